@@ -0,0 +1,212 @@
+package tslab
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/dfense/tslab/things"
+	log "github.com/sirupsen/logrus"
+)
+
+// OverflowPolicy what the listener does with an event when its queue is full
+type OverflowPolicy uint8
+
+// overflow policies
+const (
+	OverflowBlock      OverflowPolicy = iota + 1 // the thing waits until there is room
+	OverflowDropNewest                           // the new event is dropped
+	OverflowDropOldest                           // the oldest queued event is dropped to make room
+	OverflowSample                               // once half full only one in Sample events of a type is queued
+)
+
+var (
+	defaultSample = 10 // events of a type per one kept by OverflowSample
+
+	errOverflow = errors.New("backpressure must be block, drop-newest, drop-oldest or sample[:<n>]")
+	errBuffer   = errors.New("event buffer must be at least 1")
+)
+
+// Backpressure how the listener queues the events of the things on their way
+// to the sinks, and what gives when the sinks can't keep up
+type Backpressure struct {
+	Buffer int            // events queued between the things and the sinks
+	Policy OverflowPolicy // what gives when the queue is full
+	Sample int            // OverflowSample keeps one in Sample events of a thing type
+}
+
+// DefaultBackpressure things wait for the sinks, as they always did
+func DefaultBackpressure() Backpressure {
+	return Backpressure{Buffer: eventBuffer, Policy: OverflowBlock, Sample: defaultSample}
+}
+
+// ParseBackpressure policy from its String form, with the default buffer
+// block, drop-newest, drop-oldest, sample, sample:20
+func ParseBackpressure(spec string) (Backpressure, error) {
+
+	b := DefaultBackpressure()
+	spec = strings.ToLower(strings.TrimSpace(spec))
+	switch {
+	case spec == "block":
+		b.Policy = OverflowBlock
+	case spec == "drop-newest":
+		b.Policy = OverflowDropNewest
+	case spec == "drop-oldest":
+		b.Policy = OverflowDropOldest
+	case spec == "sample":
+		b.Policy = OverflowSample
+	case strings.HasPrefix(spec, "sample:"):
+		b.Policy = OverflowSample
+		n, err := strconv.Atoi(strings.TrimPrefix(spec, "sample:"))
+		if err != nil {
+			return b, errOverflow
+		}
+		b.Sample = n
+	default:
+		return b, errOverflow
+	}
+	return b, b.Validate()
+}
+
+// Validate the backpressure can be used by a listener
+func (b Backpressure) Validate() error {
+	switch {
+	case b.Policy < OverflowBlock || b.Policy > OverflowSample:
+		return errOverflow
+	case b.Buffer < 1:
+		return errBuffer
+	case b.Policy == OverflowSample && b.Sample < 1:
+		return fmt.Errorf("backpressure %s: sample must be at least 1", b)
+	}
+	return nil
+}
+
+// String spec of the policy, see ParseBackpressure
+func (b Backpressure) String() string {
+	switch b.Policy {
+	case OverflowBlock:
+		return "block"
+	case OverflowDropNewest:
+		return "drop-newest"
+	case OverflowDropOldest:
+		return "drop-oldest"
+	case OverflowSample:
+		return fmt.Sprintf("sample:%d", b.Sample)
+	}
+	return "unknown"
+}
+
+// BackpressureStats state of the event queue of the listener
+type BackpressureStats struct {
+	Backpressure
+	Queued   int               // events waiting for the sinks
+	Received uint64            // events the things and the listener published
+	Dropped  map[string]uint64 // events dropped by thing type, by the queue or a sink
+}
+
+// SetBackpressure size of the event queue and what gives when it is full,
+// set it before StartListener
+// returns an error if b isn't valid
+func (l *Listener) SetBackpressure(b Backpressure) error {
+	if err := b.Validate(); err != nil {
+		return err
+	}
+	l.backpressure = b
+	return nil
+}
+
+// BackpressureStats the policy of the event queue, how full it is and what it dropped
+func (l *Listener) BackpressureStats() BackpressureStats {
+
+	s := BackpressureStats{
+		Backpressure: l.backpressure,
+		Queued:       len(l.queue),
+		Received:     atomic.LoadUint64(&l.received),
+		Dropped:      make(map[string]uint64),
+	}
+	l.dropLock.Lock()
+	for thingType, n := range l.dropped {
+		s.Dropped[thingType] = n
+	}
+	l.dropLock.Unlock()
+	return s
+}
+
+// pump move the events of the things from eventC to the queue of the sinks,
+// applying the overflow policy, until eventC is closed
+func (l *Listener) pump() {
+
+	defer close(l.queue)
+	sampled := make(map[string]int) // events of each type seen while sampling
+	for e := range l.eventC {
+		l.stamp(&e) // before any drop, so drops show as gaps in Seq
+		l.seen(e)   // a thing whose events are dropped isn't silent
+		switch l.backpressure.Policy {
+		case OverflowBlock:
+			l.queue <- e
+			continue
+		case OverflowDropOldest:
+			for !l.offer(e) {
+				select {
+				case old := <-l.queue:
+					l.drop(old)
+				default: // taken by the sinks meanwhile
+				}
+			}
+			continue
+		case OverflowSample:
+			if len(l.queue) >= cap(l.queue)/2 {
+				sampled[e.ThingType]++
+				if (sampled[e.ThingType]-1)%l.backpressure.Sample != 0 {
+					l.drop(e)
+					continue
+				}
+			} else if len(sampled) > 0 {
+				sampled = make(map[string]int) // caught up, start over
+			}
+		}
+		if !l.offer(e) {
+			l.drop(e)
+		}
+	}
+}
+
+// offer queue an event unless the queue is full
+func (l *Listener) offer(e things.ThingEvent) bool {
+	select {
+	case l.queue <- e:
+		return true
+	default:
+		return false
+	}
+}
+
+// drop count an event that didn't make it to a sink, dropped by the queue or
+// by the queue of the sink
+func (l *Listener) drop(e things.ThingEvent) {
+	l.dropLock.Lock()
+	l.dropped[e.ThingType]++
+	n := l.dropped[e.ThingType]
+	l.dropLock.Unlock()
+
+	// warn on the first of a run of drops, not on every event
+	if n&(1<<10-1) == 1 {
+		log.Warnf("events dropped (%s), %d %s events so far", l.backpressure, n, e.ThingType)
+	}
+}
+
+// logDrops log the events dropped by thing type, if any
+func (l *Listener) logDrops() {
+	s := l.BackpressureStats()
+	types := make([]string, 0, len(s.Dropped))
+	for thingType := range s.Dropped {
+		types = append(types, thingType)
+	}
+	sort.Strings(types)
+	for _, thingType := range types {
+		log.Infof("backpressure %s dropped %d of %d events: %s", s.Backpressure, s.Dropped[thingType], s.Received, thingType)
+	}
+}
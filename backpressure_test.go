@@ -0,0 +1,159 @@
+package tslab
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dfense/tslab/things"
+)
+
+// TestParseBackpressure specs of the policies.
+func TestParseBackpressure(t *testing.T) {
+
+	tests := []struct {
+		spec   string
+		policy OverflowPolicy
+		sample int
+		ok     bool
+	}{
+		{"block", OverflowBlock, defaultSample, true},
+		{"Drop-Newest", OverflowDropNewest, defaultSample, true},
+		{"drop-oldest", OverflowDropOldest, defaultSample, true},
+		{"sample", OverflowSample, defaultSample, true},
+		{"sample:20", OverflowSample, 20, true},
+		{"sample:0", OverflowSample, 0, false},
+		{"sample:x", OverflowSample, defaultSample, false},
+		{"drop", 0, 0, false},
+	}
+	for _, tt := range tests {
+		b, err := ParseBackpressure(tt.spec)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: expected ok %t: %v", tt.spec, tt.ok, err)
+			continue
+		}
+		if tt.ok && (b.Policy != tt.policy || b.Sample != tt.sample || b.Buffer != eventBuffer) {
+			t.Errorf("%s: expected %d sample %d: %+v", tt.spec, tt.policy, tt.sample, b)
+		}
+		if tt.ok {
+			if again, _ := ParseBackpressure(b.String()); again != b {
+				t.Errorf("%s: expected %+v back from %s: %+v", tt.spec, b, b, again)
+			}
+		}
+	}
+}
+
+// TestPumpPolicies what each policy keeps of ten events of a type offered to
+// a queue of four that nobody reads.
+func TestPumpPolicies(t *testing.T) {
+
+	tests := []struct {
+		policy Backpressure
+		kept   []uint64 // things of the events queued
+	}{
+		{Backpressure{Buffer: 4, Policy: OverflowDropNewest}, []uint64{1, 2, 3, 4}},
+		{Backpressure{Buffer: 4, Policy: OverflowDropOldest}, []uint64{7, 8, 9, 10}},
+		// half full after 2, then 1 in 3 of the rest until full
+		{Backpressure{Buffer: 4, Policy: OverflowSample, Sample: 3}, []uint64{1, 2, 3, 6}},
+	}
+	for _, tt := range tests {
+		l := NewListener()
+		if err := l.SetBackpressure(tt.policy); err != nil {
+			t.Fatal(err)
+		}
+		l.eventC = make(chan things.ThingEvent, 10)
+		publish(l, 10, "Light")
+		close(l.eventC)
+		l.queue = make(chan things.ThingEvent, tt.policy.Buffer)
+		l.pump() // until eventC is empty, then closes the queue
+
+		kept := make([]uint64, 0)
+		for e := range l.queue {
+			kept = append(kept, e.ThingID)
+		}
+		if len(kept) != len(tt.kept) {
+			t.Errorf("%s: expected %v: %v", tt.policy, tt.kept, kept)
+			continue
+		}
+		for i := range kept {
+			if kept[i] != tt.kept[i] {
+				t.Errorf("%s: expected %v: %v", tt.policy, tt.kept, kept)
+				break
+			}
+		}
+		stats := l.BackpressureStats()
+		if stats.Received != 10 || stats.Dropped["Light"] != 6 || len(stats.Dropped) != 1 {
+			t.Errorf("%s: expected 6 of 10 Light events dropped: %+v", tt.policy, stats)
+		}
+	}
+}
+
+// TestSinkPolicies a full sink queue never waits, it drops as the policy of
+// the listener says, and what it drops is counted by the sink and by thing
+// type.
+func TestSinkPolicies(t *testing.T) {
+
+	tests := []struct {
+		policy OverflowPolicy
+		kept   []uint64
+	}{
+		{OverflowBlock, []uint64{1, 2}},
+		{OverflowDropNewest, []uint64{1, 2}},
+		{OverflowDropOldest, []uint64{4, 5}},
+		{OverflowSample, []uint64{1, 2}},
+	}
+	for _, tt := range tests {
+		l := NewListener()
+		r := &sinkRunner{queue: make(chan things.ThingEvent, 2)}
+		for i := 1; i <= 5; i++ {
+			r.send(things.ThingEvent{ThingID: uint64(i), ThingType: "Light"}, tt.policy, l.drop)
+		}
+		close(r.queue)
+		kept := make([]uint64, 0)
+		for e := range r.queue {
+			kept = append(kept, e.ThingID)
+		}
+		if len(kept) != 2 || kept[0] != tt.kept[0] || kept[1] != tt.kept[1] {
+			t.Errorf("policy %d: expected %v: %v", tt.policy, tt.kept, kept)
+		}
+		if stats := r.stats(); stats.Dropped != 3 {
+			t.Errorf("policy %d: expected the sink to count 3 drops: %d", tt.policy, stats.Dropped)
+		}
+		if dropped := l.BackpressureStats().Dropped["Light"]; dropped != 3 {
+			t.Errorf("policy %d: expected 3 Light events dropped: %d", tt.policy, dropped)
+		}
+	}
+}
+
+// TestDropPolicyDropsOnly a thing under a drop policy is never held up, the
+// events it loses show in the counters of the listener.
+func TestDropPolicyDropsOnly(t *testing.T) {
+
+	defer func(n int) { sinkBuffer = n }(sinkBuffer)
+	sinkBuffer = 1
+
+	l := NewListener()
+	l.SetWatchdog(0)
+	l.SetBackpressure(Backpressure{Buffer: 1, Policy: OverflowDropNewest})
+	stuck := &recorder{hold: make(chan struct{})}
+	l.AddSink("stuck", stuck)
+	l.StartListener()
+
+	published := make(chan struct{})
+	go func() { publish(l, 100, "Light"); close(published) }()
+	select {
+	case <-published:
+	case <-time.After(time.Second):
+		t.Fatal("expected a drop policy never to hold up the things")
+	}
+	close(stuck.hold)
+	l.Stop(true)
+
+	stats := l.BackpressureStats()
+	written := uint64(len(stuck.written()))
+	if stats.Received != 100 || written+stats.Dropped["Light"] != 100 {
+		t.Errorf("expected every event written or dropped: %d written %+v", written, stats)
+	}
+	if sinks := l.SinkStats(); len(sinks) != 0 {
+		t.Errorf("expected the sinks closed: %+v", sinks)
+	}
+}
@@ -4,19 +4,27 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/dfense/tslab"
+	"github.com/dfense/tslab/things"
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/alecthomas/kingpin.v2"
 	"gopkg.in/natefinch/lumberjack.v2"
 )
 
 const (
-	errProcessingCLI  = 1 // error return code from main
-	errSettingLogLvl  = "error setting log level %s:"
-	errCreatingFile   = "error creating file %s"
-	errCreatingLogDir = "error creating log dir %s"
+	errProcessingCLI   = 1 // error return code from main
+	errSettingLogLvl   = "error setting log level %s:"
+	errCreatingFile    = "error creating file %s"
+	errCreatingLogDir  = "error creating log dir %s"
+	errParsingClock    = "error parsing clock %s"
+	errLoadingSnapshot = "error loading snapshot %s"
+	errAddingSink      = "error adding sink %s"
+	errBackpressure    = "error setting backpressure %s"
+	errFlushPolicy     = "error setting flush policy %s"
 
 	logFile   = "teslacc.log" // file location for logged output from program code
 	eventFile = "events.txt"  // the events database file basename. (uses rollover logging)
@@ -29,6 +37,25 @@ var (
 	app       = kingpin.New("TESLA Code Challenge", "A short async demonstration for concurrency")
 	autoStart = kingpin.Flag("autostart", "start (1) of each thing type {t, true, f, false}").Short('a').Default("true").String()
 	loglevel  = kingpin.Flag("loglevel", "Set log level {PANIC, FATAL, ERROR, WARN, INFO, DEBUG}").Short('l').Default("INFO").String()
+	seed      = kingpin.Flag("seed", "seed for a reproducible run, 0 picks one from the clock (see log)").Short('s').Default("0").Int64()
+	clockSpec = kingpin.Flag("clock", "clock of the run {real, afap (as fast as possible), <n>x e.g. 60x}").Short('c').Default("real").String()
+	startTime = kingpin.Flag("start", "simulated start time RFC3339, default now (ignored by the real clock)").String()
+	scenario  = kingpin.Flag("scenario", "TOML scenario file declaring the fleet and timed actions, replaces autostart").String()
+	replay    = kingpin.Flag("replay", "events file to replay through the listener").String()
+	replaySpd = kingpin.Flag("replay-speed", "multiplier of the original event timing, 0 as fast as possible").Default("1").Float64()
+	replayTT  = kingpin.Flag("replay-type", "replay only events of this thing_type, repeatable").Strings()
+	replayIDs = kingpin.Flag("replay-id", "replay only events of this thing ID, repeatable").Uint64List()
+	watchdog  = kingpin.Flag("watchdog", "gaps between events a thing may miss before it is flagged stale, 0 turns the watchdog off").Default("10").Float64()
+	restore   = kingpin.Flag("restore", "snapshot file to restore the fleet from, replaces autostart").String()
+	snapshot  = kingpin.Flag("snapshot", "snapshot file written when the program exits").String()
+	snapEvery = kingpin.Flag("snapshot-every", "also write the snapshot this often in clock time, e.g. 10m").Duration()
+	bpSpec    = kingpin.Flag("backpressure", "when the event queue is full {block, drop-newest, drop-oldest, sample[:<n>]}").Default("block").String()
+	bpBuffer  = kingpin.Flag("event-buffer", "events queued between the things and the sinks").Default("5").Int()
+	flushSize = kingpin.Flag("flush-bytes", "sinks flush once this many bytes are buffered, 0 no limit").Default("4096").Int()
+	flushEvts = kingpin.Flag("flush-events", "sinks flush after this many events, 0 no limit").Default("0").Int()
+	flushWait = kingpin.Flag("flush-latency", "sinks flush an event that waited this long in wall time e.g. 250ms, 0 flushes whenever a sink catches up").Default("0").Duration()
+	fsync     = kingpin.Flag("fsync", "files are synced to disk {never, flush, <interval> e.g. 1s}").Default("never").String()
+	sinks     = kingpin.Flag("sink", "also send events to [name=]{file:<path>, tcp:<host:port>, udp:<host:port>, mem:<size>}, repeatable").Strings()
 
 	// TODO build data at compile time
 	// version   string
@@ -46,7 +73,18 @@ func main() {
 	// allow for configuration and injection of items before starting supervisor
 	// this can also be expanded into a richer Confuration object/service/factory
 	configData := tslab.ConfigData{
-		Autostart: *autoStart,
+		Autostart:  *autoStart,
+		Seed:       *seed,
+		Scenario:   *scenario,
+		ReplayFile: *replay,
+		Replay: tslab.ReplayConfig{
+			Speed: *replaySpd,
+			Types: *replayTT,
+			IDs:   *replayIDs,
+		},
+		Restore:       *restore,
+		Snapshot:      *snapshot,
+		SnapshotEvery: *snapEvery,
 	}
 
 	// create the io.WriterCloser and inject into listener
@@ -55,9 +93,56 @@ func main() {
 		log.Fatalf(errCreatingFile, err)
 	}
 
+	// a restored fleet carries on from the time of its snapshot
+	start := *startTime
+	if *restore != "" && start == "" {
+		snap, err := tslab.LoadSnapshot(*restore)
+		if err != nil {
+			log.Fatalf(errLoadingSnapshot, err)
+		}
+		start = snap.Taken.Format(time.RFC3339Nano)
+	}
+
+	// one clock for the things and the listener
+	clock, err := newClock(*clockSpec, start)
+	if err != nil {
+		log.Fatalf(errParsingClock, err)
+	}
+	things.SetClock(clock)
+
 	// create a listener to inject
 	listener := tslab.NewListener()
+	flush := tslab.FlushPolicy{MaxBytes: *flushSize, MaxEvents: *flushEvts, MaxLatency: *flushWait}
+	if err := flush.ParseSync(*fsync); err != nil {
+		log.Fatalf(errFlushPolicy, err)
+	}
+	if err := listener.SetFlushPolicy(flush); err != nil {
+		log.Fatalf(errFlushPolicy, err)
+	}
 	listener.SetWriter(eventWriter)
+	for _, spec := range *sinks {
+		name := spec
+		if i := strings.Index(spec, "="); i > 0 {
+			name, spec = spec[:i], spec[i+1:]
+		}
+		sink, err := tslab.ParseSink(spec)
+		if err != nil {
+			log.Fatalf(errAddingSink, err)
+		}
+		if err := listener.AddSink(name, sink); err != nil {
+			log.Fatalf(errAddingSink, err)
+		}
+	}
+	listener.SetClock(clock)
+	listener.SetWatchdog(*watchdog)
+	backpressure, err := tslab.ParseBackpressure(*bpSpec)
+	if err != nil {
+		log.Fatalf(errBackpressure, err)
+	}
+	backpressure.Buffer = *bpBuffer
+	if err := listener.SetBackpressure(backpressure); err != nil {
+		log.Fatalf(errBackpressure, err)
+	}
 
 	//inject Listener into supervisor
 	tslab.SetListener(listener)
@@ -89,12 +174,25 @@ func main() {
 	tslab.Console()
 }
 
+// newClock clock of the run from the CLI args
+func newClock(spec, start string) (things.Clock, error) {
+	t := time.Now()
+	if start != "" {
+		var err error
+		t, err = time.Parse(time.RFC3339, start)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return things.ParseClock(spec, t)
+}
+
 // setupLogger ensure log dir is created/existing, and configure loglevel, and logfile
 func setupLogger(logLevel string) {
 
 	err := os.MkdirAll(logPath, 0744)
 	if err != nil {
-		log.Fatal(errCreatingLogDir, err)
+		log.Fatalf(errCreatingLogDir, err)
 	}
 
 	level, err := log.ParseLevel(*loglevel)
@@ -2,9 +2,11 @@ package tslab
 
 import (
 	"bufio"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -22,6 +24,7 @@ var (
 	errInvalidThingType   = errors.New("invalid thing type, try again")
 	errImproperNumberArgs = errors.New("wrong number of arguents to command, try again")
 	errConvertingToInt    = errors.New("error converting param to int, try again")
+	errConvertingToFloat  = errors.New("error converting param to a positive number, try again")
 	errMaxQtyExceeded     = errors.New("error maximum qty of things to create is (100)")
 
 	lastType = things.TBatteryPack
@@ -73,41 +76,109 @@ func printMenu() {
 Command | Arguments       | Description 
 ----------------------------------------------------------------
    h    |                 | print this help menu
-   li   |                 | list all things running/publishing
-   nt   | <type> <qty>    | new thing by <type> <qty 1-1000>
+   li   | [site]          | list all things running/publishing, or those on [site]
+   ls   |                 | list sites and their energy balance
+   nt   | <type> <qty> [s]| new thing by <type> <qty 1-1000> on site [s]
+   as   | <id> <site>     | assign thing <id> to <site>
    stop |                 | stop & delete all things, exit program 
    st   | <type>          | stop things by type [see types below]
    si   | <id>            | stop thing by id number
+   cd   | <id|type> <cad> | cadence of thing by id or type, e.g. cd b jitter:1s:10%
+                            fixed:<d>, jitter:<d>:<pct>%, uniform:<min>-<max>, poisson:<mean>
+   pa   | <id|type>       | pause thing by id, or all things of a type
+   re   | <id|type>       | resume thing by id, or all things of a type
+   ss   | <site>          | stop all things on a site
    sa   |                 | stop all things, do NOT exit program
+   at   | <id> <id>       | attach inverter <id> to battery <id>
+   cmd  | <id> <cmd> [val]| send command to thing, e.g. cmd 3 level 80
+   rp   | <file> [speed]  | replay an events file, [speed] x original timing (0 = no waits)
+   snap | <file>          | save a snapshot of all things to <file>, restore with --restore
+   bp   |                 | backpressure of the event queue and events dropped by type
+   sk   | [add|rm|tail]   | list sinks, sk add <name> <spec>, sk rm <name>, sk tail <name> [n]
+                            file:<path>, tcp:<host:port>, udp:<host:port>, mem:<size>
    q    |                 | quit, stop all things, exit program
------------------------------------------------------------------
-valid thing <type> -> [b=battery, i=inverter, l=light]
-
-`
+-----------------------------------------------------------------`
 	fmt.Println(menu)
+
+	// thing types come from the registry, custom types included
+	types := make([]string, 0)
+	for _, info := range things.Types() {
+		types = append(types, info.ShortCode+"="+info.Name)
+	}
+	fmt.Printf("valid thing <type> -> [%s]\n\n\n", strings.Join(types, ", "))
 }
 
 // processCommand verify and dispatch command from menu
 func processCommand(command string) error {
 
-	command = strings.ToLower(command)
 	c := strings.Fields(command) // simple space delimited parser
 	if len(c) == 0 {
 		return errNoCommandEntered
 	}
+	c[0] = strings.ToLower(c[0]) // arguments keep their case, site and file names included
 	// simple simple parser. If it gets more complex,  reconsider a lib
 	switch c[0] {
 	case "h":
 		printMenu()
 	case "li":
-		cids := GetThingsList()
+		var cids []things.CID
+		switch len(c) {
+		case 1:
+			cids = GetThingsList()
+		case 2:
+			cids = GetSiteThingsList(c[1])
+		default:
+			return errImproperNumberArgs
+		}
 		fmt.Println("\n                      list of things                              ")
-		fmt.Println(" CID     | ThingType        | CreatedOn                 | TTLEvts    ")
-		fmt.Println("-----------------------------------------------------------------------")
+		fmt.Println(" CID     | ThingType        | Site         | State    | CreatedOn                 | TTLEvts    | Alarms ")
+		fmt.Println("------------------------------------------------------------------------------------------------------------")
+		alarms := 0
 		for _, cid := range cids {
-			fmt.Printf(" %-7d| %-18s| %-26s| %-10d\n", cid.CidNumber, cid.Type, cid.CreateTime.Format(time.RFC3339), cid.TTLEvents)
+			state := cid.State.String()
+			if cid.Stale {
+				state = "stale"
+			}
+			fmt.Printf(" %-7d| %-18s| %-13s| %-9s| %-26s| %-11d| %-6d\n", cid.CidNumber, cid.Type, cid.Site, state, cid.CreateTime.Format(time.RFC3339), cid.TTLEvents, cid.Alarms)
+			alarms += cid.Alarms
+		}
+		fmt.Printf("(%d total thing(s) running, %d active alarm(s)) \n\n", len(cids), alarms)
+
+	case "ls":
+		balances := GetSiteBalances()
+		fmt.Println("\n                      list of sites                               ")
+		fmt.Println(" Site         | Things | Generation W | Load W     | Storage W  | Export W   | Mismatch W ")
+		fmt.Println("------------------------------------------------------------------------------------------")
+		for _, b := range balances {
+			mismatch := "-" // not metered
+			if b.Metered {
+				mismatch = fmt.Sprintf("%.1f", b.Mismatch)
+			}
+			fmt.Printf(" %-13s| %-7d| %-13.1f| %-11.1f| %-11.1f| %-11.1f| %-11s\n", b.Site, b.Things, b.Generation, b.Load, b.StorageCharge, b.GridExport, mismatch)
+		}
+		fmt.Printf("(%d total site(s)) \n\n", len(balances))
+
+	case "as":
+		if len(c) != 3 {
+			return errImproperNumberArgs
+		}
+		id, err := strconv.ParseUint(c[1], 10, 64)
+		if err != nil {
+			return errConvertingToInt
+		}
+		err = AssignSite(id, c[2])
+		if err != nil {
+			return err
+		}
+
+	case "ss":
+		if len(c) != 2 {
+			return errImproperNumberArgs
+		}
+		err := StopThingsBySite(c[1])
+		if err != nil {
+			return err
 		}
-		fmt.Printf("(%d total thing(s) running) \n\n", len(cids))
 
 	// new thing, create
 	case "nt":
@@ -119,14 +190,14 @@ func processCommand(command string) error {
 			CreateThing(lastType, 1)
 
 			// default used, then rotate to next thing in line, variety :-)
-			if lastType == things.TLight {
+			if int(lastType) == len(things.Types()) {
 				lastType = things.TBatteryPack
 				break
 			}
 			lastType++
 
 		// use parameters if provided
-		case 3:
+		case 3, 4:
 			qty, err := strconv.Atoi(c[2])
 			if err != nil {
 				return errConvertingToInt
@@ -139,7 +210,11 @@ func processCommand(command string) error {
 			if err1 != nil {
 				return errInvalidThingType
 			}
-			CreateThing(thingType, qty)
+			site := DefaultSite
+			if len(c) == 4 {
+				site = c[3]
+			}
+			CreateThingOnSite(thingType, qty, site)
 
 		default:
 			return errImproperNumberArgs
@@ -177,6 +252,120 @@ func processCommand(command string) error {
 		default:
 			return errImproperNumberArgs
 		}
+	case "at":
+		switch len(c) {
+		case 3:
+			inverterID, err := strconv.ParseUint(c[1], 10, 64)
+			if err != nil {
+				return errConvertingToInt
+			}
+			batteryID, err := strconv.ParseUint(c[2], 10, 64)
+			if err != nil {
+				return errConvertingToInt
+			}
+			err = AttachInverter(inverterID, batteryID)
+			if err != nil {
+				return err
+			}
+		default:
+			return errImproperNumberArgs
+		}
+	case "cmd":
+		if len(c) < 3 || len(c) > 4 {
+			return errImproperNumberArgs
+		}
+		id, err := strconv.ParseUint(c[1], 10, 64)
+		if err != nil {
+			return errConvertingToInt
+		}
+		cmd := things.Command{Name: strings.ToLower(c[2])}
+		if len(c) == 4 {
+			cmd.Value = strings.ToLower(c[3])
+		}
+		ack, err := SendCommand(id, cmd)
+		if err != nil {
+			return err
+		}
+		if !ack.Accepted {
+			fmt.Printf("\n--- rejected: %s ---\n\n", ack.Reason)
+			break
+		}
+		fmt.Println("\n--- accepted ---")
+		fmt.Println("")
+	case "cd":
+		if len(c) != 3 {
+			return errImproperNumberArgs
+		}
+		cadence, err := things.ParseCadence(c[2])
+		if err != nil {
+			return err
+		}
+		if id, err := strconv.ParseUint(c[1], 10, 64); err == nil {
+			return SetCadenceByCID(id, cadence)
+		}
+		thingType, err := verifyThingType(c[1])
+		if err != nil {
+			return err
+		}
+		return SetCadenceByType(thingType, cadence)
+	case "pa", "re":
+		if len(c) != 2 {
+			return errImproperNumberArgs
+		}
+		pause := c[0] == "pa"
+		if id, err := strconv.ParseUint(c[1], 10, 64); err == nil {
+			if pause {
+				return PauseThingByCID(id)
+			}
+			return ResumeThingByCID(id)
+		}
+		thingType, err := verifyThingType(c[1])
+		if err != nil {
+			return err
+		}
+		if pause {
+			return PauseThingsByType(thingType)
+		}
+		return ResumeThingsByType(thingType)
+	case "rp":
+		if len(c) < 2 || len(c) > 3 {
+			return errImproperNumberArgs
+		}
+		cfg := ReplayConfig{Speed: 1}
+		if len(c) == 3 {
+			speed, err := strconv.ParseFloat(c[2], 64)
+			if err != nil || speed < 0 {
+				return errConvertingToFloat
+			}
+			cfg.Speed = speed
+		}
+		id, err := StartReplay(c[1], cfg)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("\n--- replaying as %d, stop with si %d ---\n\n", id, id)
+	case "snap":
+		if len(c) != 2 {
+			return errImproperNumberArgs
+		}
+		if err := SaveSnapshot(c[1]); err != nil {
+			return err
+		}
+		fmt.Printf("\n--- snapshot saved to %s ---\n\n", c[1])
+	case "bp":
+		bp := GetBackpressure()
+		fmt.Printf("\n--- backpressure %s, %d of %d events queued, %d received ---\n", bp.Backpressure, bp.Queued, bp.Buffer, bp.Received)
+		types := make([]string, 0, len(bp.Dropped))
+		for thingType := range bp.Dropped {
+			types = append(types, thingType)
+		}
+		sort.Strings(types)
+		for _, thingType := range types {
+			fmt.Printf(" %-18s| %d dropped\n", thingType, bp.Dropped[thingType])
+		}
+		fmt.Println("")
+	case "sk":
+		return sinkCommand(c)
 	case "q", "stop":
 		Stop(true)
 	default:
@@ -187,15 +376,53 @@ func processCommand(command string) error {
 	return nil
 }
 
-func verifyThingType(c string) (things.ThingType, error) {
-	switch c {
-	case "b":
-		return things.TBatteryPack, nil
-	case "i":
-		return things.TInverter, nil
-	case "l":
-		return things.TLight, nil
+// sinkCommand list, add, remove or tail the event sinks
+func sinkCommand(c []string) error {
+
+	switch {
+	case len(c) == 1:
+		fmt.Println("\n                      list of sinks                               ")
+		fmt.Println(" Name           | Queued   | Written      | Dropped    | Errors     ")
+		fmt.Println("--------------------------------------------------------------------")
+		for _, s := range GetSinks() {
+			fmt.Printf(" %-15s| %-9d| %-13d| %-11d| %-11d\n", s.Name, s.Queued, s.Written, s.Dropped, s.Errors)
+		}
+		fmt.Println("")
+	case strings.EqualFold(c[1], "add") && len(c) == 4:
+		return AddSink(c[2], c[3])
+	case strings.EqualFold(c[1], "rm") && len(c) == 3:
+		return RemoveSink(c[2])
+	case strings.EqualFold(c[1], "tail") && (len(c) == 3 || len(c) == 4):
+		n := 10
+		if len(c) == 4 {
+			var err error
+			if n, err = strconv.Atoi(c[3]); err != nil || n < 1 {
+				return errConvertingToInt
+			}
+		}
+		events, err := TailSink(c[2], n)
+		if err != nil {
+			return err
+		}
+		fmt.Println("")
+		for _, e := range events {
+			eventJSON, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(eventJSON))
+		}
+		fmt.Println("")
 	default:
+		return errImproperNumberArgs
+	}
+	return nil
+}
+
+func verifyThingType(c string) (things.ThingType, error) {
+	info, ok := things.LookupCode(c)
+	if !ok {
 		return 0, errInvalidThingType
 	}
+	return info.Type, nil
 }
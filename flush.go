@@ -0,0 +1,110 @@
+package tslab
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SyncPolicy when a sink asks the OS to put what it flushed on disk
+type SyncPolicy uint8
+
+// sync policies
+const (
+	SyncNever    SyncPolicy = iota + 1 // leave it to the OS
+	SyncFlush                          // after every flush
+	SyncInterval                       // every SyncEvery, flushing first
+)
+
+var (
+	defaultFlushBytes = 4096 // bytes buffered by a sink before it flushes
+
+	errSync      = errors.New("fsync must be never, flush or an interval e.g. 1s")
+	errFlushSpec = errors.New("flush limits must not be negative")
+)
+
+// FlushPolicy when a sink sends on what it buffered. It flushes on whichever
+// limit is hit first, a limit of 0 is no limit. Without a MaxLatency a sink
+// flushes as soon as it has no more events queued. Latencies are wall time
+// whatever the clock of the run, they are for the people following the stream.
+type FlushPolicy struct {
+	MaxBytes   int           // bytes buffered
+	MaxEvents  int           // events written since the last flush
+	MaxLatency time.Duration // time the oldest unflushed event has waited
+	Sync       SyncPolicy    // when a flushed file is synced to disk
+	SyncEvery  time.Duration // time between syncs of SyncInterval
+}
+
+// Syncer implemented by sinks that can put what they flushed on disk
+type Syncer interface {
+	Sync() error
+}
+
+// buffered implemented by sinks that can tell how many bytes they hold
+type buffered interface {
+	Buffered() int
+}
+
+// DefaultFlushPolicy flush every 4KB and whenever the sink catches up, no syncs
+func DefaultFlushPolicy() FlushPolicy {
+	return FlushPolicy{MaxBytes: defaultFlushBytes, Sync: SyncNever}
+}
+
+// ParseSync set the sync policy from its String form
+// never, flush, or an interval e.g. 1s
+func (p *FlushPolicy) ParseSync(spec string) error {
+
+	spec = strings.ToLower(strings.TrimSpace(spec))
+	switch spec {
+	case "never":
+		p.Sync, p.SyncEvery = SyncNever, 0
+	case "flush":
+		p.Sync, p.SyncEvery = SyncFlush, 0
+	default:
+		every, err := time.ParseDuration(spec)
+		if err != nil || every <= 0 {
+			return errSync
+		}
+		p.Sync, p.SyncEvery = SyncInterval, every
+	}
+	return nil
+}
+
+// Validate the policy can be used by a sink
+func (p FlushPolicy) Validate() error {
+	switch {
+	case p.MaxBytes < 0 || p.MaxEvents < 0 || p.MaxLatency < 0:
+		return errFlushSpec
+	case p.Sync < SyncNever || p.Sync > SyncInterval:
+		return errSync
+	case p.Sync == SyncInterval && p.SyncEvery <= 0:
+		return errSync
+	}
+	return nil
+}
+
+// String the limits of the policy
+func (p FlushPolicy) String() string {
+	sync := "never"
+	switch p.Sync {
+	case SyncFlush:
+		sync = "flush"
+	case SyncInterval:
+		sync = p.SyncEvery.String()
+	}
+	return fmt.Sprintf("bytes %d, events %d, latency %s, fsync %s", p.MaxBytes, p.MaxEvents, p.MaxLatency, sync)
+}
+
+// SetFlushPolicy when sinks flush and sync, for the sinks added from now on,
+// SetWriter included
+// returns an error if p isn't valid
+func (l *Listener) SetFlushPolicy(p FlushPolicy) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	l.sinksLock.Lock()
+	l.flush = p
+	l.sinksLock.Unlock()
+	return nil
+}
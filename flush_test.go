@@ -0,0 +1,121 @@
+package tslab
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dfense/tslab/things"
+)
+
+// TestParseSync specs of the sync policies.
+func TestParseSync(t *testing.T) {
+
+	tests := []struct {
+		spec  string
+		sync  SyncPolicy
+		every time.Duration
+		ok    bool
+	}{
+		{"never", SyncNever, 0, true},
+		{"Flush", SyncFlush, 0, true},
+		{"250ms", SyncInterval, 250 * time.Millisecond, true},
+		{"0s", 0, 0, false},
+		{"-1s", 0, 0, false},
+		{"always", 0, 0, false},
+	}
+	for _, tt := range tests {
+		p := DefaultFlushPolicy()
+		err := p.ParseSync(tt.spec)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: expected ok %t: %v", tt.spec, tt.ok, err)
+			continue
+		}
+		if tt.ok && (p.Sync != tt.sync || p.SyncEvery != tt.every || p.Validate() != nil) {
+			t.Errorf("%s: expected %d every %s: %+v", tt.spec, tt.sync, tt.every, p)
+		}
+	}
+	if err := (FlushPolicy{MaxEvents: -1, Sync: SyncNever}).Validate(); err != errFlushSpec {
+		t.Errorf("expected negative limits rejected: %v", err)
+	}
+}
+
+// TestFlushTriggers a sink flushes on whichever limit of its policy it hits
+// first. Five events are written at once on a clock that runs as fast as
+// possible, held until the sink has taken them, so the latency timer fires
+// at a known time after them. Each event buffers 100 bytes.
+func TestFlushTriggers(t *testing.T) {
+
+	defer func(c things.Clock) { sinkClock = c }(sinkClock)
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		policy  FlushPolicy
+		flushes []flush // as recorded, the last one by Close
+		syncs   int
+	}{
+		{"events", FlushPolicy{MaxEvents: 2, MaxLatency: time.Hour, Sync: SyncNever},
+			[]flush{{2, start}, {2, start}, {1, start.Add(time.Hour)}, {0, start.Add(time.Hour)}}, 0},
+		{"bytes", FlushPolicy{MaxBytes: 250, MaxLatency: time.Hour, Sync: SyncNever},
+			[]flush{{3, start}, {2, start.Add(time.Hour)}, {0, start.Add(time.Hour)}}, 0},
+		{"latency", FlushPolicy{MaxLatency: time.Second, Sync: SyncNever},
+			[]flush{{5, start.Add(time.Second)}, {0, start.Add(time.Second)}}, 0},
+		{"fsync on flush", FlushPolicy{MaxEvents: 2, MaxLatency: time.Hour, Sync: SyncFlush},
+			[]flush{{2, start}, {2, start}, {1, start.Add(time.Hour)}, {0, start.Add(time.Hour)}}, 4},
+		{"fsync interval", FlushPolicy{MaxLatency: time.Second, Sync: SyncInterval, SyncEvery: time.Hour},
+			[]flush{{5, start.Add(time.Second)}, {0, start.Add(time.Second)}}, 1}, // on close only
+	}
+	for _, tt := range tests {
+		clock := things.NewAFAPClock(start)
+		sinkClock = clock
+		sink := &recorder{clock: clock}
+
+		clock.Join() // no timer fires while the events are sent
+		r := newSinkRunner(tt.name, sink, tt.policy)
+		for i := 1; i <= 5; i++ {
+			r.send(things.ThingEvent{ThingID: uint64(i)}, OverflowBlock, nil)
+		}
+		sink.await(t, 5)
+		clock.Leave()
+		for deadline := time.Now().Add(time.Second); r.stats().Written < 5 || clock.Now().Equal(start); {
+			if time.Now().After(deadline) {
+				break // a policy that flushes without the timer
+			}
+			time.Sleep(time.Millisecond)
+		}
+		r.stop()
+
+		if len(sink.flushes) != len(tt.flushes) {
+			t.Errorf("%s: expected flushes %v: %v", tt.name, tt.flushes, sink.flushes)
+			continue
+		}
+		for i, f := range sink.flushes {
+			if f.events != tt.flushes[i].events || !f.at.Equal(tt.flushes[i].at) {
+				t.Errorf("%s: expected flushes %v: %v", tt.name, tt.flushes, sink.flushes)
+				break
+			}
+		}
+		if sink.syncs != tt.syncs {
+			t.Errorf("%s: expected %d syncs: %d", tt.name, tt.syncs, sink.syncs)
+		}
+	}
+}
+
+// TestFlushCatchUp without a latency limit a sink flushes once it has caught
+// up with its queue, so nothing waits unflushed.
+func TestFlushCatchUp(t *testing.T) {
+
+	sink := &recorder{}
+	r := newSinkRunner("catch up", sink, FlushPolicy{Sync: SyncNever})
+	for i := 1; i <= 5; i++ {
+		r.send(things.ThingEvent{ThingID: uint64(i)}, OverflowBlock, nil)
+	}
+	sink.await(t, 5)
+	for deadline := time.Now().Add(time.Second); sink.Buffered() > 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the sink to flush once caught up")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	r.stop()
+}
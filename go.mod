@@ -3,7 +3,7 @@ module github.com/dfense/tslab
 go 1.13
 
 require (
-	github.com/BurntSushi/toml v0.3.1 // indirect
+	github.com/BurntSushi/toml v0.3.1
 	github.com/alecthomas/units v0.0.0-20190924025748-f65c72e2690d // indirect
 	github.com/prometheus/common v0.10.0
 	github.com/sirupsen/logrus v1.6.0
@@ -1,13 +1,15 @@
 package tslab
 
 import (
-	"bufio"
-	"encoding/json"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
-	"fmt"
 	"io"
 	"os"
+	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/dfense/tslab/things"
@@ -15,24 +17,46 @@ import (
 )
 
 var (
-	eventBuffer       = 5 // buffer size of the event channel
+	eventBuffer       = 5 // default size of the event queue, see Backpressure
 	errJSONDecoding   = "decoding json: %s"
 	errClosingWriter  = "error closing writer: %s"
 	errFlushingBuffer = "error flusing buffer: %s"
 
 	errNoTypeFound = errors.New("no thing(s) with that ThingType found")
 	errIDFound     = errors.New("no thing with that CID found")
+	errNoSiteFound = errors.New("no thing(s) on that site found")
+	errEmptySite   = errors.New("site name can not be empty")
 )
 
 // Listener aggregates all events emitted from things
 type Listener struct {
+	received  uint64                 // events taken from eventC, first for 64bit atomic alignment
 	waitGroup *sync.WaitGroup        // semaphore counter for all things created
-	stopC     chan struct{}          // kill channel to stop the server
-	writer    io.WriteCloser         // stream to persist all event data
 	eventC    chan things.ThingEvent // all thing events feed into this channel:w
-
-	thingList  []things.Thing // base thing type
-	thingsLock *sync.Mutex    // lock anytime we alter table or shutdown
+	queue     chan things.ThingEvent // events on their way to the sinks, fed by pump
+	runID     string                 // tells the event IDs of this run from those of others
+
+	backpressure Backpressure      // size of queue and what gives when it is full
+	dropped      map[string]uint64 // events dropped by thing type
+	dropLock     *sync.Mutex       // guards dropped
+
+	sinks     map[string]*sinkRunner // every event is fanned out to these by name
+	sinksLock *sync.Mutex            // guards sinks, flush and subscriptions
+	flush     FlushPolicy            // flush policy of sinks added from now on
+
+	subscriptions map[*Subscription]bool // in process subscribers to the events
+
+	thingList  []things.Thing    // base thing type
+	sites      map[uint64]string // site of each thing by CID
+	thingsLock *sync.Mutex       // lock anytime we alter table or shutdown
+	siteStopC  chan struct{}     // kill channel to stop publishing site balances
+	clock      things.Clock      // times the site balances, shared with the things
+
+	watchdog   float64              // gaps of a thing allowed before it is stale, 0 is off
+	lastSeen   map[uint64]time.Time // clock time the last event of each thing was received
+	stale      map[uint64]bool      // things flagged stale by the watchdog
+	watchLock  *sync.Mutex          // guards lastSeen and stale
+	watchStopC chan struct{}        // kill channel to stop the watchdog
 }
 
 // NewListener initializes a Listener struct and creates instance
@@ -41,73 +65,190 @@ func NewListener() *Listener {
 	return &Listener{
 		waitGroup:  &sync.WaitGroup{},
 		thingsLock: &sync.Mutex{},
-		stopC:      make(chan struct{}),
-		eventC:     make(chan things.ThingEvent, 5),
+		siteStopC:  make(chan struct{}),
+		eventC:     make(chan things.ThingEvent),
+		runID:      newRunID(),
+		sites:      make(map[uint64]string),
+		clock:      things.GetClock(),
+		watchdog:   defaultWatchdogFactor,
+		lastSeen:   make(map[uint64]time.Time),
+		stale:      make(map[uint64]bool),
+		watchLock:  &sync.Mutex{},
+		watchStopC: make(chan struct{}),
+		sinks:      make(map[string]*sinkRunner),
+		sinksLock:  &sync.Mutex{},
+		flush:      DefaultFlushPolicy(),
+
+		subscriptions: make(map[*Subscription]bool),
+
+		backpressure: DefaultBackpressure(),
+		dropped:      make(map[string]uint64),
+		dropLock:     &sync.Mutex{},
 	}
 }
 
-// SetWriter dependency inject writer for all events
+// SetClock dependency inject the clock of the run, set it before StartListener.
+// Things take theirs from things.SetClock, both should be the same clock.
+func (l *Listener) SetClock(c things.Clock) {
+	l.clock = c
+}
+
+// SetWriter dependency inject writer for all events, as JSON lines. It is the
+// sink named events, a writer set again replaces it.
 func (l *Listener) SetWriter(w io.WriteCloser) {
-	l.writer = w
+	l.RemoveSink(writerSinkName)
+	l.AddSink(writerSinkName, NewWriterSink(w))
 }
 
 // StartListener receiver call to begin an Aggregator loop of all Events emitting from
-// things it subscribes to. If a writer has NOT been set, it will create default
-func (l Listener) StartListener() {
+// things it subscribes to, along with the energy balance of each site.
+// Every event is fanned out to the sinks, see AddSink.
+func (l *Listener) StartListener() {
 
-	// if writer is not set, create default
+	go l.siteLoop()
+	if l.watchdog > 0 {
+		go l.watchdogLoop()
+	}
+
+	l.queue = make(chan things.ThingEvent, l.backpressure.Buffer)
+	go l.pump()
 	go func() {
-		streamBuffer := bufio.NewWriter(l.writer)
-		for {
-			select {
-			case x := <-l.eventC:
-				eventJSON, err := json.Marshal(x)
-				if err != nil {
-					log.Errorf(errJSONDecoding, err)
-					continue
-				}
-				// writeline to event io
-				fmt.Fprintln(streamBuffer, string(eventJSON))
-			case <-l.stopC:
-				// make sure channel is flushed
-				close(l.eventC) // close channel
-				log.Debug("Turning all the lights out, closing the doors")
-				err := streamBuffer.Flush()
-				if err != nil {
-					log.Errorf(errFlushingBuffer, err)
-				}
-				err = l.writer.Close()
-				if err != nil {
-					log.Errorf(errClosingWriter, err)
-				}
-				// signal to Stop() we are all finished here
-				l.waitGroup.Done()
-				return
-			}
+		// runs until Stop closes eventC and the pump has emptied the queue
+		for x := range l.queue {
+			l.fanOut(x)
 		}
+		log.Debug("Turning all the lights out, closing the doors")
+		l.logDrops()
+		l.closeSinks() // each writes out its queue and closes
+		l.closeSubscriptions()
+		// signal to Stop() we are all finished here
+		l.waitGroup.Done()
 	}()
 }
 
-// SubscribeToThing listen for all Events published by a Thing
+// stamp the envelope of an event as it is received, see things.ThingEvent
+func (l *Listener) stamp(e *things.ThingEvent) {
+	e.Schema = things.EventSchema
+	e.Seq = atomic.AddUint64(&l.received, 1)
+	e.ID = l.runID + "-" + strconv.FormatUint(e.Seq, 10)
+	e.Ingested = l.clock.Now()
+}
+
+// newRunID random ID of a run of the listener, not drawn from the seed so a
+// repeated run doesn't repeat event IDs
+func newRunID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b)
+}
+
+// SubscribeToThing listen for all Events published by a Thing on the DefaultSite
 func (l *Listener) SubscribeToThing(t things.Thing) {
+	l.SubscribeToSite(t, DefaultSite)
+}
+
+// SubscribeToSite listen for all Events published by a Thing on a site
+func (l *Listener) SubscribeToSite(t things.Thing, site string) {
 
 	// lock the list
 	defer l.thingsLock.Unlock()
 	l.thingsLock.Lock()
 	l.thingList = append(l.thingList, t) // add thing to list
-	go t.Emit(l.eventC, l.waitGroup)     // start emitting
+	l.sites[t.ShortD().CidNumber] = site
+	l.watchLock.Lock()
+	l.lastSeen[t.ShortD().CidNumber] = l.clock.Now()
+	l.watchLock.Unlock()
+	go t.Emit(l.eventC, l.waitGroup) // start emitting
+}
+
+// AssignSite move a running thing to a site
+// returns errIDFound, errEmptySite
+func (l *Listener) AssignSite(cid uint64, site string) error {
+
+	if site == "" {
+		return errEmptySite
+	}
+
+	defer l.thingsLock.Unlock()
+	l.thingsLock.Lock()
+	if _, ok := l.sites[cid]; !ok {
+		return errIDFound
+	}
+	l.sites[cid] = site
+	return nil
+}
+
+// SiteOf name of the site a thing is on, empty if the thing is not running
+func (l *Listener) SiteOf(cid uint64) string {
+
+	defer l.thingsLock.Unlock()
+	l.thingsLock.Lock()
+	return l.sites[cid]
+}
+
+// Sites sorted names of all sites with things on them
+func (l *Listener) Sites() []string {
+
+	defer l.thingsLock.Unlock()
+	l.thingsLock.Lock()
+	return l.siteNames()
+}
+
+// siteNames call with thingsLock held. Things subscribed without a site,
+// like a Replay, are left out.
+func (l *Listener) siteNames() []string {
+
+	names := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, site := range l.sites {
+		if site != "" && !seen[site] {
+			seen[site] = true
+			names = append(names, site)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SiteBalances energy balance of every site with things on it
+func (l *Listener) SiteBalances() []SiteBalance {
+
+	l.thingsLock.Lock()
+	names := l.siteNames()
+	count := make(map[string]int)
+	flows := make(map[string][]things.PowerFlow)
+	for _, t := range l.thingList {
+		site := l.sites[t.ShortD().CidNumber]
+		count[site]++
+		if f, ok := t.(things.PowerFlow); ok {
+			flows[site] = append(flows[site], f)
+		}
+	}
+	l.thingsLock.Unlock()
+
+	// read the flows outside the lock, meters look up the list while they hold their own
+	balances := make([]SiteBalance, 0, len(names))
+	for _, site := range names {
+		balances = append(balances, balanceSite(site, count[site], flows[site]))
+	}
+	return balances
 }
 
 // GetThingsShortD return a short description things.CID of all things
 // registered in listener.
-func (l Listener) GetThingsShortD() []things.CID {
+func (l *Listener) GetThingsShortD() []things.CID {
 
 	cids := make([]things.CID, 0) // create empty list
 
 	defer l.thingsLock.Unlock()
 	l.thingsLock.Lock()
 	for _, t := range l.thingList {
-		cids = append(cids, t.ShortD())
+		cid := t.ShortD()
+		cid.Site = l.sites[cid.CidNumber]
+		cid.Stale = l.isStale(cid.CidNumber)
+		cids = append(cids, cid)
 	}
 
 	return cids
@@ -118,31 +259,52 @@ func (l Listener) GetThingsShortD() []things.CID {
 func (l *Listener) Stop(exit bool) {
 
 	// lock list
-	defer l.thingsLock.Unlock()
 	l.thingsLock.Lock()
-
 	for i, t := range l.thingList {
 		log.Debugf("removeSlice[%d] id[%d]\n", i, t.ShortD().CidNumber)
 		// pop item from list
 		l.thingList = l.thingList[1:]
+		delete(l.sites, t.ShortD().CidNumber)
 		t.Stop()
 	}
+	l.thingsLock.Unlock()
+
+	// wait outside the lock, things finishing a sample may still look up the list
 	l.waitGroup.Wait() // waiting for semaphore to hit zero
 	log.Debug("WaitGroup returned")
 
 	if exit {
-		// wait for eventC to be flushed by our io writer
-		for len(l.eventC) > 0 {
-			time.Sleep(time.Millisecond * 10)
+		// no more site balances, the loop may be waiting on a full eventC
+		l.siteStopC <- things.ZeroStruct
+		if l.watchdog > 0 {
+			l.watchStopC <- things.ZeroStruct
 		}
 
-		// send interrupt to the running listener loop
+		// nothing sends anymore, the listener loop writes out the queue and ends
 		l.waitGroup.Add(1)
-		l.stopC <- things.ZeroStruct
+		close(l.eventC)
 		l.waitGroup.Wait()
 	}
 }
 
+// PowerFlows all things that move power on a site
+func (l *Listener) PowerFlows(site string) []things.PowerFlow {
+
+	flows := make([]things.PowerFlow, 0)
+
+	defer l.thingsLock.Unlock()
+	l.thingsLock.Lock()
+	for _, t := range l.thingList {
+		if l.sites[t.ShortD().CidNumber] != site {
+			continue
+		}
+		if f, ok := t.(things.PowerFlow); ok {
+			flows = append(flows, f)
+		}
+	}
+	return flows
+}
+
 // StopByType stop thing by ThingsType
 // return errNoTypeFound
 func (l *Listener) StopByType(tt things.ThingType) error {
@@ -150,10 +312,6 @@ func (l *Listener) StopByType(tt things.ThingType) error {
 	defer l.thingsLock.Unlock()
 	l.thingsLock.Lock()
 
-	// additional lookup
-	// convert the string to an enum
-	var tmpTType things.ThingType // temp TType from thing
-
 	i := 0                // current position
 	s := len(l.thingList) // size of slice
 	d := 0                // items deleted
@@ -161,17 +319,9 @@ func (l *Listener) StopByType(tt things.ThingType) error {
 	// remove items as we iterate through the list if they match ThingType
 	for i < s {
 		t := l.thingList[i]
-		switch t.ShortD().Type {
-		case "BatteryPack":
-			tmpTType = things.TBatteryPack
-		case "Inverter":
-			tmpTType = things.TInverter
-		case "Light":
-			tmpTType = things.TLight
-		}
-
-		if tmpTType == tt { // thingtype == commandType
+		if t.ShortD().Type == tt.String() { // thingtype == commandType
 			l.thingList[i].Stop()
+			delete(l.sites, t.ShortD().CidNumber)
 			l.thingList = append(l.thingList[:i], l.thingList[i+1:]...)
 			s--
 			d++
@@ -186,6 +336,76 @@ func (l *Listener) StopByType(tt things.ThingType) error {
 	return nil
 }
 
+// StopBySite stop all things on a site
+// return errNoSiteFound
+func (l *Listener) StopBySite(site string) error {
+
+	defer l.thingsLock.Unlock()
+	l.thingsLock.Lock()
+
+	kept := l.thingList[:0]
+	d := 0 // items deleted
+	for _, t := range l.thingList {
+		cid := t.ShortD().CidNumber
+		if l.sites[cid] != site {
+			kept = append(kept, t)
+			continue
+		}
+		t.Stop()
+		delete(l.sites, cid)
+		d++
+	}
+	l.thingList = kept
+
+	if d == 0 {
+		return errNoSiteFound
+	}
+	return nil
+}
+
+// GetThings all running things
+func (l *Listener) GetThings() []things.Thing {
+
+	defer l.thingsLock.Unlock()
+	l.thingsLock.Lock()
+	list := make([]things.Thing, len(l.thingList))
+	copy(list, l.thingList)
+	return list
+}
+
+// GetThingsByType running things of a ThingType
+// returns errNoTypeFound
+func (l *Listener) GetThingsByType(tt things.ThingType) ([]things.Thing, error) {
+
+	defer l.thingsLock.Unlock()
+	l.thingsLock.Lock()
+
+	found := make([]things.Thing, 0)
+	for _, t := range l.thingList {
+		if t.ShortD().Type == tt.String() {
+			found = append(found, t)
+		}
+	}
+	if len(found) == 0 {
+		return nil, errNoTypeFound
+	}
+	return found, nil
+}
+
+// GetThing look up a running thing by CID
+// returns errIDFound
+func (l *Listener) GetThing(cid uint64) (things.Thing, error) {
+
+	defer l.thingsLock.Unlock()
+	l.thingsLock.Lock()
+	for _, t := range l.thingList {
+		if t.ShortD().CidNumber == cid {
+			return t, nil
+		}
+	}
+	return nil, errIDFound
+}
+
 // StopByCID stop thing by CID
 // returns errNoIDFound
 func (l *Listener) StopByCID(cid uint64) error {
@@ -195,6 +415,7 @@ func (l *Listener) StopByCID(cid uint64) error {
 	for i, t := range l.thingList {
 		if t.ShortD().CidNumber == cid {
 			t.Stop()
+			delete(l.sites, cid)
 			if len(l.thingList) > i {
 				l.thingList = append(l.thingList[:i], l.thingList[i+1:]...)
 			} else { // last one in list
@@ -0,0 +1,49 @@
+package tslab
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/dfense/tslab/things"
+)
+
+// TestStamp every event gets the envelope of the listener as it is received,
+// IDs unique to the run and numbered in order.
+func TestStamp(t *testing.T) {
+
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := NewListener()
+	l.SetWatchdog(0)
+	l.SetClock(things.NewAFAPClock(start))
+	sink := &recorder{}
+	l.AddSink("recorder", sink)
+	l.StartListener()
+	publish(l, 3, "Light")
+	l.Stop(true)
+
+	events := sink.written()
+	if len(events) != 3 {
+		t.Fatalf("expected 3 events: %d", len(events))
+	}
+	for i, e := range events {
+		seq := uint64(i + 1)
+		tests := []struct {
+			field     string
+			got, want interface{}
+		}{
+			{"schema", e.Schema, things.EventSchema},
+			{"seq", e.Seq, seq},
+			{"id", e.ID, l.runID + "-" + strconv.FormatUint(seq, 10)},
+			{"ingested", e.Ingested.Equal(start), true},
+		}
+		for _, tt := range tests {
+			if tt.got != tt.want {
+				t.Errorf("event %d: expected %s %v: %v", seq, tt.field, tt.want, tt.got)
+			}
+		}
+	}
+	if other := NewListener(); other.runID == l.runID || l.runID == "" {
+		t.Errorf("expected a run ID per listener: %q %q", l.runID, other.runID)
+	}
+}
@@ -0,0 +1,171 @@
+package tslab
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dfense/tslab/things"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	replayType    = "Replay"    // ShortD().Type of a running replay
+	replayMaxLine = 1024 * 1024 // longest event line read from a file
+)
+
+// ReplayConfig how an events file is replayed
+type ReplayConfig struct {
+	Speed float64  // multiplier of the original timing, 0 sends as fast as the listener takes them
+	Types []string // thing_type of the events to replay, empty replays all
+	IDs   []uint64 // thing IDs of the events to replay, empty replays all
+}
+
+// Replay re-emits the events of a file written by the listener, with their
+// original TS and payload. It runs as a thing, so the listener stops it with
+// the rest and li shows how many events it has sent.
+type Replay struct {
+	evtCount    uint64 // events replayed, first for 64bit atomic alignment
+	state       int32  // things.State, running until the source ends
+	id          uint64
+	createdTime time.Time
+	config      ReplayConfig
+	source      io.ReadCloser
+	clock       things.Clock // waits between events
+	stopC       chan struct{}
+}
+
+// NewReplay replay the events read from source
+// ID = cid of the replay, from the same sequence as things
+func NewReplay(ID uint64, source io.ReadCloser, cfg ReplayConfig) *Replay {
+	clock := things.GetClock()
+	return &Replay{
+		id:          ID,
+		createdTime: clock.Now(),
+		config:      cfg,
+		source:      source,
+		clock:       clock,
+		stopC:       make(chan struct{}, 1),
+		state:       int32(things.StateCreated),
+	}
+}
+
+// NewReplayFile replay the events of a file
+func NewReplayFile(ID uint64, path string, cfg ReplayConfig) (*Replay, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewReplay(ID, f, cfg), nil
+}
+
+// Emit implements things.Thing, sends the events of the source until it ends
+// or the replay is stopped
+func (r *Replay) Emit(c chan<- things.ThingEvent, wg *sync.WaitGroup) {
+
+	defer wg.Done()
+	wg.Add(1)
+	defer r.source.Close()
+
+	atomic.StoreInt32(&r.state, int32(things.StateRunning))
+	defer atomic.StoreInt32(&r.state, int32(things.StateStopped))
+
+	r.clock.Join()
+	defer r.clock.Leave()
+
+	scanner := bufio.NewScanner(r.source)
+	scanner.Buffer(make([]byte, 0, 64*1024), replayMaxLine)
+
+	var last time.Time // TS of the last event sent
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		e, err := decodeEvent(scanner.Bytes())
+		if err != nil {
+			log.Errorf(errJSONDecoding, err)
+			continue
+		}
+		if !r.match(e) {
+			continue
+		}
+
+		// keep the gap to the last event, scaled by speed
+		if !last.IsZero() && r.config.Speed > 0 && e.TS.After(last) {
+			timer := r.clock.NewTimer(time.Duration(float64(e.TS.Sub(last)) / r.config.Speed))
+			select {
+			case <-timer.C():
+			case <-r.stopC:
+				timer.Stop()
+				return
+			}
+		}
+		last = e.TS
+		e.Replayed = true
+
+		select {
+		case c <- e:
+			atomic.AddUint64(&r.evtCount, 1)
+		case <-r.stopC:
+			return
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Errorf("replay %d: %s", r.id, err)
+	}
+	log.Debugf("replay %d finished: %d events", r.id, atomic.LoadUint64(&r.evtCount))
+}
+
+// match the event passes the type and ID filters
+func (r *Replay) match(e things.ThingEvent) bool {
+
+	if len(r.config.Types) > 0 {
+		found := false
+		for _, tt := range r.config.Types {
+			found = found || strings.EqualFold(tt, e.ThingType)
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(r.config.IDs) > 0 {
+		for _, id := range r.config.IDs {
+			if id == e.ThingID {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// ShortD implements things.Thing
+func (r *Replay) ShortD() things.CID {
+	return things.CID{CidNumber: r.id, Type: replayType, CreateTime: r.createdTime, TTLEvents: atomic.LoadUint64(&r.evtCount),
+		State: things.State(atomic.LoadInt32(&r.state))}
+}
+
+// Stop implements things.Thing
+func (r *Replay) Stop() {
+	select {
+	case r.stopC <- things.ZeroStruct:
+	default: // already stopping
+	}
+}
+
+// decodeEvent one line of an events file. The payload is kept as raw JSON so
+// it is written back exactly as it was read.
+func decodeEvent(line []byte) (things.ThingEvent, error) {
+	var data json.RawMessage
+	e := things.ThingEvent{EventData: &data}
+	if err := json.Unmarshal(line, &e); err != nil {
+		return e, err
+	}
+	e.EventData = data
+	return e, nil
+}
@@ -0,0 +1,128 @@
+package tslab
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dfense/tslab/things"
+)
+
+// waitClock records the waits asked of the clock it wraps
+type waitClock struct {
+	things.Clock
+	mu    sync.Mutex
+	waits []time.Duration
+}
+
+func (c *waitClock) NewTimer(d time.Duration) things.Timer {
+	c.mu.Lock()
+	c.waits = append(c.waits, d)
+	c.mu.Unlock()
+	return c.Clock.NewTimer(d)
+}
+
+// replaySource events file of the thing types and IDs given, the nth event
+// 10s times n after start
+func replaySource(start time.Time, events ...things.ThingEvent) string {
+	lines := make([]string, 0, len(events))
+	for n, e := range events {
+		lines = append(lines, fmt.Sprintf(`{"schema":1,"seq":%d,"ts":%q,"thing_id":%d,"thing_type":%q,"kind":"telemetry","event_data":{"n":%d}}`,
+			n+1, start.Add(time.Duration(n)*10*time.Second).Format(time.RFC3339Nano), e.ThingID, e.ThingType, n))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// replayAll run a replay to the end, returns the events it sent and the waits
+// between them
+func replayAll(source string, cfg ReplayConfig) ([]things.ThingEvent, []time.Duration) {
+
+	clock := &waitClock{Clock: things.NewAFAPClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))}
+	r := NewReplay(1, ioutil.NopCloser(strings.NewReader(source)), cfg)
+	r.clock = clock
+
+	c := make(chan things.ThingEvent)
+	var wg sync.WaitGroup
+	go func() {
+		r.Emit(c, &wg)
+		close(c)
+	}()
+	events := make([]things.ThingEvent, 0)
+	for e := range c {
+		events = append(events, e)
+	}
+	return events, clock.waits
+}
+
+// TestReplay events are sent in the order of the file with their original TS
+// and gaps scaled by the speed, as fast as taken at speed 0, and filtered by
+// type and ID.
+func TestReplay(t *testing.T) {
+
+	start := time.Date(2020, 6, 22, 8, 0, 0, 0, time.UTC)
+	source := replaySource(start,
+		things.ThingEvent{ThingID: 1, ThingType: "Light"},
+		things.ThingEvent{ThingID: 2, ThingType: "BatteryPack"},
+		things.ThingEvent{ThingID: 1, ThingType: "Light"},
+		things.ThingEvent{ThingID: 3, ThingType: "Light"},
+	)
+
+	tests := []struct {
+		name  string
+		cfg   ReplayConfig
+		ids   []uint64        // of the events sent, in order
+		waits []time.Duration // between them
+	}{
+		{"original timing", ReplayConfig{Speed: 1}, []uint64{1, 2, 1, 3}, []time.Duration{10 * time.Second, 10 * time.Second, 10 * time.Second}},
+		{"double speed", ReplayConfig{Speed: 2}, []uint64{1, 2, 1, 3}, []time.Duration{5 * time.Second, 5 * time.Second, 5 * time.Second}},
+		{"as fast as taken", ReplayConfig{}, []uint64{1, 2, 1, 3}, nil},
+		{"by type", ReplayConfig{Speed: 1, Types: []string{"light"}}, []uint64{1, 1, 3}, []time.Duration{20 * time.Second, 10 * time.Second}},
+		{"by ID", ReplayConfig{Speed: 1, IDs: []uint64{1}}, []uint64{1, 1}, []time.Duration{20 * time.Second}},
+	}
+	for _, tt := range tests {
+		events, waits := replayAll(source, tt.cfg)
+		if len(events) != len(tt.ids) {
+			t.Errorf("%s: expected %d events: %d", tt.name, len(tt.ids), len(events))
+			continue
+		}
+		for n, e := range events {
+			if e.ThingID != tt.ids[n] || !e.Replayed {
+				t.Errorf("%s: event %d expected a replayed %d: %+v", tt.name, n, tt.ids[n], e)
+			}
+			if n > 0 && !e.TS.After(events[n-1].TS) {
+				t.Errorf("%s: event %d expected its original TS after the last: %s", tt.name, n, e.TS)
+			}
+		}
+		if fmt.Sprint(waits) != fmt.Sprint(tt.waits) {
+			t.Errorf("%s: expected waits %v: %v", tt.name, tt.waits, waits)
+		}
+	}
+}
+
+// TestReplayNotSeen replayed events reach the sinks but don't count as events
+// of the things they were recorded from, so a live thing of the same ID still
+// goes stale.
+func TestReplayNotSeen(t *testing.T) {
+
+	l := startListener()
+	sink := &recorder{}
+	l.AddSink("recorder", sink)
+
+	source := replaySource(time.Now(), things.ThingEvent{ThingID: 7, ThingType: "Light"}, things.ThingEvent{ThingID: 7, ThingType: "Light"})
+	l.SubscribeToThing(NewReplay(99, ioutil.NopCloser(strings.NewReader(source)), ReplayConfig{}))
+	sink.await(t, 2)
+	l.eventC <- things.ThingEvent{ThingID: 8, ThingType: "Light"}
+	sink.await(t, 3)
+	l.Stop(true)
+
+	l.watchLock.Lock()
+	_, replayed := l.lastSeen[7]
+	_, live := l.lastSeen[8]
+	l.watchLock.Unlock()
+	if replayed || !live {
+		t.Errorf("expected only the live thing seen: replayed %t, live %t", replayed, live)
+	}
+}
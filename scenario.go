@@ -0,0 +1,486 @@
+package tslab
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/dfense/tslab/things"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	errNoScenarioCount  = errors.New("scenario things need a count of at least 1")
+	errNoActionCommand  = errors.New("scenario action has no command")
+	errScenarioName     = errors.New("scenario thing names must be unique, without spaces, dots or @")
+	errUnknownScenarios = "unknown keys in scenario: %s"
+	errScenarioRef      = "%s: no scenario thing of that name"
+	errScenarioRefIndex = "%s: not one of the %d things of that name"
+	errScenarioRefMany  = "%s: names %d things, pick one with %s.<n>"
+	errScenarioParam    = "param %s must be %s"
+)
+
+// Scenario fleet and timed actions of a run, read from a TOML file
+//
+//	seed = 42
+//
+//	[[things]]
+//	type = "BatteryPack"          # name or short code from the registry
+//	name = "pack"                 # actions refer to the things as @pack.1, @pack.2
+//	count = 2
+//	site = "home"                 # default site when empty
+//	cadence = "jitter:1s:10%"     # time between events, see things.ParseCadence
+//	params = { capacity_ah = 200, setpoint = -50 } # configuration, then commands
+//
+//	[[things]]
+//	type = "i"
+//	count = 1
+//	site = "home"
+//	attach_batteries = true       # attach the scenario battery packs of the same site
+//
+//	[[actions]]
+//	at = "+10m"                   # after the start of the scenario, simulated time
+//	command = "cmd @pack.1 fault over_temperature" # any console command
+type Scenario struct {
+	Seed    int64            `toml:"seed"` // used when no seed is given on the CLI
+	Things  []ScenarioThing  `toml:"things"`
+	Actions []ScenarioAction `toml:"actions"`
+}
+
+// ScenarioThing a group of things of one type. Params that set up the
+// configuration of the type are handed to its New...Config constructor, see
+// scenarioConfig, the others are sent to each thing as commands.
+type ScenarioThing struct {
+	Type            string                 `toml:"type"`
+	Name            string                 `toml:"name"` // actions refer to the things as @name, @name.<n>
+	Count           int                    `toml:"count"`
+	Site            string                 `toml:"site"`
+	Cadence         string                 `toml:"cadence"`
+	Interval        string                 `toml:"interval"` // same as Cadence
+	Params          map[string]interface{} `toml:"params"`
+	AttachBatteries bool                   `toml:"attach_batteries"` // inverters only
+}
+
+// ScenarioAction console command run at a time after the scenario started.
+// @name stands for the CID of the only thing of a named group, @name.<n> for
+// the nth thing of it.
+type ScenarioAction struct {
+	At      ScenarioDuration `toml:"at"`
+	Command string           `toml:"command"`
+}
+
+// ScenarioDuration time.Duration that also takes a leading + and days, e.g. +2d
+type ScenarioDuration time.Duration
+
+// UnmarshalText implements encoding.TextUnmarshaler
+func (d *ScenarioDuration) UnmarshalText(text []byte) error {
+	s := strings.TrimPrefix(strings.TrimSpace(string(text)), "+")
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.ParseFloat(strings.TrimSuffix(s, "d"), 64)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", text)
+		}
+		*d = ScenarioDuration(days * float64(24*time.Hour))
+		return nil
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = ScenarioDuration(v)
+	return nil
+}
+
+// LoadScenario read and check a scenario file
+func LoadScenario(path string) (Scenario, error) {
+
+	var s Scenario
+	meta, err := toml.DecodeFile(path, &s)
+	if err != nil {
+		return s, err
+	}
+	if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+		keys := make([]string, len(undecoded))
+		for i, k := range undecoded {
+			keys[i] = k.String()
+		}
+		return s, fmt.Errorf(errUnknownScenarios, strings.Join(keys, ", "))
+	}
+
+	named := make(map[string][]uint64) // stand in CIDs, to check the references of the actions
+	for _, t := range s.Things {
+		tt, err := scenarioType(t.Type)
+		if err != nil {
+			return s, fmt.Errorf("%s: %s", t.Type, err)
+		}
+		if t.Count < 1 {
+			return s, errNoScenarioCount
+		}
+		if _, err := t.cadence(); err != nil {
+			return s, fmt.Errorf("%s: %s", t.Type, err)
+		}
+		if _, _, err := scenarioConfig(tt, t.Params); err != nil {
+			return s, fmt.Errorf("%s: %s", t, err)
+		}
+		if t.Name != "" {
+			if _, ok := named[t.Name]; ok || strings.ContainsAny(t.Name, " \t.@") {
+				return s, errScenarioName
+			}
+			named[t.Name] = make([]uint64, t.Count)
+		}
+	}
+	for _, a := range s.Actions {
+		if strings.TrimSpace(a.Command) == "" {
+			return s, errNoActionCommand
+		}
+		if _, err := resolveNames(a.Command, named); err != nil {
+			return s, err
+		}
+	}
+	return s, nil
+}
+
+// RunScenario create the things of a scenario and schedule its actions
+func RunScenario(s Scenario) error {
+
+	// hold the clock until the actions are scheduled, so time can't run past them
+	clock := things.GetClock()
+	clock.Join()
+	start := clock.Now()
+
+	batteries := make(map[string][]uint64) // battery packs created by site
+	inverters := make(map[string][]uint64) // inverters to attach by site
+	named := make(map[string][]uint64)     // things of the named groups
+	for _, t := range s.Things {
+		tt, _ := scenarioType(t.Type)
+		site := t.Site
+		if site == "" {
+			site = DefaultSite
+		}
+		cadence, _ := t.cadence()
+		factory, configured, err := scenarioConfig(tt, t.Params)
+		if err != nil {
+			clock.Leave()
+			return err
+		}
+		ids, err := CreateThings(tt, t.Count, CreateOptions{Site: site, Cadence: cadence, Factory: factory})
+		if err != nil {
+			clock.Leave()
+			return err
+		}
+		for _, id := range ids {
+			if err := configureThing(id, t, configured); err != nil {
+				clock.Leave()
+				return err
+			}
+		}
+		if t.Name != "" {
+			named[t.Name] = ids
+		}
+		switch {
+		case tt == things.TBatteryPack:
+			batteries[site] = append(batteries[site], ids...)
+		case tt == things.TInverter && t.AttachBatteries:
+			inverters[site] = append(inverters[site], ids...)
+		}
+	}
+	for site, ids := range inverters {
+		for _, id := range ids {
+			if err := AttachInverter(id, batteries[site]...); err != nil {
+				clock.Leave()
+				return err
+			}
+		}
+	}
+
+	actions := append([]ScenarioAction(nil), s.Actions...)
+	sort.SliceStable(actions, func(i, j int) bool { return actions[i].At < actions[j].At })
+	go runActions(clock, start, actions, named)
+	return nil
+}
+
+// runActions run each action at its time after start, on the clock the
+// caller joined
+func runActions(clock things.Clock, start time.Time, actions []ScenarioAction, named map[string][]uint64) {
+
+	defer clock.Leave()
+	for _, a := range actions {
+		if wait := time.Duration(a.At) - clock.Now().Sub(start); wait > 0 {
+			<-clock.NewTimer(wait).C()
+		}
+		command, err := resolveNames(a.Command, named)
+		if err == nil {
+			log.Infof("scenario +%s: %s", time.Duration(a.At), command)
+			err = processCommand(command)
+		}
+		if err != nil {
+			log.Errorf("scenario +%s: %s", time.Duration(a.At), err)
+		}
+	}
+}
+
+// resolveNames replace the references to named scenario things in a command
+// with their CIDs, see ScenarioAction
+func resolveNames(command string, named map[string][]uint64) (string, error) {
+
+	fields := strings.Fields(command)
+	for i, f := range fields {
+		if !strings.HasPrefix(f, "@") {
+			continue
+		}
+		name, n := f[1:], 0
+		if dot := strings.LastIndex(name, "."); dot >= 0 {
+			var err error
+			if n, err = strconv.Atoi(name[dot+1:]); err != nil || n < 1 {
+				return "", fmt.Errorf(errScenarioRef, f)
+			}
+			name = name[:dot]
+		}
+		ids, ok := named[name]
+		switch {
+		case !ok:
+			return "", fmt.Errorf(errScenarioRef, f)
+		case n == 0 && len(ids) > 1:
+			return "", fmt.Errorf(errScenarioRefMany, f, len(ids), f)
+		case n == 0:
+			n = 1
+		case n > len(ids):
+			return "", fmt.Errorf(errScenarioRefIndex, f, len(ids))
+		}
+		fields[i] = strconv.FormatUint(ids[n-1], 10)
+	}
+	return strings.Join(fields, " "), nil
+}
+
+// String name of the group and its type, for errors
+func (t ScenarioThing) String() string {
+	if t.Name == "" {
+		return t.Type
+	}
+	return fmt.Sprintf("%s (%s)", t.Name, t.Type)
+}
+
+// cadence of the group, nil keeps the default of the type
+func (t ScenarioThing) cadence() (*things.Cadence, error) {
+	spec := t.Cadence
+	if spec == "" {
+		spec = t.Interval
+	}
+	if spec == "" {
+		return nil, nil
+	}
+	c, err := things.ParseCadence(spec)
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// configureThing send the params of a scenario group as commands, all but
+// those that configured it
+func configureThing(id uint64, t ScenarioThing, configured map[string]bool) error {
+
+	cmds := make([]things.Command, 0, len(t.Params))
+	names := make([]string, 0, len(t.Params))
+	for name := range t.Params {
+		if !configured[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names) // same order every run
+	for _, name := range names {
+		cmds = append(cmds, things.Command{Name: name, Value: fmt.Sprint(t.Params[name])})
+	}
+
+	for _, cmd := range cmds {
+		ack, err := SendCommand(id, cmd)
+		if err != nil {
+			return err
+		}
+		if !ack.Accepted {
+			return fmt.Errorf("thing %d %s %s: %s", id, cmd.Name, cmd.Value, ack.Reason)
+		}
+	}
+	return nil
+}
+
+// scenarioType thing type by name or short code
+func scenarioType(name string) (things.ThingType, error) {
+	if info, ok := things.LookupName(name); ok {
+		return info.Type, nil
+	}
+	if info, ok := things.LookupCode(name); ok {
+		return info.Type, nil
+	}
+	return 0, errNoThingType
+}
+
+// scenarioConfig factory of things of a type set up by the params that are
+// part of its configuration, and the names of those params. The factory is
+// nil if there are none, or the type has no configuration. Params out of the
+// range the model works in are an error.
+//
+//	BatteryPack  series, parallel, capacity_ah, cell_capacity_ah, initial_soc, ambient_temp
+//	Inverter     rated_watts, ac_volts, dc_volts
+//	SolarArray   latitude, longitude, rated_watts, cloud_cover, ambient_temp
+//	GridMeter    nominal_hz, nominal_volts, phases, base_load, power_factor
+//	Light        driver_fail_chance
+//	EVCharger    volts, max_amps, mean_arrival, mean_dwell
+func scenarioConfig(tt things.ThingType, params map[string]interface{}) (things.Factory, map[string]bool, error) {
+
+	p := configParams{params: params, used: make(map[string]bool)}
+	var factory things.Factory
+	switch tt {
+	case things.TBatteryPack:
+		cfg := things.DefaultBatteryConfig()
+		p.integer("series", &cfg.Series)
+		p.check("series", cfg.Series >= 1, "at least 1")
+		p.integer("parallel", &cfg.Parallel)
+		p.check("parallel", cfg.Parallel >= 1, "at least 1")
+		p.number("cell_capacity_ah", &cfg.CellCapacityAh)
+		p.check("cell_capacity_ah", cfg.CellCapacityAh > 0, "positive")
+		var capacity float64
+		if p.number("capacity_ah", &capacity) {
+			p.check("capacity_ah", capacity > 0, "positive")
+			if cfg.Parallel >= 1 {
+				cfg.CellCapacityAh = capacity / float64(cfg.Parallel) // of the pack
+			}
+		}
+		p.number("initial_soc", &cfg.InitialSoC)
+		p.check("initial_soc", cfg.InitialSoC >= 0 && cfg.InitialSoC <= 1, "from 0 to 1")
+		p.number("ambient_temp", &cfg.AmbientTemp)
+		factory = func(ID uint64) things.Thing { b := things.NewBatteryPackConfig(ID, cfg); return &b }
+	case things.TInverter:
+		cfg := things.DefaultInverterConfig()
+		p.number("rated_watts", &cfg.RatedWatts)
+		p.check("rated_watts", cfg.RatedWatts > 0, "positive")
+		p.number("ac_volts", &cfg.ACVolts)
+		p.check("ac_volts", cfg.ACVolts > 0, "positive")
+		p.number("dc_volts", &cfg.DCVolts)
+		p.check("dc_volts", cfg.DCVolts > 0, "positive")
+		factory = func(ID uint64) things.Thing { i := things.NewInverterConfig(ID, cfg); return &i }
+	case things.TSolarArray:
+		cfg := things.DefaultSolarConfig()
+		p.number("latitude", &cfg.Latitude)
+		p.check("latitude", cfg.Latitude >= -90 && cfg.Latitude <= 90, "from -90 to 90")
+		p.number("longitude", &cfg.Longitude)
+		p.check("longitude", cfg.Longitude >= -180 && cfg.Longitude <= 180, "from -180 to 180")
+		p.number("rated_watts", &cfg.RatedWatts)
+		p.check("rated_watts", cfg.RatedWatts > 0, "positive")
+		p.number("cloud_cover", &cfg.CloudCover)
+		p.check("cloud_cover", cfg.CloudCover >= 0 && cfg.CloudCover <= 1, "from 0 to 1")
+		p.number("ambient_temp", &cfg.AmbientTemp)
+		factory = func(ID uint64) things.Thing { s := things.NewSolarArrayConfig(ID, cfg); return &s }
+	case things.TGridMeter:
+		cfg := things.DefaultGridConfig()
+		p.number("nominal_hz", &cfg.NominalHz)
+		p.check("nominal_hz", cfg.NominalHz > 0, "positive")
+		p.number("nominal_volts", &cfg.NominalVolts)
+		p.check("nominal_volts", cfg.NominalVolts > 0, "positive")
+		p.integer("phases", &cfg.Phases)
+		p.check("phases", cfg.Phases == 1 || cfg.Phases == 3, "1 or 3")
+		p.number("base_load", &cfg.BaseLoad)
+		p.check("base_load", cfg.BaseLoad >= 0, "0 or more")
+		p.number("power_factor", &cfg.PowerFactor)
+		p.check("power_factor", cfg.PowerFactor > 0 && cfg.PowerFactor <= 1, "above 0 up to 1")
+		factory = func(ID uint64) things.Thing { g := things.NewGridMeterConfig(ID, cfg); return &g }
+	case things.TLight:
+		cfg := things.DefaultLightConfig()
+		p.number("driver_fail_chance", &cfg.DriverFailChance)
+		p.check("driver_fail_chance", cfg.DriverFailChance >= 0 && cfg.DriverFailChance <= 1, "from 0 to 1")
+		factory = func(ID uint64) things.Thing { l := things.NewLightConfig(ID, cfg); return &l }
+	case things.TEVCharger:
+		cfg := things.DefaultEVChargerConfig()
+		p.number("volts", &cfg.Volts)
+		p.check("volts", cfg.Volts > 0, "positive")
+		p.number("max_amps", &cfg.MaxAmps)
+		p.check("max_amps", cfg.MaxAmps > 0, "positive")
+		p.duration("mean_arrival", &cfg.MeanArrival)
+		p.duration("mean_dwell", &cfg.MeanDwell)
+		factory = func(ID uint64) things.Thing { e := things.NewEVChargerConfig(ID, cfg); return &e }
+	}
+	if p.err != nil {
+		return nil, nil, p.err
+	}
+	if len(p.used) == 0 {
+		return nil, p.used, nil
+	}
+	return factory, p.used, nil
+}
+
+// configParams params of a scenario group read into a configuration
+type configParams struct {
+	params map[string]interface{}
+	used   map[string]bool // params read
+	err    error           // first param that could not be read
+}
+
+// number read a number param into v, false if it isn't set
+func (p *configParams) number(name string, v *float64) bool {
+	raw, ok := p.params[name]
+	if !ok {
+		return false
+	}
+	p.used[name] = true
+	switch n := raw.(type) {
+	case float64:
+		*v = n
+	case int64:
+		*v = float64(n)
+	default:
+		p.fail(name, "a number")
+		return false
+	}
+	return true
+}
+
+// integer read an integer param into v, false if it isn't set
+func (p *configParams) integer(name string, v *int) bool {
+	raw, ok := p.params[name]
+	if !ok {
+		return false
+	}
+	p.used[name] = true
+	n, ok := raw.(int64)
+	if !ok {
+		p.fail(name, "an integer")
+		return false
+	}
+	*v = int(n)
+	return true
+}
+
+// duration read a duration param e.g. "30m" into v, false if it isn't set
+func (p *configParams) duration(name string, v *time.Duration) bool {
+	raw, ok := p.params[name]
+	if !ok {
+		return false
+	}
+	p.used[name] = true
+	s, _ := raw.(string)
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		p.fail(name, "a duration e.g. 30m")
+		return false
+	}
+	*v = d
+	return true
+}
+
+// check fail the param unless ok, its value is out of range
+func (p *configParams) check(name string, ok bool, want string) {
+	if !ok {
+		p.fail(name, want)
+	}
+}
+
+// fail note the first param that could not be read
+func (p *configParams) fail(name, want string) {
+	if p.err == nil {
+		p.err = fmt.Errorf(errScenarioParam, name, want)
+	}
+}
@@ -0,0 +1,138 @@
+package tslab
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/dfense/tslab/things"
+)
+
+// TestResolveNames actions refer to the things of named groups by name.
+func TestResolveNames(t *testing.T) {
+
+	named := map[string][]uint64{"pack": {3, 4}, "meter": {7}}
+	tests := []struct {
+		command string
+		want    string
+		err     bool
+	}{
+		{"cmd @pack.2 fault over_temperature", "cmd 4 fault over_temperature", false},
+		{"ai @meter @pack.1", "ai 7 3", false},
+		{"st l", "st l", false},
+		{"pa @pack", "", true},   // two things, which one
+		{"pa @pack.3", "", true}, // only two
+		{"pa @pack.0", "", true},
+		{"pa @inverter", "", true},
+	}
+	for _, tt := range tests {
+		got, err := resolveNames(tt.command, named)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("%s: expected %q error %t: %q %v", tt.command, tt.want, tt.err, got, err)
+		}
+	}
+}
+
+// TestScenarioConfig params that are part of the configuration of a type build
+// its things, the others are left for commands.
+func TestScenarioConfig(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		tt         things.ThingType
+		params     map[string]interface{}
+		configured int
+		factory    bool
+		err        bool
+	}{
+		{"commands only", things.TBatteryPack, map[string]interface{}{"setpoint": int64(-50)}, 0, false, false},
+		{"battery", things.TBatteryPack, map[string]interface{}{"capacity_ah": int64(200), "setpoint": int64(-50)}, 1, true, false},
+		{"inverter", things.TInverter, map[string]interface{}{"rated_watts": 5000.0}, 1, true, false},
+		{"charger", things.TEVCharger, map[string]interface{}{"max_amps": int64(32), "mean_dwell": "4h"}, 2, true, false},
+		{"bad number", things.TSolarArray, map[string]interface{}{"latitude": "north"}, 0, false, true},
+		{"bad duration", things.TEVCharger, map[string]interface{}{"mean_dwell": "long"}, 0, false, true},
+		{"light", things.TLight, map[string]interface{}{"level": int64(50)}, 0, false, false},
+		{"failing light", things.TLight, map[string]interface{}{"driver_fail_chance": 0.01, "level": int64(50)}, 1, true, false},
+		{"no series", things.TBatteryPack, map[string]interface{}{"series": int64(-1)}, 0, false, true},
+		{"no parallel", things.TBatteryPack, map[string]interface{}{"parallel": int64(0)}, 0, false, true},
+		{"no parallel capacity", things.TBatteryPack, map[string]interface{}{"capacity_ah": int64(200), "parallel": int64(0)}, 0, false, true},
+		{"negative capacity", things.TBatteryPack, map[string]interface{}{"capacity_ah": int64(-200)}, 0, false, true},
+		{"over charged", things.TBatteryPack, map[string]interface{}{"initial_soc": 1.5}, 0, false, true},
+		{"no rating", things.TInverter, map[string]interface{}{"rated_watts": int64(0)}, 0, false, true},
+		{"off the globe", things.TSolarArray, map[string]interface{}{"latitude": int64(100)}, 0, false, true},
+		{"no phases", things.TGridMeter, map[string]interface{}{"phases": int64(0)}, 0, false, true},
+		{"two phases", things.TGridMeter, map[string]interface{}{"phases": int64(2)}, 0, false, true},
+		{"single phase", things.TGridMeter, map[string]interface{}{"phases": int64(1)}, 1, true, false},
+		{"past certain", things.TLight, map[string]interface{}{"driver_fail_chance": 2.0}, 0, false, true},
+		{"no amps", things.TEVCharger, map[string]interface{}{"max_amps": -16.0}, 0, false, true},
+	}
+	for _, tt := range tests {
+		factory, configured, err := scenarioConfig(tt.tt, tt.params)
+		if (err != nil) != tt.err || len(configured) != tt.configured || (factory != nil) != tt.factory {
+			t.Errorf("%s: expected %d configured, factory %t, error %t: %v %v", tt.name, tt.configured, tt.factory, tt.err, configured, err)
+		}
+	}
+
+	factory, _, _ := scenarioConfig(things.TBatteryPack, map[string]interface{}{"capacity_ah": int64(230), "parallel": int64(23)})
+	pack, ok := factory(1).(*things.BatteryPack)
+	if !ok {
+		t.Fatalf("expected a battery pack: %T", factory(1))
+	}
+	// cells are the parallel groups, within the manufacturing variance of the pack
+	variance := things.DefaultBatteryConfig().CellVariance
+	for _, cell := range pack.Cells {
+		if math.Abs(cell.CapacityAh-230) > 230*variance+0.01 {
+			t.Errorf("expected 230Ah cells: %f", cell.CapacityAh)
+		}
+	}
+}
+
+// TestLoadScenario a scenario with params out of range is rejected when it is
+// loaded, naming the group and the param, rather than failing as it runs.
+func TestLoadScenario(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		toml   string
+		errors []string // in the error, none if empty
+	}{
+		{"valid", "[[things]]\ntype = \"BatteryPack\"\nname = \"pack\"\ncount = 2\nparams = { series = 14, parallel = 4 }\n", nil},
+		{"series", "[[things]]\ntype = \"BatteryPack\"\nname = \"pack\"\ncount = 1\nparams = { series = -1 }\n", []string{"pack (BatteryPack)", "series"}},
+		{"phases", "[[things]]\ntype = \"g\"\ncount = 1\nparams = { phases = 0 }\n", []string{"g:", "phases"}},
+	}
+	for _, tt := range tests {
+		path := writeScenario(t, tt.toml)
+		_, err := LoadScenario(path)
+		os.Remove(path)
+		if len(tt.errors) == 0 {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+			continue
+		}
+		for _, want := range tt.errors {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("%s: expected %q in the error: %v", tt.name, want, err)
+			}
+		}
+	}
+}
+
+// writeScenario write a scenario file to load, the caller removes it
+func writeScenario(t *testing.T, toml string) string {
+	f, err := ioutil.TempFile("", "scenario*.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(toml); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
@@ -0,0 +1,573 @@
+package tslab
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dfense/tslab/things"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	writerSinkName = "events" // name of the sink added by SetWriter
+	sinkRedial     = time.Second
+	sinkBufferSize = 64 * 1024 // bytes a sink can buffer, flush limits are up to it
+)
+
+var (
+	sinkBuffer       = 1024               // events queued for each sink before it drops them
+	sinkClock        = things.RealClock() // times flush latencies and syncs, see FlushPolicy
+	sinkStopTimeout  = 5 * time.Second    // wait for a sink to write out its queue and close
+	sinkWriteTimeout = 5 * time.Second    // a network peer that takes longer for a write is dropped
+
+	errSinkExists   = errors.New("a sink with that name already exists")
+	errNoSink       = errors.New("no sink with that name")
+	errSinkSpec     = errors.New("sink must be file:<path>, tcp:<host:port>, udp:<host:port> or mem:<size>")
+	errNotMemory    = errors.New("sink is not an in-memory tap")
+	errSinkNotReady = errors.New("sink is not connected")
+)
+
+// EventSink destination of the event stream. The listener hands every event
+// to every sink, each from its own goroutine with its own queue, so a sink
+// that is slow or stuck holds up only itself. Once its queue is full the
+// sink drops events, the oldest queued under OverflowDropOldest and the new
+// one otherwise, counted by the sink and by thing type. Only the queue of the
+// listener blocks. Sinks encode and buffer the events their own way.
+type EventSink interface {
+	Write(things.ThingEvent) error // encode and send or buffer one event
+	Flush() error                  // send what is buffered, called as the FlushPolicy says
+	Close() error                  // flush and release the sink, called once when removed
+}
+
+// SinkStats counters of a sink registered with the listener
+type SinkStats struct {
+	Name    string
+	Queued  int    // events waiting in the queue of the sink
+	Written uint64 // events the sink took without error
+	Dropped uint64 // events dropped because the queue was full
+	Errors  uint64 // events the sink failed to take
+}
+
+// sinkRunner queue and goroutine of a registered sink
+type sinkRunner struct {
+	written uint64 // first for 64bit atomic alignment
+	dropped uint64
+	errors  uint64
+	name    string
+	sink    EventSink
+	policy  FlushPolicy
+	clock   things.Clock
+	queue   chan things.ThingEvent
+	done    chan struct{} // closed once the sink is closed
+}
+
+// newSinkRunner start feeding a sink from its own queue
+func newSinkRunner(name string, sink EventSink, policy FlushPolicy) *sinkRunner {
+	r := &sinkRunner{
+		name:   name,
+		sink:   sink,
+		policy: policy,
+		clock:  sinkClock,
+		queue:  make(chan things.ThingEvent, sinkBuffer),
+		done:   make(chan struct{}),
+	}
+	go r.run()
+	return r
+}
+
+// run write the queued events until the queue is closed, flushing as the
+// policy says, then close the sink
+func (r *sinkRunner) run() {
+
+	defer close(r.done)
+
+	// a clock that runs as fast as possible fires the timer once the sink waits
+	r.clock.Join()
+	defer r.clock.Leave()
+
+	var latency things.Timer
+	var latencyC <-chan time.Time // set while unflushed events wait on the timer
+	var syncC <-chan time.Time
+	if r.policy.Sync == SyncInterval {
+		ticker := r.clock.NewTicker(r.policy.SyncEvery)
+		defer ticker.Stop()
+		syncC = ticker.C()
+	}
+
+	pending := 0 // events written since the last flush
+	flush := func() {
+		r.flush()
+		pending = 0
+		if latencyC != nil {
+			latency.Stop()
+			latencyC = nil
+		}
+	}
+
+	for {
+		select {
+		case e, ok := <-r.queue:
+			if !ok {
+				r.flush()
+				if r.policy.Sync == SyncInterval {
+					r.sync()
+				}
+				if err := r.sink.Close(); err != nil {
+					log.Errorf("sink %s: "+errClosingWriter, r.name, err)
+				}
+				return
+			}
+			r.write(e)
+			pending++
+			if pending == 1 && r.policy.MaxLatency > 0 {
+				latency = r.clock.NewTimer(r.policy.MaxLatency)
+				latencyC = latency.C()
+			}
+			if r.due(pending) {
+				flush()
+			}
+		case <-latencyC:
+			latencyC = nil // fired, nothing to stop
+			flush()
+		case <-syncC:
+			if pending > 0 {
+				flush()
+			}
+			r.sync()
+		}
+	}
+}
+
+// write hand an event to the sink, counting errors
+func (r *sinkRunner) write(e things.ThingEvent) {
+	if err := r.sink.Write(e); err != nil {
+		// log the first of a run of errors, not every event
+		if atomic.AddUint64(&r.errors, 1)&(1<<10-1) == 1 {
+			log.Errorf("sink %s: %s", r.name, err)
+		}
+		return
+	}
+	atomic.AddUint64(&r.written, 1)
+}
+
+// due a limit of the policy is hit and the sink should flush
+func (r *sinkRunner) due(pending int) bool {
+	switch {
+	case r.policy.MaxEvents > 0 && pending >= r.policy.MaxEvents:
+		return true
+	case r.policy.MaxBytes > 0:
+		if b, ok := r.sink.(buffered); ok && b.Buffered() >= r.policy.MaxBytes {
+			return true
+		}
+	}
+	// without a latency limit catch up before flushing
+	return r.policy.MaxLatency == 0 && len(r.queue) == 0
+}
+
+// flush the sink, and sync it if the policy says so
+func (r *sinkRunner) flush() {
+	if err := r.sink.Flush(); err != nil {
+		log.Debugf("sink %s flush: %s", r.name, err)
+		return
+	}
+	if r.policy.Sync == SyncFlush {
+		r.sync()
+	}
+}
+
+// sync put what the sink flushed on disk, if it can
+func (r *sinkRunner) sync() {
+	if s, ok := r.sink.(Syncer); ok {
+		if err := s.Sync(); err != nil {
+			log.Debugf("sink %s sync: %s", r.name, err)
+		}
+	}
+}
+
+// send queue an event for the sink without waiting. With a full queue
+// drop-oldest drops the oldest queued event and the other policies the new
+// one, blocking is left to the queue of the listener. Events dropped are
+// counted by the sink and handed to drop.
+func (r *sinkRunner) send(e things.ThingEvent, policy OverflowPolicy, drop func(things.ThingEvent)) {
+	if policy == OverflowDropOldest {
+		for {
+			select {
+			case r.queue <- e:
+				return
+			default:
+			}
+			select {
+			case old := <-r.queue:
+				atomic.AddUint64(&r.dropped, 1)
+				drop(old)
+			default: // written by the sink meanwhile
+			}
+		}
+	}
+	select {
+	case r.queue <- e:
+	default:
+		atomic.AddUint64(&r.dropped, 1)
+		drop(e)
+	}
+}
+
+// stop close the queue and wait for the sink to write it out and close. A
+// sink stuck in a write is left behind after sinkStopTimeout. The runner must
+// be out of the sinks already.
+func (r *sinkRunner) stop() {
+	close(r.queue)
+	select {
+	case <-r.done:
+	case <-time.After(sinkStopTimeout):
+		log.Errorf("sink %s: not closed after %s, left behind", r.name, sinkStopTimeout)
+	}
+}
+
+// stats counters of the sink
+func (r *sinkRunner) stats() SinkStats {
+	return SinkStats{
+		Name:    r.name,
+		Queued:  len(r.queue),
+		Written: atomic.LoadUint64(&r.written),
+		Dropped: atomic.LoadUint64(&r.dropped),
+		Errors:  atomic.LoadUint64(&r.errors),
+	}
+}
+
+// AddSink register a sink under a name, it receives every event from now on
+// returns errSinkExists
+func (l *Listener) AddSink(name string, sink EventSink) error {
+
+	defer l.sinksLock.Unlock()
+	l.sinksLock.Lock()
+	if _, ok := l.sinks[name]; ok {
+		return errSinkExists
+	}
+	l.sinks[name] = newSinkRunner(name, sink, l.flush)
+	return nil
+}
+
+// RemoveSink unregister a sink, once the events queued for it are written
+// the sink is closed
+// returns errNoSink
+func (l *Listener) RemoveSink(name string) error {
+
+	l.sinksLock.Lock()
+	r, ok := l.sinks[name]
+	delete(l.sinks, name)
+	l.sinksLock.Unlock()
+
+	if !ok {
+		return errNoSink
+	}
+	r.stop()
+	return nil
+}
+
+// Sink the sink registered under a name
+// returns errNoSink
+func (l *Listener) Sink(name string) (EventSink, error) {
+
+	defer l.sinksLock.Unlock()
+	l.sinksLock.Lock()
+	r, ok := l.sinks[name]
+	if !ok {
+		return nil, errNoSink
+	}
+	return r.sink, nil
+}
+
+// SinkStats counters of every registered sink, sorted by name
+func (l *Listener) SinkStats() []SinkStats {
+
+	l.sinksLock.Lock()
+	stats := make([]SinkStats, 0, len(l.sinks))
+	for _, r := range l.sinks {
+		stats = append(stats, r.stats())
+	}
+	l.sinksLock.Unlock()
+
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+	return stats
+}
+
+// fanOut hand an event to every sink and subscription. Sinks never wait and
+// are sent to under sinksLock. Subscriptions are taken under it but handed
+// the event once it is released, so one that blocks doesn't hold up
+// Unsubscribe, which frees it.
+func (l *Listener) fanOut(e things.ThingEvent) {
+
+	l.sinksLock.Lock()
+	for _, r := range l.sinks {
+		r.send(e, l.backpressure.Policy, l.drop)
+	}
+	subscriptions := make([]*Subscription, 0, len(l.subscriptions))
+	for s := range l.subscriptions {
+		s.senders.Add(1)
+		subscriptions = append(subscriptions, s)
+	}
+	l.sinksLock.Unlock()
+
+	for _, s := range subscriptions {
+		s.send(e)
+		s.senders.Done()
+	}
+}
+
+// closeSinks remove every sink, waiting for each to write out its queue
+func (l *Listener) closeSinks() {
+
+	l.sinksLock.Lock()
+	runners := l.sinks
+	l.sinks = make(map[string]*sinkRunner)
+	l.sinksLock.Unlock()
+
+	for _, r := range runners {
+		r.stop()
+	}
+}
+
+// ParseSink create a sink from its spec
+// file:<path> JSON lines appended to a file, tcp:<host:port> or
+// udp:<host:port> JSON lines over the network, mem:<size> in-memory tap of
+// the last size events
+func ParseSink(spec string) (EventSink, error) {
+
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, errSinkSpec
+	}
+	switch strings.ToLower(parts[0]) {
+	case "file":
+		f, err := NewEventWriter(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		return NewWriterSink(f), nil
+	case "tcp", "udp":
+		return NewNetworkSink(strings.ToLower(parts[0]), parts[1]), nil
+	case "mem":
+		size, err := strconv.Atoi(parts[1])
+		if err != nil || size < 1 {
+			return nil, errSinkSpec
+		}
+		return NewMemorySink(size), nil
+	}
+	return nil, errSinkSpec
+}
+
+//---------------------------------------------------------
+// JSON lines to an io.WriteCloser
+//---------------------------------------------------------
+
+// WriterSink writes events as JSON lines through a buffer
+type WriterSink struct {
+	w      io.WriteCloser
+	buffer *bufio.Writer
+}
+
+// NewWriterSink JSON lines to w, w is closed with the sink
+func NewWriterSink(w io.WriteCloser) *WriterSink {
+	return &WriterSink{w: w, buffer: bufio.NewWriterSize(w, sinkBufferSize)}
+}
+
+// Write implements EventSink
+func (s *WriterSink) Write(e things.ThingEvent) error {
+	return writeJSONLine(s.buffer, e)
+}
+
+// Flush implements EventSink
+func (s *WriterSink) Flush() error {
+	return s.buffer.Flush()
+}
+
+// Buffered bytes not flushed yet
+func (s *WriterSink) Buffered() int {
+	return s.buffer.Buffered()
+}
+
+// Sync implements Syncer if the writer is a file
+func (s *WriterSink) Sync() error {
+	if f, ok := s.w.(Syncer); ok {
+		return f.Sync()
+	}
+	return nil
+}
+
+// Close implements EventSink
+func (s *WriterSink) Close() error {
+	if err := s.buffer.Flush(); err != nil {
+		log.Errorf(errFlushingBuffer, err)
+	}
+	return s.w.Close()
+}
+
+// writeJSONLine encode an event as one line of JSON
+func writeJSONLine(w io.Writer, e things.ThingEvent) error {
+	eventJSON, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf(errJSONDecoding, err)
+	}
+	eventJSON = append(eventJSON, '\n')
+	_, err = w.Write(eventJSON)
+	return err
+}
+
+//---------------------------------------------------------
+// JSON lines over the network
+//---------------------------------------------------------
+
+// NetworkSink streams events as JSON lines to a TCP or UDP listener. A
+// connection that fails, or a peer that doesn't take a write within
+// sinkWriteTimeout, is dropped and dialed again at most once a second,
+// events written while it is down are lost.
+type NetworkSink struct {
+	network  string
+	address  string
+	conn     net.Conn
+	buffer   *bufio.Writer
+	lastDial time.Time
+}
+
+// NewNetworkSink JSON lines to address over network, tcp or udp. Dials on
+// the first event.
+func NewNetworkSink(network, address string) *NetworkSink {
+	return &NetworkSink{network: network, address: address}
+}
+
+// Write implements EventSink
+func (s *NetworkSink) Write(e things.ThingEvent) error {
+	if err := s.dial(); err != nil {
+		return err
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(sinkWriteTimeout))
+	if s.network == "udp" {
+		// one datagram per event, a buffer would split lines across them
+		if err := writeJSONLine(s.conn, e); err != nil {
+			s.drop()
+			return err
+		}
+		return nil
+	}
+	if err := writeJSONLine(s.buffer, e); err != nil {
+		s.drop()
+		return err
+	}
+	return nil
+}
+
+// Flush implements EventSink
+func (s *NetworkSink) Flush() error {
+	if s.buffer == nil {
+		return nil
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(sinkWriteTimeout))
+	if err := s.buffer.Flush(); err != nil {
+		s.drop()
+		return err
+	}
+	return nil
+}
+
+// Buffered bytes not sent yet
+func (s *NetworkSink) Buffered() int {
+	if s.buffer == nil {
+		return 0
+	}
+	return s.buffer.Buffered()
+}
+
+// Close implements EventSink
+func (s *NetworkSink) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	s.Flush()
+	return s.conn.Close()
+}
+
+// dial connect unless connected, no more than once every sinkRedial
+func (s *NetworkSink) dial() error {
+	if s.conn != nil {
+		return nil
+	}
+	if time.Since(s.lastDial) < sinkRedial {
+		return errSinkNotReady
+	}
+	s.lastDial = time.Now()
+	conn, err := net.DialTimeout(s.network, s.address, sinkRedial)
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	s.buffer = bufio.NewWriterSize(conn, sinkBufferSize)
+	return nil
+}
+
+// drop the connection after an error, the next write dials again
+func (s *NetworkSink) drop() {
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	s.conn, s.buffer = nil, nil
+}
+
+//---------------------------------------------------------
+// in-memory tap
+//---------------------------------------------------------
+
+// MemorySink keeps the last events in memory, for tests and the console
+type MemorySink struct {
+	mu     sync.Mutex
+	events []things.ThingEvent // ring of the last len(events) events
+	next   int                 // position of the next event in the ring
+	count  uint64              // events written
+}
+
+// NewMemorySink tap of the last size events
+func NewMemorySink(size int) *MemorySink {
+	return &MemorySink{events: make([]things.ThingEvent, size)}
+}
+
+// Write implements EventSink
+func (s *MemorySink) Write(e things.ThingEvent) error {
+	defer s.mu.Unlock()
+	s.mu.Lock()
+	s.events[s.next] = e
+	s.next = (s.next + 1) % len(s.events)
+	s.count++
+	return nil
+}
+
+// Flush implements EventSink
+func (s *MemorySink) Flush() error { return nil }
+
+// Close implements EventSink, the events stay readable
+func (s *MemorySink) Close() error { return nil }
+
+// Events the events held, oldest first
+func (s *MemorySink) Events() []things.ThingEvent {
+	defer s.mu.Unlock()
+	s.mu.Lock()
+
+	n := len(s.events)
+	if s.count < uint64(n) {
+		n = int(s.count)
+	}
+	events := make([]things.ThingEvent, 0, n)
+	for i := len(s.events) - n; i < len(s.events); i++ {
+		events = append(events, s.events[(s.next+i)%len(s.events)])
+	}
+	return events
+}
@@ -0,0 +1,344 @@
+package tslab
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dfense/tslab/things"
+)
+
+// recorder EventSink that records what the listener asks of it. Each event
+// buffers 100 bytes until the next flush.
+type recorder struct {
+	mu      sync.Mutex
+	events  []things.ThingEvent
+	pending int     // events written since the last flush
+	flushes []flush // every call to Flush
+	syncs   int
+	closed  bool
+	delay   time.Duration // taken by every Write, a slow sink
+	hold    chan struct{} // Write waits for it to close, a stuck sink
+	clock   things.Clock  // time of the flushes, nil for none
+}
+
+// flush a call to Flush of a recorder
+type flush struct {
+	events int       // events written since the flush before
+	at     time.Time // time on the clock of the recorder
+}
+
+func (r *recorder) Write(e things.ThingEvent) error {
+	time.Sleep(r.delay)
+	if r.hold != nil {
+		<-r.hold
+	}
+	defer r.mu.Unlock()
+	r.mu.Lock()
+	r.events = append(r.events, e)
+	r.pending++
+	return nil
+}
+
+func (r *recorder) Flush() error {
+	defer r.mu.Unlock()
+	r.mu.Lock()
+	f := flush{events: r.pending}
+	if r.clock != nil {
+		f.at = r.clock.Now()
+	}
+	r.flushes = append(r.flushes, f)
+	r.pending = 0
+	return nil
+}
+
+func (r *recorder) Buffered() int {
+	defer r.mu.Unlock()
+	r.mu.Lock()
+	return r.pending * 100
+}
+
+func (r *recorder) Sync() error {
+	defer r.mu.Unlock()
+	r.mu.Lock()
+	r.syncs++
+	return nil
+}
+
+func (r *recorder) Close() error {
+	defer r.mu.Unlock()
+	r.mu.Lock()
+	r.closed = true
+	return nil
+}
+
+// written events the recorder took
+func (r *recorder) written() []things.ThingEvent {
+	defer r.mu.Unlock()
+	r.mu.Lock()
+	return append([]things.ThingEvent(nil), r.events...)
+}
+
+// await wait for a recorder to have written n events
+func (r *recorder) await(t *testing.T, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); len(r.written()) < n; {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d events: %d", n, len(r.written()))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// startListener listener without a watchdog, running
+func startListener() *Listener {
+	l := NewListener()
+	l.SetWatchdog(0)
+	l.StartListener()
+	return l
+}
+
+// publish n events of a thing type through the listener, as things do, with
+// ThingIDs 1 to n
+func publish(l *Listener, n int, thingType string) {
+	for i := 0; i < n; i++ {
+		l.eventC <- things.ThingEvent{ThingID: uint64(i + 1), ThingType: thingType}
+	}
+}
+
+// TestFanOut every sink gets every event published while it is registered, in
+// order, and is closed once removed or the listener stops. Events are
+// published in batches of 10.
+func TestFanOut(t *testing.T) {
+
+	l := startListener()
+	first, second, late := &recorder{}, &recorder{}, &recorder{}
+	tap := NewMemorySink(5)
+	for name, sink := range map[string]EventSink{"first": first, "second": second, "tap": tap} {
+		if err := l.AddSink(name, sink); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	publish(l, 10, "Light")
+	first.await(t, 10) // fanned out, not only received
+	if err := l.AddSink("late", late); err != nil {
+		t.Fatal(err)
+	}
+	publish(l, 10, "Light")
+	first.await(t, 20)
+	if err := l.RemoveSink("second"); err != nil {
+		t.Fatal(err)
+	}
+	publish(l, 10, "Light")
+	l.Stop(true)
+
+	tests := []struct {
+		name    string
+		sink    *recorder
+		batches int
+	}{
+		{"first", first, 3},
+		{"second", second, 2},
+		{"late", late, 2},
+	}
+	for _, tt := range tests {
+		events := tt.sink.written()
+		if len(events) != tt.batches*10 {
+			t.Errorf("%s: expected %d events: %d", tt.name, tt.batches*10, len(events))
+			continue
+		}
+		for i, e := range events {
+			if e.ThingID != uint64(i%10+1) {
+				t.Errorf("%s: expected thing %d: %d", tt.name, i%10+1, e.ThingID)
+				break
+			}
+		}
+		if !tt.sink.closed {
+			t.Errorf("%s: expected the sink closed", tt.name)
+		}
+	}
+	if events := tap.Events(); len(events) != 5 || events[0].ThingID != 6 {
+		t.Errorf("expected the tap to hold the last 5 events: %+v", events)
+	}
+}
+
+// TestSinkRegistry names of the sinks are unique, and only registered sinks
+// can be looked up or removed.
+func TestSinkRegistry(t *testing.T) {
+
+	l := NewListener()
+	sink := &recorder{}
+	tests := []struct {
+		name string
+		op   func() error
+		err  error
+	}{
+		{"add", func() error { return l.AddSink("a", sink) }, nil},
+		{"add again", func() error { return l.AddSink("a", &recorder{}) }, errSinkExists},
+		{"lookup", func() error { _, err := l.Sink("a"); return err }, nil},
+		{"lookup unknown", func() error { _, err := l.Sink("b"); return err }, errNoSink},
+		{"remove", func() error { return l.RemoveSink("a") }, nil},
+		{"remove again", func() error { return l.RemoveSink("a") }, errNoSink},
+		{"add after remove", func() error { return l.AddSink("a", &recorder{}) }, nil},
+	}
+	for _, tt := range tests {
+		if err := tt.op(); err != tt.err {
+			t.Errorf("%s: expected %v: %v", tt.name, tt.err, err)
+		}
+	}
+	if !sink.closed {
+		t.Error("expected the removed sink closed")
+	}
+	if stats := l.SinkStats(); len(stats) != 1 || stats[0].Name != "a" {
+		t.Errorf("expected one sink a: %+v", stats)
+	}
+	l.closeSinks()
+}
+
+// TestSlowSink a sink that falls behind catches up from its queue. Once the
+// queue is full it drops and counts the events, so a stuck sink holds up
+// neither the listener nor a healthy sink beside it, and removing it gives
+// up on it.
+func TestSlowSink(t *testing.T) {
+
+	defer func(n int, d time.Duration) { sinkBuffer, sinkStopTimeout = n, d }(sinkBuffer, sinkStopTimeout)
+
+	l := startListener()
+	slow := &recorder{delay: time.Millisecond}
+	if err := l.AddSink("slow", slow); err != nil {
+		t.Fatal(err)
+	}
+	publish(l, 50, "Light")
+	l.Stop(true)
+	if n := len(slow.written()); n != 50 {
+		t.Errorf("expected 50 events: %d", n)
+	}
+
+	// stuck beside a healthy sink
+	l = startListener()
+	healthy := &recorder{}
+	if err := l.AddSink("healthy", healthy); err != nil {
+		t.Fatal(err)
+	}
+	sinkBuffer, sinkStopTimeout = 1, 10*time.Millisecond
+	stuck := &recorder{hold: make(chan struct{})}
+	if err := l.AddSink("stuck", stuck); err != nil {
+		t.Fatal(err)
+	}
+	published := make(chan struct{})
+	go func() { publish(l, 50, "Light"); close(published) }()
+	select {
+	case <-published:
+	case <-time.After(time.Second):
+		t.Fatal("expected the stuck sink not to hold up the listener")
+	}
+	healthy.await(t, 50)
+	for i, e := range healthy.written() {
+		if e.ThingID != uint64(i+1) {
+			t.Fatalf("expected the healthy sink to get every event in order: %d at %d", e.ThingID, i)
+		}
+	}
+
+	var dropped uint64
+	for _, s := range l.SinkStats() {
+		if s.Name == "stuck" {
+			dropped = s.Dropped
+		}
+	}
+	if dropped < 48 || l.BackpressureStats().Dropped["Light"] != dropped {
+		t.Errorf("expected the stuck sink to count what it dropped: %d %+v", dropped, l.BackpressureStats())
+	}
+	removed := make(chan error)
+	go func() { removed <- l.RemoveSink("stuck") }()
+	select {
+	case err := <-removed:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected removing a stuck sink not to hang")
+	}
+	close(stuck.hold) // the sink left behind writes out its queue and closes
+	l.Stop(true)
+	if !healthy.closed {
+		t.Error("expected the healthy sink closed")
+	}
+}
+
+// TestNetworkSinkDeadline a peer that stops reading fails the writes of a
+// network sink instead of hanging it.
+func TestNetworkSinkDeadline(t *testing.T) {
+
+	defer func(d time.Duration) { sinkWriteTimeout = d }(sinkWriteTimeout)
+	sinkWriteTimeout = 10 * time.Millisecond
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			accepted <- conn // and never read
+		}
+	}()
+
+	sink := NewNetworkSink("tcp", ln.Addr().String())
+	e := things.ThingEvent{ThingType: "Light", EventData: strings.Repeat("x", 1000)}
+	failed := make(chan error)
+	go func() {
+		for i := 0; i < 100000; i++ {
+			if err := sink.Write(e); err != nil {
+				failed <- err
+				return
+			}
+			if err := sink.Flush(); err != nil {
+				failed <- err
+				return
+			}
+		}
+		failed <- nil
+	}()
+	select {
+	case err := <-failed:
+		if err == nil {
+			t.Error("expected a write to time out")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the sink not to hang on a peer that doesn't read")
+	}
+	sink.Close()
+	(<-accepted).Close()
+}
+
+// TestParseSink specs of the sinks.
+func TestParseSink(t *testing.T) {
+
+	tests := []struct {
+		spec string
+		ok   bool
+	}{
+		{"mem:10", true},
+		{"MEM:1", true},
+		{"tcp:localhost:9000", true},
+		{"udp:localhost:9000", true},
+		{"mem:0", false},
+		{"mem:ten", false},
+		{"tcp:", false},
+		{"kafka:events", false},
+		{"events.txt", false},
+	}
+	for _, tt := range tests {
+		sink, err := ParseSink(tt.spec)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: expected ok %t: %v", tt.spec, tt.ok, err)
+		}
+		if sink != nil {
+			sink.Close()
+		}
+	}
+}
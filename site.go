@@ -0,0 +1,102 @@
+package tslab
+
+import (
+	"math"
+	"time"
+
+	"github.com/dfense/tslab/things"
+)
+
+// DefaultSite site of things created without naming one
+const DefaultSite = "default"
+
+var siteInterval = time.Second // time between energy balance events of each site
+
+// SiteBalance energy balance of a site at one tick, Generation = Load +
+// StorageCharge + GridExport always holds. Without a meter the grid is the
+// slack of the site, the export is computed from the things. A site with a
+// meter measures its export at the point of connection and the load is the
+// slack: what the things book plus what they don't account for, the
+// Mismatch. It isn't 0 as the meter reads at its own cadence.
+type SiteBalance struct {
+	Site          string  `json:"site"`
+	Things        int     `json:"things"`               // things assigned to the site
+	Generation    float64 `json:"generation_watts"`     // generation and storage discharge
+	Load          float64 `json:"load_watts"`           // loads, including unmetered site load and Mismatch
+	StorageCharge float64 `json:"storage_charge_watts"` // power charging storage
+	GridExport    float64 `json:"grid_export_watts"`    // negative while importing
+	Metered       bool    `json:"metered"`              // GridExport was measured by a meter
+	Mismatch      float64 `json:"mismatch_watts"`       // load the things don't account for, measured less computed grid export
+}
+
+// balanceSite book the power of each flow by its role and balance the site.
+// The first meter on the site is its point of connection, its unmetered load
+// is booked once and the export it measures balances the site through the
+// load. Further meters on the site are left out, they would count the site
+// load again.
+func balanceSite(site string, count int, flows []things.PowerFlow) SiteBalance {
+
+	b := SiteBalance{Site: site, Things: count}
+	var meter things.SiteMeter
+	for _, f := range flows {
+		if m, ok := f.(things.SiteMeter); ok {
+			if meter != nil {
+				continue
+			}
+			meter = m
+		}
+		watts := f.NetWatts()
+		switch f.EnergyRole() {
+		case things.RoleGeneration:
+			b.Generation += watts
+		case things.RoleLoad:
+			b.Load -= watts
+		case things.RoleStorage:
+			if watts > 0 {
+				b.Generation += watts
+			} else {
+				b.StorageCharge -= watts
+			}
+		}
+	}
+	b.Generation = roundWatts(b.Generation)
+	b.Load = roundWatts(b.Load)
+	b.StorageCharge = roundWatts(b.StorageCharge)
+	computed := roundWatts(b.Generation - b.Load - b.StorageCharge)
+	b.GridExport = computed
+	if meter != nil {
+		b.Metered = true
+		b.GridExport = roundWatts(-meter.GridWatts())
+		b.Mismatch = roundWatts(b.GridExport - computed)
+		b.Load = roundWatts(b.Load - b.Mismatch)
+	}
+	return b
+}
+
+// roundWatts round to milliwatts, same precision things publish
+func roundWatts(w float64) float64 {
+	return math.Round(w*1000) / 1000
+}
+
+// siteLoop publish the energy balance of every site with things on it, until
+// told to stop
+func (l *Listener) siteLoop() {
+
+	ticker := l.clock.NewTicker(siteInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C():
+			for _, b := range l.SiteBalances() {
+				l.eventC <- things.ThingEvent{
+					TS:        now,
+					ThingType: things.ThingTypeSite,
+					Kind:      things.KindSite,
+					EventData: b,
+				}
+			}
+		case <-l.siteStopC:
+			return
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package tslab
+
+import (
+	"testing"
+
+	"github.com/dfense/tslab/things"
+)
+
+// flow a PowerFlow of fixed power
+type flow struct {
+	watts float64
+	role  things.EnergyRole
+}
+
+func (f flow) NetWatts() float64             { return f.watts }
+func (f flow) EnergyRole() things.EnergyRole { return f.role }
+
+// meter a SiteMeter with a fixed unmetered load and reading
+type meter struct {
+	flow
+	measured float64 // watts imported
+}
+
+func (m meter) SetNetPower(func() float64) {}
+func (m meter) GridWatts() float64         { return m.measured }
+
+// TestBalanceSite each flow is booked by its role and every site balances.
+// Without a meter the grid export is the slack, with one the load is, and
+// the meter is counted once per site.
+func TestBalanceSite(t *testing.T) {
+
+	solar := flow{3000, things.RoleGeneration}
+	light := flow{-200, things.RoleLoad}
+	charging := flow{-1000, things.RoleStorage}
+	grid := meter{flow{-1500, things.RoleLoad}, -300}   // exports what the flows leave over
+	skewed := meter{flow{-1500, things.RoleLoad}, -250} // read a moment earlier, at its own cadence
+	more := meter{flow{-1500, things.RoleLoad}, -400}   // measures less load than the things book
+	second := meter{flow{-1400, things.RoleLoad}, -400} // same site, another load
+
+	tests := []struct {
+		name  string
+		flows []things.PowerFlow
+		want  SiteBalance
+	}{
+		{"slack", []things.PowerFlow{solar, light, charging},
+			SiteBalance{Generation: 3000, Load: 200, StorageCharge: 1000, GridExport: 1800}},
+		{"metered", []things.PowerFlow{solar, light, charging, grid},
+			SiteBalance{Generation: 3000, Load: 1700, StorageCharge: 1000, GridExport: 300, Metered: true}},
+		{"mismatch", []things.PowerFlow{solar, light, charging, skewed},
+			SiteBalance{Generation: 3000, Load: 1750, StorageCharge: 1000, GridExport: 250, Metered: true, Mismatch: -50}},
+		{"more export", []things.PowerFlow{solar, light, charging, more},
+			SiteBalance{Generation: 3000, Load: 1600, StorageCharge: 1000, GridExport: 400, Metered: true, Mismatch: 100}},
+		{"two meters", []things.PowerFlow{grid, solar, second, light, charging},
+			SiteBalance{Generation: 3000, Load: 1700, StorageCharge: 1000, GridExport: 300, Metered: true}},
+		{"discharging", []things.PowerFlow{flow{500, things.RoleStorage}, light},
+			SiteBalance{Generation: 500, Load: 200, GridExport: 300}},
+	}
+	for _, tt := range tests {
+		tt.want.Site, tt.want.Things = "home", len(tt.flows)
+		got := balanceSite("home", len(tt.flows), tt.flows)
+		if got != tt.want {
+			t.Errorf("%s: expected %+v: %+v", tt.name, tt.want, got)
+		}
+		if got.Generation != got.Load+got.StorageCharge+got.GridExport {
+			t.Errorf("%s: expected the site to balance: %+v", tt.name, got)
+		}
+	}
+}
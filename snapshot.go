@@ -0,0 +1,243 @@
+package tslab
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/dfense/tslab/things"
+	log "github.com/sirupsen/logrus"
+)
+
+const snapshotVersion = 1 // version of the snapshot file format
+
+var (
+	errSnapshotVersion = errors.New("snapshot file version is not supported")
+	errCIDInUse        = errors.New("a thing with that CID is already running")
+)
+
+// Snapshot the fleet saved to a file, a later run restores it with the same
+// CIDs and carries on from where it was
+type Snapshot struct {
+	Version int             `json:"version"`
+	Taken   time.Time       `json:"taken"`   // clock time of the snapshot
+	Seed    int64           `json:"seed"`    // seed of the run that took it
+	NextID  uint64          `json:"next_id"` // last CID handed out
+	Things  []SnapshotThing `json:"things"`
+}
+
+// SnapshotThing saved state of a thing and the site it is on
+type SnapshotThing struct {
+	Site string `json:"site"`
+	things.ThingState
+}
+
+// TakeSnapshot state of every running thing. Things that can't be saved,
+// like a replay, are left out.
+func TakeSnapshot() (Snapshot, error) {
+
+	snap := Snapshot{Version: snapshotVersion, Taken: things.GetClock().Now(), Seed: things.Seed()}
+	slock.Lock()
+	snap.NextID = nextID
+	slock.Unlock()
+
+	for _, t := range listener.GetThings() {
+		s, ok := t.(things.Snapshotter)
+		if !ok {
+			log.Debugf("snapshot skips %s: %d", t.ShortD().Type, t.ShortD().CidNumber)
+			continue
+		}
+		state, err := s.Snapshot()
+		if err != nil {
+			return snap, err
+		}
+		snap.Things = append(snap.Things, SnapshotThing{Site: listener.SiteOf(state.CID), ThingState: state})
+	}
+	return snap, nil
+}
+
+// SaveSnapshot write the state of every running thing to a file. The file is
+// replaced in one step, a run killed while saving keeps the last snapshot.
+func SaveSnapshot(path string) error {
+
+	snap, err := TakeSnapshot()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	log.Infof("snapshot of %d things saved to %s", len(snap.Things), path)
+	return nil
+}
+
+// snapshotLoop save a snapshot on every tick, for runs that may be killed
+func snapshotLoop(path string, ticker things.Ticker) {
+	for range ticker.C() {
+		if err := SaveSnapshot(path); err != nil {
+			log.Errorf("snapshot %s: %s", path, err)
+		}
+	}
+}
+
+// LoadSnapshot read a snapshot file
+func LoadSnapshot(path string) (Snapshot, error) {
+
+	var snap Snapshot
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return snap, err
+	}
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return snap, err
+	}
+	if snap.Version != snapshotVersion {
+		return snap, errSnapshotVersion
+	}
+	return snap, nil
+}
+
+// RestoreSnapshot create the things of a snapshot with their saved CIDs and
+// state, and attach inverters to their battery packs again. New things get
+// CIDs after the last one of the snapshot. Every thing is restored and its
+// attachments checked before any is started, a snapshot that can't be
+// restored whole starts none.
+func RestoreSnapshot(snap Snapshot) error {
+
+	running := make(map[uint64]bool)
+	for _, cid := range listener.GetThingsShortD() {
+		running[cid.CidNumber] = true
+	}
+
+	restored := make([]things.Thing, 0, len(snap.Things))
+	for _, saved := range snap.Things {
+		if running[saved.CID] {
+			return fmt.Errorf("%d: %s", saved.CID, errCIDInUse)
+		}
+		thing, err := restoreThing(saved)
+		if err != nil {
+			return err
+		}
+		restored = append(restored, thing)
+		running[saved.CID] = true
+	}
+	if err := checkAttached(snap, restored); err != nil {
+		return err
+	}
+
+	slock.Lock()
+	if snap.NextID > nextID {
+		nextID = snap.NextID
+	}
+	slock.Unlock()
+
+	for n, saved := range snap.Things {
+		thing, cid := restored[n], saved.CID
+		if meter, ok := thing.(things.SiteMeter); ok {
+			meter.SetNetPower(func() float64 { return siteNetPower(listener.SiteOf(cid)) })
+		}
+		site := saved.Site
+		if site == "" {
+			site = DefaultSite
+		}
+		listener.SubscribeToSite(thing, site)
+		log.Debugf("restored %s: %d on site %s", saved.Type, cid, site)
+	}
+
+	// attach once every battery pack is back
+	for _, saved := range snap.Things {
+		if len(saved.Attached) > 0 {
+			if err := AttachInverter(saved.CID, saved.Attached...); err != nil {
+				return fmt.Errorf("%s %d: %s", saved.Type, saved.CID, err)
+			}
+		}
+	}
+	log.Infof("restored %d things, taken %s", len(snap.Things), snap.Taken.Format(time.RFC3339))
+	return nil
+}
+
+// restoreThing create a thing of a snapshot with its saved state, not started
+func restoreThing(saved SnapshotThing) (things.Thing, error) {
+
+	info, ok := things.LookupName(saved.Type)
+	if !ok {
+		return nil, fmt.Errorf("%s: %s", saved.Type, errNoThingType)
+	}
+	thing, err := things.New(info.Type, saved.CID)
+	if err != nil {
+		return nil, err
+	}
+	s, ok := thing.(things.Snapshotter)
+	if !ok {
+		return nil, fmt.Errorf("%s can not be restored", saved.Type)
+	}
+	if err := s.Restore(saved.ThingState); err != nil {
+		return nil, fmt.Errorf("%s %d: %s", saved.Type, saved.CID, err)
+	}
+	return thing, nil
+}
+
+// checkAttached the things attached in a snapshot are battery packs on the
+// site of their inverter, restored with it or already running
+func checkAttached(snap Snapshot, restored []things.Thing) error {
+
+	sites := make(map[uint64]string)
+	packs := make(map[uint64]bool)
+	for n, saved := range snap.Things {
+		sites[saved.CID] = saved.Site
+		if saved.Site == "" {
+			sites[saved.CID] = DefaultSite
+		}
+		_, packs[saved.CID] = restored[n].(*things.BatteryPack)
+	}
+
+	for n, saved := range snap.Things {
+		if len(saved.Attached) == 0 {
+			continue
+		}
+		if _, ok := restored[n].(*things.Inverter); !ok {
+			return fmt.Errorf("%s %d: %s", saved.Type, saved.CID, errNotInverter)
+		}
+		for _, cid := range saved.Attached {
+			pack, site := packs[cid], sites[cid]
+			if _, ok := sites[cid]; !ok {
+				t, err := listener.GetThing(cid)
+				if err != nil {
+					return fmt.Errorf("%s %d: %s", saved.Type, saved.CID, err)
+				}
+				_, pack = t.(*things.BatteryPack)
+				site = listener.SiteOf(cid)
+			}
+			if !pack {
+				return fmt.Errorf("%s %d: %d %s", saved.Type, saved.CID, cid, errNotBatteryPack)
+			}
+			if site != sites[saved.CID] {
+				return fmt.Errorf("%s %d: %d %s", saved.Type, saved.CID, cid, errOtherSite)
+			}
+		}
+	}
+	return nil
+}
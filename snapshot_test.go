@@ -0,0 +1,169 @@
+package tslab
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dfense/tslab/things"
+)
+
+// fleetListener run the supervisor on a listener of its own, with a clock
+// held still so the things don't move between snapshots
+func fleetListener(t *testing.T) {
+
+	clock := things.NewAFAPClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	oldClock, oldListener := things.GetClock(), listener
+	things.SetClock(clock)
+	clock.Join()
+	listener = startListener()
+	slock.Lock()
+	oldID := nextID
+	slock.Unlock()
+
+	t.Cleanup(func() {
+		listener.Stop(true)
+		clock.Leave()
+		listener = oldListener
+		things.SetClock(oldClock)
+		slock.Lock()
+		nextID = oldID
+		slock.Unlock()
+	})
+}
+
+// createFleet two battery packs with an inverter attached on one site, a
+// light on another
+func createFleet(t *testing.T) {
+	packs, err := CreateThingOnSite(things.TBatteryPack, 2, "home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inverter, err := CreateThingOnSite(things.TInverter, 1, "home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := AttachInverter(inverter[0], packs...); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateThingOnSite(things.TLight, 1, "shed"); err != nil {
+		t.Fatal(err)
+	}
+	awaitRunning(t)
+}
+
+// awaitRunning wait for the emit loops of the things to start, the listener
+// only waits for those that have
+func awaitRunning(t *testing.T) {
+	deadline := time.Now().Add(5 * time.Second)
+	for _, cid := range listener.GetThingsShortD() {
+		for t, _ := listener.GetThing(cid.CidNumber); t.ShortD().State == things.StateCreated; {
+			if time.Now().After(deadline) {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+// fleetState the things of a snapshot without their event counts, which move
+// as things start
+func fleetState(t *testing.T, snap Snapshot) string {
+	saved := make([]SnapshotThing, len(snap.Things))
+	for n, s := range snap.Things {
+		s.Events = 0
+		saved[n] = s
+	}
+	data, err := json.Marshal(saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// TestSnapshotRoundTrip a fleet restored from a snapshot has the same things,
+// sites, state and attachments, and new things carry on after its CIDs.
+func TestSnapshotRoundTrip(t *testing.T) {
+
+	fleetListener(t)
+	createFleet(t)
+
+	snap, err := TakeSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snap.Things) != 4 {
+		t.Fatalf("expected 4 things in the snapshot: %d", len(snap.Things))
+	}
+	listener.Stop(false)
+	slock.Lock()
+	nextID = 0
+	slock.Unlock()
+
+	if err := RestoreSnapshot(snap); err != nil {
+		t.Fatal(err)
+	}
+	awaitRunning(t)
+	again, err := TakeSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := fleetState(t, snap), fleetState(t, again); got != want {
+		t.Errorf("expected the restored fleet to match:\n%s\n%s", want, got)
+	}
+	if again.NextID != snap.NextID {
+		t.Errorf("expected next ID %d: %d", snap.NextID, again.NextID)
+	}
+	if ids, err := CreateThing(things.TLight, 1); err != nil || ids[0] != snap.NextID+1 {
+		t.Errorf("expected a new thing after the CIDs of the snapshot: %v %v", ids, err)
+	}
+	awaitRunning(t)
+}
+
+// TestRestoreSnapshotFails a snapshot that can't be restored whole leaves
+// nothing running, whichever thing it fails on.
+func TestRestoreSnapshotFails(t *testing.T) {
+
+	fleetListener(t)
+	createFleet(t)
+	snap, err := TakeSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Stop(false)
+
+	tests := []struct {
+		name   string
+		change func(s *SnapshotThing) // to the last thing of the snapshot
+		err    string
+	}{
+		{"unknown type", func(s *SnapshotThing) { s.Type = "Toaster" }, "Toaster"},
+		{"bad state", func(s *SnapshotThing) { s.Model = json.RawMessage(`{"light_level":"dim"}`) }, "Light"},
+		{"CID twice", func(s *SnapshotThing) { s.CID = snap.Things[0].CID }, "already running"},
+		{"attach", func(s *SnapshotThing) {
+			inverter := snap.Things[2]
+			inverter.Attached = []uint64{s.CID} // the light
+			*s = inverter
+			s.CID = 99
+		}, "Inverter 99"},
+		{"other site", func(s *SnapshotThing) {
+			*s = snap.Things[2]
+			s.CID, s.Site = 99, "shed"
+		}, "different sites"},
+	}
+	for _, tt := range tests {
+		bad := snap
+		bad.NextID = 1000
+		bad.Things = append([]SnapshotThing(nil), snap.Things...)
+		tt.change(&bad.Things[len(bad.Things)-1])
+
+		err := RestoreSnapshot(bad)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: expected an error naming %q: %v", tt.name, tt.err, err)
+		}
+		if running := listener.GetThingsShortD(); len(running) != 0 {
+			t.Errorf("%s: expected nothing running: %+v", tt.name, running)
+		}
+	}
+}
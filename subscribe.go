@@ -0,0 +1,213 @@
+package tslab
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/dfense/tslab/things"
+)
+
+var (
+	errNoSubscription       = errors.New("not subscribed")
+	errSubscriptionOverflow = errors.New("subscription overflow must be block, drop-newest or drop-oldest")
+)
+
+// Filter which events a subscription gets. An event must pass every part
+// that is set, an empty Filter passes them all.
+type Filter struct {
+	Types []string                     // thing types, any case
+	CIDs  []uint64                     // CIDs of the things
+	Match func(things.ThingEvent) bool // any other test, called from the listener loop
+}
+
+// SubscribeOptions buffer of a subscription and what gives when it is full.
+// The zero value is a buffer of 1024 events and OverflowBlock.
+type SubscribeOptions struct {
+	Buffer   int            // events queued for the subscriber
+	Overflow OverflowPolicy // OverflowBlock, OverflowDropNewest or OverflowDropOldest
+}
+
+// Subscription events of the listener delivered in process, to a channel or
+// a callback, see Subscribe and SubscribeFunc
+type Subscription struct {
+	dropped  uint64                   // first for 64bit atomic alignment
+	C        <-chan things.ThingEvent // events of a channel subscription, closed once unsubscribed
+	queue    chan things.ThingEvent
+	types    map[string]bool
+	cids     map[uint64]bool
+	match    func(things.ThingEvent) bool
+	overflow OverflowPolicy
+	cancel   chan struct{}  // closed by Unsubscribe, frees a blocked send
+	senders  sync.WaitGroup // sends in flight, the queue closes once they are done
+	once     sync.Once
+	done     chan struct{} // closed once a callback has returned for the last time
+}
+
+// Dropped events that passed the filter but found the buffer full
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Subscribe get the events that pass a filter on the channel C of the
+// subscription, from now until Unsubscribe or the listener stops, which
+// close C. With OverflowBlock a subscriber that doesn't read holds up the
+// listener, and so every sink and thing.
+func (l *Listener) Subscribe(f Filter, opts SubscribeOptions) (*Subscription, error) {
+
+	s, err := newSubscription(f, opts)
+	if err != nil {
+		return nil, err
+	}
+	s.C = s.queue
+	close(s.done)
+	l.addSubscription(s)
+	return s, nil
+}
+
+// SubscribeFunc call fn with the events that pass a filter, in order, from a
+// goroutine of the subscription. Unsubscribe waits for fn to return, so don't
+// call it from fn.
+func (l *Listener) SubscribeFunc(f Filter, opts SubscribeOptions, fn func(things.ThingEvent)) (*Subscription, error) {
+
+	s, err := newSubscription(f, opts)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		defer close(s.done)
+		for e := range s.queue {
+			fn(e)
+		}
+	}()
+	l.addSubscription(s)
+	return s, nil
+}
+
+// Unsubscribe stop the events of a subscription and close it. Events already
+// queued stay readable on C, or are handed to the callback first.
+// returns errNoSubscription
+func (l *Listener) Unsubscribe(s *Subscription) error {
+
+	s.once.Do(func() { close(s.cancel) })
+	l.sinksLock.Lock()
+	_, ok := l.subscriptions[s]
+	delete(l.subscriptions, s)
+	l.sinksLock.Unlock()
+
+	if !ok {
+		return errNoSubscription
+	}
+	s.senders.Wait()
+	close(s.queue)
+	<-s.done
+	return nil
+}
+
+// newSubscription subscription of a filter, not added to the listener yet
+func newSubscription(f Filter, opts SubscribeOptions) (*Subscription, error) {
+
+	if opts.Buffer < 1 {
+		opts.Buffer = sinkBuffer
+	}
+	switch opts.Overflow {
+	case 0:
+		opts.Overflow = OverflowBlock
+	case OverflowBlock, OverflowDropNewest, OverflowDropOldest:
+	default:
+		return nil, errSubscriptionOverflow
+	}
+
+	s := &Subscription{
+		queue:    make(chan things.ThingEvent, opts.Buffer),
+		match:    f.Match,
+		overflow: opts.Overflow,
+		cancel:   make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if len(f.Types) > 0 {
+		s.types = make(map[string]bool)
+		for _, tt := range f.Types {
+			s.types[strings.ToLower(tt)] = true
+		}
+	}
+	if len(f.CIDs) > 0 {
+		s.cids = make(map[uint64]bool)
+		for _, cid := range f.CIDs {
+			s.cids[cid] = true
+		}
+	}
+	return s, nil
+}
+
+// addSubscription start handing events to a subscription
+func (l *Listener) addSubscription(s *Subscription) {
+	l.sinksLock.Lock()
+	l.subscriptions[s] = true
+	l.sinksLock.Unlock()
+}
+
+// passes the event gets through the filter of the subscription
+func (s *Subscription) passes(e things.ThingEvent) bool {
+	switch {
+	case s.types != nil && !s.types[strings.ToLower(e.ThingType)]:
+		return false
+	case s.cids != nil && !s.cids[e.ThingID]:
+		return false
+	case s.match != nil && !s.match(e):
+		return false
+	}
+	return true
+}
+
+// send queue an event for the subscriber as its overflow policy says, call
+// from the listener loop without sinksLock, see fanOut
+func (s *Subscription) send(e things.ThingEvent) {
+
+	if !s.passes(e) {
+		return
+	}
+	switch s.overflow {
+	case OverflowBlock:
+		select {
+		case s.queue <- e:
+		case <-s.cancel: // unsubscribing
+		}
+	case OverflowDropNewest:
+		select {
+		case s.queue <- e:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	case OverflowDropOldest:
+		for {
+			select {
+			case s.queue <- e:
+				return
+			default:
+			}
+			select {
+			case <-s.queue:
+				atomic.AddUint64(&s.dropped, 1)
+			default: // read by the subscriber meanwhile
+			}
+		}
+	}
+}
+
+// closeSubscriptions close every subscription as the listener stops
+func (l *Listener) closeSubscriptions() {
+
+	l.sinksLock.Lock()
+	subscriptions := l.subscriptions
+	l.subscriptions = make(map[*Subscription]bool)
+	l.sinksLock.Unlock()
+
+	for s := range subscriptions {
+		s.once.Do(func() { close(s.cancel) })
+		s.senders.Wait()
+		close(s.queue)
+		<-s.done
+	}
+}
@@ -0,0 +1,152 @@
+package tslab
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dfense/tslab/things"
+)
+
+// TestFilter an event must pass every part of a filter that is set.
+func TestFilter(t *testing.T) {
+
+	light := things.ThingEvent{ThingID: 1, ThingType: "Light"}
+	pack := things.ThingEvent{ThingID: 2, ThingType: "BatteryPack"}
+	odd := func(e things.ThingEvent) bool { return e.ThingID%2 == 1 }
+
+	tests := []struct {
+		name   string
+		filter Filter
+		passes []bool // light, pack
+	}{
+		{"empty", Filter{}, []bool{true, true}},
+		{"type", Filter{Types: []string{"light"}}, []bool{true, false}},
+		{"types any case", Filter{Types: []string{"LIGHT", "batterypack"}}, []bool{true, true}},
+		{"cid", Filter{CIDs: []uint64{2}}, []bool{false, true}},
+		{"match", Filter{Match: odd}, []bool{true, false}},
+		{"all parts", Filter{Types: []string{"BatteryPack"}, Match: odd}, []bool{false, false}},
+	}
+	for _, tt := range tests {
+		s, err := newSubscription(tt.filter, SubscribeOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, e := range []things.ThingEvent{light, pack} {
+			if s.passes(e) != tt.passes[i] {
+				t.Errorf("%s: expected %s to pass %t", tt.name, e.ThingType, tt.passes[i])
+			}
+		}
+	}
+	if _, err := newSubscription(Filter{}, SubscribeOptions{Overflow: OverflowSample}); err != errSubscriptionOverflow {
+		t.Errorf("expected sample refused: %v", err)
+	}
+}
+
+// TestSubscriptionOverflow what a full subscription keeps of five events, and
+// that it counts the ones it drops.
+func TestSubscriptionOverflow(t *testing.T) {
+
+	tests := []struct {
+		overflow OverflowPolicy
+		kept     []uint64
+	}{
+		{OverflowDropNewest, []uint64{1, 2}},
+		{OverflowDropOldest, []uint64{4, 5}},
+	}
+	for _, tt := range tests {
+		s, _ := newSubscription(Filter{}, SubscribeOptions{Buffer: 2, Overflow: tt.overflow})
+		for i := 1; i <= 5; i++ {
+			s.send(things.ThingEvent{ThingID: uint64(i)})
+		}
+		close(s.queue)
+		kept := make([]uint64, 0)
+		for e := range s.queue {
+			kept = append(kept, e.ThingID)
+		}
+		if len(kept) != 2 || kept[0] != tt.kept[0] || kept[1] != tt.kept[1] {
+			t.Errorf("overflow %d: expected %v: %v", tt.overflow, tt.kept, kept)
+		}
+		if s.Dropped() != 3 {
+			t.Errorf("overflow %d: expected 3 dropped: %d", tt.overflow, s.Dropped())
+		}
+	}
+}
+
+// TestSubscribeBlock a subscriber that doesn't read holds up the listener
+// until it unsubscribes, and loses nothing meanwhile.
+func TestSubscribeBlock(t *testing.T) {
+
+	l := startListener()
+	s, err := l.Subscribe(Filter{}, SubscribeOptions{Buffer: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	published := make(chan struct{})
+	go func() { publish(l, 10, "Light"); close(published) }()
+	select {
+	case <-published:
+		t.Fatal("expected the subscriber to hold up the listener")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	if err := l.Unsubscribe(s); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-published:
+	case <-time.After(time.Second):
+		t.Fatal("expected unsubscribing to free the listener")
+	}
+	if e, ok := <-s.C; !ok || e.ThingID != 1 || s.Dropped() != 0 {
+		t.Errorf("expected the queued event readable and nothing dropped: %+v", e)
+	}
+	if _, ok := <-s.C; ok {
+		t.Error("expected C closed")
+	}
+	l.Stop(true)
+}
+
+// TestSubscribe channel and callback subscriptions get the events of their
+// filter until the listener stops, which closes them.
+func TestSubscribe(t *testing.T) {
+
+	l := startListener()
+	lights, err := l.Subscribe(Filter{Types: []string{"light"}}, SubscribeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var packs []things.ThingEvent
+	fn, err := l.SubscribeFunc(Filter{Types: []string{"BatteryPack"}}, SubscribeOptions{},
+		func(e things.ThingEvent) {
+			mu.Lock()
+			packs = append(packs, e)
+			mu.Unlock()
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publish(l, 3, "Light")
+	publish(l, 2, "BatteryPack")
+	l.Stop(true)
+
+	var got []things.ThingEvent
+	for e := range lights.C { // closed by Stop
+		got = append(got, e)
+	}
+	if len(got) != 3 || got[0].ThingID != 1 || got[2].ThingID != 3 {
+		t.Errorf("expected the 3 light events: %+v", got)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(packs) != 2 || packs[0].ThingID != 1 {
+		t.Errorf("expected the 2 battery pack events, callback done by Stop: %+v", packs)
+	}
+	for _, s := range []*Subscription{lights, fn} {
+		if err := l.Unsubscribe(s); err != errNoSubscription {
+			t.Errorf("expected the subscription gone after Stop: %v", err)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/dfense/tslab/things"
 	log "github.com/sirupsen/logrus"
@@ -15,31 +16,106 @@ var (
 	initialized uint64     // use atomic reader to verify initialized
 	listener    *Listener
 	nextID      uint64 // the next ID to be assigned to a new thing
+	snapshotTo  string // snapshot file written when the run exits, empty for none
 
 	errNoThingType            = errors.New("no thing type by that name")
 	errAlreadyInitialized     = errors.New("listener already initialized")
+	errNotInverter            = errors.New("thing is not an inverter")
+	errNotBatteryPack         = errors.New("thing is not a battery pack")
+	errNotControllable        = errors.New("thing does not accept commands")
+	errNotPausable            = errors.New("thing can not be paused")
+	errNotCadenced            = errors.New("thing cadence can not be changed")
+	errOtherSite              = errors.New("inverter and battery pack are on different sites")
+	errRestoreScenario        = errors.New("restore and scenario can not be used together")
 	ErrInvalidAutoStartOption = errors.New("invalid autostart option")
 )
 
 // ConfigData read in on CLI
 type ConfigData struct {
-	Autostart string
+	Autostart  string
+	Seed       int64        // seed of the run, 0 keeps the seed picked from the clock
+	Scenario   string       // scenario file to run instead of Autostart, empty for none
+	ReplayFile string       // events file to replay at start, empty for none
+	Replay     ReplayConfig // how ReplayFile is replayed
+
+	Restore       string        // snapshot file to restore the fleet from, replaces Autostart
+	Snapshot      string        // snapshot file written on exit, empty for none
+	SnapshotEvery time.Duration // also write Snapshot this often in clock time, 0 only on exit
 }
 
 // Initialize process command line parameters and initialize the start of app
 func Initialize(c ConfigData) error {
 
-	switch c.Autostart {
-	case "true":
-		CreateThing(things.TBatteryPack, 1)
-		CreateThing(things.TInverter, 1)
+	var snap Snapshot
+	if c.Restore != "" {
+		if c.Scenario != "" {
+			return errRestoreScenario
+		}
+		var err error
+		snap, err = LoadSnapshot(c.Restore)
+		if err != nil {
+			return err
+		}
+		if c.Seed == 0 {
+			c.Seed = snap.Seed
+		}
+	}
+
+	var scenario Scenario
+	if c.Scenario != "" {
+		var err error
+		scenario, err = LoadScenario(c.Scenario)
+		if err != nil {
+			return err
+		}
+		if c.Seed == 0 {
+			c.Seed = scenario.Seed
+		}
+	}
+
+	// seed before any thing is created, log it so the run can be repeated
+	if c.Seed != 0 {
+		things.SetSeed(c.Seed)
+	}
+	log.Infof("seed: %d", things.Seed())
+
+	// a snapshot or scenario declares the fleet, autostart is ignored
+	switch {
+	case c.Restore != "":
+		if err := RestoreSnapshot(snap); err != nil {
+			return err
+		}
+	case c.Scenario != "":
+		if err := RunScenario(scenario); err != nil {
+			return err
+		}
+		log.Infof("running scenario %s", c.Scenario)
+	case c.Autostart == "true":
+		batteries, _ := CreateThing(things.TBatteryPack, 1)
+		inverters, _ := CreateThing(things.TInverter, 1)
 		CreateThing(things.TLight, 1)
-	case "false":
+		AttachInverter(inverters[0], batteries...)
+	case c.Autostart == "false":
 
 	default:
 		return ErrInvalidAutoStartOption
 	}
 
+	if c.ReplayFile != "" {
+		if _, err := StartReplay(c.ReplayFile, c.Replay); err != nil {
+			return err
+		}
+	}
+
+	if c.Snapshot != "" {
+		slock.Lock()
+		snapshotTo = c.Snapshot
+		slock.Unlock()
+		if c.SnapshotEvery > 0 {
+			go snapshotLoop(c.Snapshot, things.GetClock().NewTicker(c.SnapshotEvery))
+		}
+	}
+
 	return nil
 }
 
@@ -61,6 +137,18 @@ func SetListener(l *Listener) error {
 // exit = if true stop listener, close channel and io.writer
 //        if false just stop all the things
 func Stop(exit bool) {
+
+	if exit {
+		slock.Lock()
+		path := snapshotTo
+		slock.Unlock()
+		if path != "" {
+			if err := SaveSnapshot(path); err != nil {
+				log.Errorf("snapshot %s: %s", path, err)
+			}
+		}
+	}
+
 	// dispatch stop to listener
 	listener.Stop(exit)
 
@@ -80,44 +168,320 @@ func StopThingsByCID(cid uint64) error {
 	return listener.StopByCID(cid)
 }
 
-// CreateThing create new thing.
-// type = the thing type to start
+// StopThingsBySite shut down all things on a site
+func StopThingsBySite(site string) error {
+	return listener.StopBySite(site)
+}
+
+// CreateThing create new thing on the DefaultSite.
+// type = the thing type to start, any type in the things registry
+// qty = number of thing agents to start
+// returns the CIDs of the things created
+func CreateThing(thingtype things.ThingType, qty int) ([]uint64, error) {
+	return CreateThingOnSite(thingtype, qty, DefaultSite)
+}
+
+// CreateThingOnSite create new thing on a site.
+// type = the thing type to start, any type in the things registry
+// qty = number of thing agents to start
+// site = name of the site, created with its first thing
+// returns the CIDs of the things created
+func CreateThingOnSite(thingtype things.ThingType, qty int, site string) ([]uint64, error) {
+	if site == "" {
+		return nil, errEmptySite
+	}
+	return CreateThings(thingtype, qty, CreateOptions{Site: site})
+}
+
+// CreateOptions how CreateThings sets up new things
+type CreateOptions struct {
+	Site    string          // name of the site, DefaultSite when empty
+	Cadence *things.Cadence // time between events, nil keeps the default of the type
+	Factory things.Factory  // creates the things, e.g. from a config, nil uses the registry
+}
+
+// CreateThings create new things set up before they emit their first event.
+// type = the thing type to start, any type in the things registry
 // qty = number of thing agents to start
-func CreateThing(thingtype things.ThingType, qty int) error {
+// opts = site, cadence and factory of the things
+// returns the CIDs of the things created
+func CreateThings(thingtype things.ThingType, qty int, opts CreateOptions) ([]uint64, error) {
 
+	if _, ok := thingtype.Info(); !ok {
+		return nil, errNoThingType
+	}
+	site := opts.Site
+	if site == "" {
+		site = DefaultSite
+	}
+
+	ids := make([]uint64, 0, qty)
 	for i := 0; i < qty; i++ {
-		switch thingtype {
+		id := getNextID()
+		var thing things.Thing
+		var err error
+		if opts.Factory != nil {
+			thing = opts.Factory(id)
+		} else if thing, err = things.New(thingtype, id); err != nil {
+			return ids, err
+		}
+
+		if opts.Cadence != nil {
+			c, ok := thing.(things.Cadenced)
+			if !ok {
+				return ids, errNotCadenced
+			}
+			if err := c.SetCadence(*opts.Cadence); err != nil {
+				return ids, err
+			}
+		}
+
+		// meters need to see the rest of whichever site they are on
+		if meter, ok := thing.(things.SiteMeter); ok {
+			meter.SetNetPower(func() float64 { return siteNetPower(listener.SiteOf(id)) })
+		}
+
+		// add to listener
+		listener.SubscribeToSite(thing, site)
+		ids = append(ids, id)
+		log.Debugf("created %s: %d on site %s", thingtype, id, site)
+	}
+	return ids, nil
+}
+
+// StartReplay replay an events file through the listener, see Replay
+// path = events file written by the listener
+// cfg = speed and filters of the replay
+// returns the CID of the replay, stop it like any thing
+func StartReplay(path string, cfg ReplayConfig) (uint64, error) {
+
+	id := getNextID()
+	r, err := NewReplayFile(id, path, cfg)
+	if err != nil {
+		return 0, err
+	}
+	listener.SubscribeToSite(r, "") // a replay is not part of any site
+	log.Infof("replaying %s: %d", path, id)
+	return id, nil
+}
+
+// AttachInverter connect battery packs to the DC side of an inverter
+// inverterCID = CID of a running inverter
+// batteryCIDs = CIDs of running battery packs
+func AttachInverter(inverterCID uint64, batteryCIDs ...uint64) error {
+
+	t, err := listener.GetThing(inverterCID)
+	if err != nil {
+		return err
+	}
+	inverter, ok := t.(*things.Inverter)
+	if !ok {
+		return errNotInverter
+	}
+
+	for _, cid := range batteryCIDs {
+		t, err := listener.GetThing(cid)
+		if err != nil {
+			return err
+		}
+		battery, ok := t.(*things.BatteryPack)
+		if !ok {
+			return errNotBatteryPack
+		}
+		if listener.SiteOf(cid) != listener.SiteOf(inverterCID) {
+			return errOtherSite
+		}
+		inverter.Attach(battery)
+	}
+	return nil
+}
 
-		case things.TBatteryPack:
-			battery := things.NewBatteryPack(getNextID())
+// SendCommand change a running thing, see things.Controllable
+// cid = CID of the thing
+// cmd = the change to make
+// returns the acknowledgement or rejection of the thing
+func SendCommand(cid uint64, cmd things.Command) (things.Ack, error) {
 
-			// add to listener
-			listener.SubscribeToThing(&battery)
-			log.Printf("batterypack")
+	t, err := listener.GetThing(cid)
+	if err != nil {
+		return things.Ack{}, err
+	}
+	c, ok := t.(things.Controllable)
+	if !ok {
+		return things.Ack{}, errNotControllable
+	}
+	return c.Control(cmd), nil
+}
 
-		case things.TInverter:
-			inverter := things.NewInverter(getNextID())
-			log.Printf("inverter")
-			listener.SubscribeToThing(&inverter)
+// SetCadenceByCID change the time between events of a running thing
+func SetCadenceByCID(cid uint64, cadence things.Cadence) error {
+	t, err := listener.GetThing(cid)
+	if err != nil {
+		return err
+	}
+	c, ok := t.(things.Cadenced)
+	if !ok {
+		return errNotCadenced
+	}
+	return c.SetCadence(cadence)
+}
 
-		case things.TLight:
-			light := things.NewLight(getNextID())
-			log.Printf("light")
-			listener.SubscribeToThing(&light)
+// SetCadenceByType change the time between events of all things of a type
+func SetCadenceByType(tt things.ThingType, cadence things.Cadence) error {
+	list, err := listener.GetThingsByType(tt)
+	if err != nil {
+		return err
+	}
+	for _, t := range list {
+		if c, ok := t.(things.Cadenced); ok {
+			if err := c.SetCadence(cadence); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
 
-		default:
-			return errNoThingType
+// PauseThingByCID silence a thing, it keeps its state and CID until resumed
+func PauseThingByCID(cid uint64) error {
+	return pauseResume(cid, things.Pausable.Pause)
+}
+
+// ResumeThingByCID resume a paused thing
+func ResumeThingByCID(cid uint64) error {
+	return pauseResume(cid, things.Pausable.Resume)
+}
+
+// PauseThingsByType silence all running things of a type
+func PauseThingsByType(tt things.ThingType) error {
+	return pauseResumeType(tt, things.Pausable.Pause)
+}
+
+// ResumeThingsByType resume all paused things of a type
+func ResumeThingsByType(tt things.ThingType) error {
+	return pauseResumeType(tt, things.Pausable.Resume)
+}
 
+// pauseResume apply pause or resume to one thing
+func pauseResume(cid uint64, f func(things.Pausable) error) error {
+	t, err := listener.GetThing(cid)
+	if err != nil {
+		return err
+	}
+	p, ok := t.(things.Pausable)
+	if !ok {
+		return errNotPausable
+	}
+	return f(p)
+}
+
+// pauseResumeType apply pause or resume to all things of a type, those
+// already in the state asked for are left alone
+func pauseResumeType(tt things.ThingType, f func(things.Pausable) error) error {
+	list, err := listener.GetThingsByType(tt)
+	if err != nil {
+		return err
+	}
+	for _, t := range list {
+		if p, ok := t.(things.Pausable); ok {
+			f(p)
 		}
 	}
 	return nil
 }
 
+// siteNetPower power injected into a site by its running things, other than
+// the meters reading it
+func siteNetPower(site string) float64 {
+	watts := 0.0
+	for _, f := range listener.PowerFlows(site) {
+		if _, ok := f.(things.SiteMeter); ok {
+			continue
+		}
+		watts += f.NetWatts()
+	}
+	return watts
+}
+
+// AssignSite move a running thing to another site
+func AssignSite(cid uint64, site string) error {
+	return listener.AssignSite(cid, site)
+}
+
+// GetSites names of all sites with things running on them
+func GetSites() []string {
+	return listener.Sites()
+}
+
+// GetSiteBalances energy balance of every site
+func GetSiteBalances() []SiteBalance {
+	return listener.SiteBalances()
+}
+
 // GetThingsList get a list of all running things Short Description
 func GetThingsList() []things.CID {
 	return listener.GetThingsShortD()
 }
 
+// GetSiteThingsList get a list of the running things on a site
+func GetSiteThingsList(site string) []things.CID {
+	cids := make([]things.CID, 0)
+	for _, cid := range listener.GetThingsShortD() {
+		if cid.Site == site {
+			cids = append(cids, cid)
+		}
+	}
+	return cids
+}
+
+// AddSink fan events out to another sink while running
+// name = name to list and remove the sink by
+// spec = file:<path>, tcp:<host:port>, udp:<host:port> or mem:<size>, see ParseSink
+func AddSink(name, spec string) error {
+	sink, err := ParseSink(spec)
+	if err != nil {
+		return err
+	}
+	if err := listener.AddSink(name, sink); err != nil {
+		sink.Close()
+		return err
+	}
+	log.Infof("sink %s: %s", name, spec)
+	return nil
+}
+
+// RemoveSink stop sending events to a sink, it is flushed and closed
+func RemoveSink(name string) error {
+	return listener.RemoveSink(name)
+}
+
+// GetSinks counters of every sink
+func GetSinks() []SinkStats {
+	return listener.SinkStats()
+}
+
+// TailSink last n events held by an in-memory sink, oldest first
+func TailSink(name string, n int) ([]things.ThingEvent, error) {
+	sink, err := listener.Sink(name)
+	if err != nil {
+		return nil, err
+	}
+	tap, ok := sink.(*MemorySink)
+	if !ok {
+		return nil, errNotMemory
+	}
+	events := tap.Events()
+	if n < len(events) {
+		events = events[len(events)-n:]
+	}
+	return events, nil
+}
+
+// GetBackpressure policy of the event queue, how full it is and what it dropped
+func GetBackpressure() BackpressureStats {
+	return listener.BackpressureStats()
+}
+
 // ConfigureWriter take configuration for writer
 // CLI options forwarded here (or config file upgrade)
 func ConfigureWriter() {
@@ -126,8 +490,8 @@ func ConfigureWriter() {
 }
 
 func getNextID() uint64 {
+	defer slock.Unlock()
 	slock.Lock()
 	nextID++
-	slock.Unlock()
 	return nextID
 }
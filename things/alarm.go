@@ -0,0 +1,189 @@
+package things
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Severity how urgent an alarm is
+type Severity uint8
+
+// alarm severities, least urgent first
+const (
+	SeverityWarning Severity = iota + 1
+	SeverityMajor
+	SeverityCritical
+)
+
+// String name of the severity
+func (s Severity) String() string {
+	switch s {
+	case SeverityWarning:
+		return "warning"
+	case SeverityMajor:
+		return "major"
+	case SeverityCritical:
+		return "critical"
+	}
+	return "unknown"
+}
+
+// MarshalText severity is published by name
+func (s Severity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText severity is read by name
+func (s *Severity) UnmarshalText(text []byte) error {
+	for _, v := range []Severity{SeverityWarning, SeverityMajor, SeverityCritical} {
+		if v.String() == string(text) {
+			*s = v
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown severity %q", text)
+}
+
+// AlarmCode condition an alarm reports
+type AlarmCode string
+
+// alarms raised by the built in things
+const (
+	AlarmOverTemp      AlarmCode = "over_temperature" // BatteryPack hottest thermistor
+	AlarmOverVoltage   AlarmCode = "over_voltage"     // BatteryPack highest cell
+	AlarmGroundFault   AlarmCode = "ground_fault"     // Inverter insulation resistance
+	AlarmDriverFailure AlarmCode = "driver_failure"   // Light LED driver, latched until reset
+)
+
+// AlarmRule set and clear thresholds of an alarm on a reading. The alarm is
+// raised when the reading reaches Set and cleared once it is back past Clear,
+// the gap between them is the hysteresis. Set above Clear alarms on a high
+// reading, Set below Clear on a low one. A rule without a Code is disabled.
+type AlarmRule struct {
+	Code     AlarmCode
+	Severity Severity
+	Set      float64
+	Clear    float64
+}
+
+// Alarm payload of a KindAlarm event, published when an alarm is raised and
+// again when it clears
+type Alarm struct {
+	Code      AlarmCode `json:"code"`
+	Severity  Severity  `json:"severity"`
+	Active    bool      `json:"active"`    // true raised, false cleared
+	Value     float64   `json:"value"`     // reading that raised or cleared the alarm
+	Threshold float64   `json:"threshold"` // threshold crossed, 0 for faults without a reading
+	Raised    time.Time `json:"raised"`    // when the alarm was raised
+}
+
+// severities of the built in alarms, injected faults of other codes are major
+var alarmSeverity = map[AlarmCode]Severity{
+	AlarmOverTemp:      SeverityMajor,
+	AlarmOverVoltage:   SeverityCritical,
+	AlarmGroundFault:   SeverityCritical,
+	AlarmDriverFailure: SeverityMajor,
+}
+
+// Alarmed implemented by things that raise alarms
+type Alarmed interface {
+	ActiveAlarms() []Alarm // alarms raised and not yet cleared
+}
+
+// ActiveAlarms implements Alarmed, sorted by code
+func (b *base) ActiveAlarms() []Alarm {
+
+	defer b.mu.Unlock()
+	b.mu.Lock()
+
+	active := make([]Alarm, 0, len(b.alarms))
+	for _, a := range b.alarms {
+		active = append(active, a)
+	}
+	sort.Slice(active, func(i, j int) bool { return active[i].Code < active[j].Code })
+	return active
+}
+
+// checkAlarm raise or clear the alarm of a rule for a reading, call with the lock held
+func (b *base) checkAlarm(rule AlarmRule, value float64, now time.Time) {
+
+	if rule.Code == "" || b.faults[rule.Code] {
+		return
+	}
+
+	high := rule.Set >= rule.Clear
+	if b.alarmActive(rule.Code) {
+		if (high && value <= rule.Clear) || (!high && value >= rule.Clear) {
+			b.clearAlarm(rule.Code, value, rule.Clear)
+		}
+		return
+	}
+	if (high && value >= rule.Set) || (!high && value <= rule.Set) {
+		b.raiseAlarm(rule.Code, rule.Severity, value, rule.Set, now)
+	}
+}
+
+// injectFault raise an alarm by code and hold it, readings no longer clear it
+// until releaseFault. Call with the lock held.
+func (b *base) injectFault(code AlarmCode) error {
+
+	if code == "" {
+		return errNoAlarmCode
+	}
+	severity, ok := alarmSeverity[code]
+	if !ok {
+		severity = SeverityMajor
+	}
+	b.faults[code] = true
+	b.raiseAlarm(code, severity, 0, 0, b.clock.Now())
+	return nil
+}
+
+// releaseFault stop holding an injected fault and clear its alarm, call with
+// the lock held
+func (b *base) releaseFault(code AlarmCode) error {
+
+	if !b.faults[code] {
+		return errNotFaulted
+	}
+	delete(b.faults, code)
+	b.clearAlarm(code, 0, 0)
+	return nil
+}
+
+// alarmActive call with the lock held
+func (b *base) alarmActive(code AlarmCode) bool {
+	_, ok := b.alarms[code]
+	return ok
+}
+
+// raiseAlarm make an alarm active and queue its event, call with the lock held
+func (b *base) raiseAlarm(code AlarmCode, severity Severity, value, threshold float64, now time.Time) {
+
+	if b.alarmActive(code) {
+		return
+	}
+	a := Alarm{Code: code, Severity: severity, Active: true, Value: round(value), Threshold: threshold, Raised: now}
+	b.alarms[code] = a
+	atomic.AddInt32(&b.alarmCount, 1)
+	b.queue(KindAlarm, a)
+	b.updateFaulted()
+}
+
+// clearAlarm clear an active alarm and queue its event, call with the lock held
+func (b *base) clearAlarm(code AlarmCode, value, threshold float64) {
+
+	a, ok := b.alarms[code]
+	if !ok {
+		return
+	}
+	delete(b.alarms, code)
+	atomic.AddInt32(&b.alarmCount, -1)
+	a.Active = false
+	a.Value = round(value)
+	a.Threshold = threshold
+	b.queue(KindAlarm, a)
+	b.updateFaulted()
+}
@@ -0,0 +1,114 @@
+package things
+
+import (
+	"testing"
+	"time"
+)
+
+// noRandomFaults switch off the random faults of the things, call the
+// returned func to switch them back on
+func noRandomFaults() func() {
+	inverter := invFaultChance
+	invFaultChance = 0
+	return func() {
+		invFaultChance = inverter
+	}
+}
+
+// TestAlarmHysteresis an alarm is raised at its set threshold and only clears
+// once the reading is back past the clear threshold, for high and low rules.
+func TestAlarmHysteresis(t *testing.T) {
+
+	b := newBase(1, "Test", FixedCadence(time.Second))
+	now := time.Now()
+	high := AlarmRule{Code: AlarmOverTemp, Severity: SeverityMajor, Set: 45, Clear: 40}
+	low := AlarmRule{Code: AlarmGroundFault, Severity: SeverityCritical, Set: 100, Clear: 500}
+
+	steps := []struct {
+		rule   AlarmRule
+		value  float64
+		active bool
+	}{
+		{high, 44, false},
+		{high, 45, true},
+		{high, 42, true}, // inside the hysteresis
+		{high, 40, false},
+		{low, 200, false},
+		{low, 90, true},
+		{low, 300, true},
+		{low, 500, false},
+	}
+	for n, s := range steps {
+		b.checkAlarm(s.rule, s.value, now)
+		if b.alarmActive(s.rule.Code) != s.active {
+			t.Errorf("step %d: %s at %g expected active %t", n, s.rule.Code, s.value, s.active)
+		}
+	}
+
+	if len(b.pending) != 4 {
+		t.Fatalf("expected an event per raise and clear: %d", len(b.pending))
+	}
+	for _, e := range b.pending {
+		if e.Kind != KindAlarm {
+			t.Errorf("expected alarm events: %s", e.Kind)
+		}
+	}
+	if a := b.pending[1].EventData.(Alarm); a.Active || a.Code != AlarmOverTemp || a.Threshold != 40 {
+		t.Errorf("expected over temperature cleared at 40: %+v", a)
+	}
+}
+
+// TestBatteryOverTemp a hot pack raises its over temperature alarm and counts
+// it in the short description.
+func TestBatteryOverTemp(t *testing.T) {
+
+	cfg := DefaultBatteryConfig()
+	cfg.InitialSoC = 0.5
+	battery := NewBatteryPackConfig(1, cfg)
+
+	battery.setAmps(200)
+	battery.heat(100 * cfg.HeatCapacity / cfg.CoolingCoeff)
+	battery.updateTemps()
+	battery.checkAlarms(time.Now())
+
+	active := battery.ActiveAlarms()
+	if len(active) != 1 || active[0].Code != AlarmOverTemp || active[0].Severity != SeverityMajor {
+		t.Fatalf("expected an over temperature alarm: %+v", active)
+	}
+	if battery.ShortD().Alarms != 1 {
+		t.Errorf("expected 1 active alarm in the short description: %d", battery.ShortD().Alarms)
+	}
+}
+
+// TestLightDriverFailure the driver of a default light never fails on its
+// own, a failed driver holds the light dark and rejects commands to turn it
+// on until it is reset.
+func TestLightDriverFailure(t *testing.T) {
+
+	light := NewLight(1)
+	for n := 0; n < 1000; n++ {
+		if light.sample(time.Now()); len(light.ActiveAlarms()) != 0 {
+			t.Fatalf("expected the default light to never fail: %+v", light.ActiveAlarms())
+		}
+	}
+
+	light = NewLightConfig(1, LightConfig{DriverFailChance: 1})
+	sampled := light.sample(time.Now()).(Light)
+	if sampled.State || sampled.LightLevel != 0 || light.NetWatts() != 0 {
+		t.Errorf("expected a dark light: %t %d", sampled.State, sampled.LightLevel)
+	}
+	if ack := light.Control(Command{Name: "state", Value: "on"}); ack.Accepted {
+		t.Errorf("expected state on to be rejected: %+v", ack)
+	}
+
+	light.config.DriverFailChance = 0
+	if ack := light.Control(Command{Name: "reset"}); !ack.Accepted {
+		t.Fatalf("expected reset to be accepted: %+v", ack)
+	}
+	if len(light.ActiveAlarms()) != 0 {
+		t.Errorf("expected the driver failure cleared: %+v", light.ActiveAlarms())
+	}
+	if ack := light.Control(Command{Name: "state", Value: "on"}); !ack.Accepted {
+		t.Errorf("expected state on to be accepted after reset: %+v", ack)
+	}
+}
@@ -0,0 +1,190 @@
+package things
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// base identity, timing and emit loop common to all things. Things embed it
+// and hand run a sample func that advances their model to now and returns
+// the event payload.
+type base struct {
+	evtCount    uint64              // number of events generated, first for 64bit atomic alignment
+	id          uint64              // non serializable id
+	createdTime time.Time           // time the object was created
+	thingType   string              // name of thing type
+	cadence     Cadence             // time between events, use with the lock held
+	stopC       chan struct{}       // internal stopC interupt
+	mu          *sync.Mutex         // guards the model of the thing while sampling
+	rng         rng                 // values of the model, use with the lock held
+	timing      rng                 // delays between events, used by the emit loop only
+	pending     []ThingEvent        // events queued by the model, sent ahead of the next telemetry
+	alarms      map[AlarmCode]Alarm // active alarms, use with the lock held
+	alarmCount  int32               // number of active alarms, read without the lock by ShortD
+	faults      map[AlarmCode]bool  // injected faults held active, use with the lock held
+	state       int32               // lifecycle State, written with the lock held
+	wakeC       chan struct{}       // wakes the emit loop to send a transition
+	clock       Clock               // source of time, simulated or the wall clock
+	exception   Exception           // report by exception settings, use with the lock held
+	reported    report              // last telemetry sent by exception, use with the lock held
+	fields      fieldValues         // telemetry deadbands are checked against, use with the lock held
+}
+
+// newBase ID = cid  code challenge id. Increment ID created by supervisor unique to all things
+// thingType = name of the thing type
+// cadence = time between events
+func newBase(ID uint64, thingType string, cadence Cadence) base {
+	clock := GetClock()
+	return base{
+		id:          ID,
+		clock:       clock,
+		createdTime: clock.Now(),
+		thingType:   thingType,
+		cadence:     cadence,
+		stopC:       make(chan struct{}, 1),
+		wakeC:       make(chan struct{}, 1),
+		state:       int32(StateCreated),
+		mu:          &sync.Mutex{},
+		rng:         newRng(ID, streamValues),
+		timing:      newRng(ID, streamTiming),
+		alarms:      make(map[AlarmCode]Alarm),
+		faults:      make(map[AlarmCode]bool),
+		exception:   Exception{Deadbands: make(map[string]float64), Integrity: defaultIntegrity},
+	}
+}
+
+// run emit loop shared by all things. sample is called with the lock held.
+// c = channel writer for all events
+// wg = waitgroup needs to know when we are done with channel
+func (b *base) run(c chan<- ThingEvent, wg *sync.WaitGroup, sample func(now time.Time) interface{}) {
+
+	defer wg.Done() // tell the listener we are done
+	wg.Add(1)
+
+	if c == nil {
+		log.Error(errChannelIsNil)
+		return
+	}
+
+	// the clock waits for this loop whenever it is busy
+	b.clock.Join()
+	defer b.clock.Leave()
+
+	b.mu.Lock()
+	b.setState(b.activeState())
+	b.mu.Unlock()
+	b.flush(c)
+
+	timer := b.clock.NewTimer(b.nextDelay())
+EMIT:
+	// Begin start lifecycle of thing
+	for {
+		select {
+
+		// simulate non-deterministic timing
+		case now := <-timer.C():
+
+			b.mu.Lock()
+			data := sample(now)
+			b.sampled(data)
+			if b.report(data, now) {
+				b.queue(KindTelemetry, data)
+			}
+			b.mu.Unlock()
+			b.flush(c)
+
+		// paused, resumed or a new cadence, send any transition now and
+		// schedule the next event again below
+		case <-b.wakeC:
+			timer.Stop()
+			b.flush(c)
+			if b.lifecycle() == StatePaused && !b.paused(c) {
+				break EMIT
+			}
+
+		case <-b.stopC:
+			timer.Stop()
+			break EMIT
+		}
+
+		// reset another random time, each time through loop
+		timer = b.clock.NewTimer(b.nextDelay())
+	}
+
+	b.mu.Lock()
+	b.setState(StateStopped)
+	b.mu.Unlock()
+	b.flush(c)
+	log.Debugf("exiting %s: %d", b.thingType, b.id)
+}
+
+// paused silent until resumed, the clock no longer waits for the thing.
+// Returns false when stopped instead.
+func (b *base) paused(c chan<- ThingEvent) bool {
+
+	b.clock.Leave()
+	defer b.clock.Join()
+
+	for {
+		select {
+		case <-b.wakeC:
+			b.flush(c)
+			if b.lifecycle() != StatePaused {
+				return true
+			}
+		case <-b.stopC:
+			return false
+		}
+	}
+}
+
+// flush send the queued events
+func (b *base) flush(c chan<- ThingEvent) {
+
+	b.mu.Lock()
+	events := b.pending
+	b.pending = nil
+	b.mu.Unlock()
+
+	for _, thingEvent := range events {
+		thingEvent.ThingSeq = atomic.AddUint64(&b.evtCount, 1)
+		c <- thingEvent
+	}
+}
+
+// queue an event to go out with the next telemetry, call with the lock held
+func (b *base) queue(kind EventKind, data interface{}) {
+	b.pending = append(b.pending, ThingEvent{
+		ThingID:   b.id,
+		TS:        b.clock.Now(),
+		ThingType: b.thingType,
+		Kind:      kind,
+		EventData: data,
+	})
+}
+
+// nextDelay delay until the next event, drawn from the cadence
+func (b *base) nextDelay() time.Duration {
+	b.mu.Lock()
+	cadence := b.cadence
+	b.mu.Unlock()
+	return cadence.next(b.timing)
+}
+
+// ShortD used to give brief data reprentation of this thing. implemnted from things.Thing
+func (b *base) ShortD() CID {
+	return CID{CidNumber: b.id, Type: b.thingType, CreateTime: b.createdTime, TTLEvents: atomic.LoadUint64(&b.evtCount),
+		Alarms: int(atomic.LoadInt32(&b.alarmCount)), State: b.lifecycle()}
+}
+
+// Stop start shutdown sequence. Does not wait for the emit loop, which may be
+// busy sampling, the waitgroup tells when it is done.
+func (b *base) Stop() {
+	select {
+	case b.stopC <- ZeroStruct:
+	default: // already stopping
+	}
+}
@@ -2,29 +2,44 @@ package things
 
 import (
 	"errors"
-	"reflect"
+	"math"
 	"sync"
-	"sync/atomic"
 	"time"
-
-	log "github.com/sirupsen/logrus"
 )
 
-// some general sane ranges. not of great value, more than a placeholder
-// erratic jumps with Random generator are absurd or maybe comical? but not the point of this challenge
+// the default pack, 71S46P of 5Ah NMC cells, with the limits its readings
+// are held to, the random walk of its load current, and the thermal model
+// and alarm thresholds of its cells
 const (
-	battRandomDelayMin int     = 1       // least time delay 1ms
-	battRandomDelayMax int     = 1000    // most time delay 1s
-	minVolts           float64 = 227.00  // 71S * 3.2v
-	maxVolts           float64 = 300.00  // 71S * 4.2v
-	minTherm           float64 = -40.0   // celcius
-	maxTherm           float64 = 175.0   // celcius
-	minLiveAmps        float64 = -1000.0 // Amps
-	maxLiveAmps        float64 = 1000.0  // Amps
-	minCycleAh         float64 = 90.0    // Ah
-	maxCycleAh         float64 = 1000.0  // Ah
-	minTTLAh           float64 = 0       // kAh
-	maxTTLAh           float64 = 30000   // kAh
+	battRandomDelayMin time.Duration = 100 * time.Millisecond  // least time delay 100ms
+	battRandomDelayMax time.Duration = 1000 * time.Millisecond // most time delay 1s
+	minVolts           float64       = 227.00                  // 71S * 3.2v
+	maxVolts           float64       = 300.00                  // 71S * 4.2v
+	minTherm           float64       = -40.0                   // celcius
+	maxTherm           float64       = 175.0                   // celcius
+	minLiveAmps        float64       = -1000.0                 // Amps
+	maxLiveAmps        float64       = 1000.0                  // Amps
+
+	battSeries         int     = 71    // cells in series, see minVolts/maxVolts
+	battParallel       int     = 46    // cells in parallel per series element
+	battCellAh         float64 = 5.0   // rated capacity of one cell Ah
+	battCellResistance float64 = 0.032 // internal resistance of one cell ohms
+	battInitialSoC     float64 = 0.8   // state of charge of a new pack
+	battAmpStep        float64 = 25.0  // max change of load current per emit
+	battSoCDrift       float64 = 40.0  // pull of load current back toward mid SoC
+	battAmpReversion   float64 = 0.9   // share of the load current kept each emit, pulls toward rest
+	battCellVariance   float64 = 0.02  // manufacturing variance of cell capacity and resistance
+	battSoCVariance    float64 = 0.01  // variance of cell state of charge at creation
+	battBalanceVolts   float64 = 0.005 // cells this far above the lowest cell are bled
+	battBleedAmps      float64 = 0.5   // passive balancing bleed current
+	battAmbientTemp    float64 = 25.0  // ambient temperature celcius
+	battCoolingCoeff   float64 = 20.0  // heat rejected to ambient W per degree celcius
+	battHeatCapacity   float64 = 150e3 // thermal mass of the pack J per degree celcius
+	battCellGradient   float64 = 0.5   // fraction of the core rise seen by the coolest cell
+	battOverTempSet    float64 = 45.0  // celcius at the hottest thermistor
+	battOverTempClear  float64 = 40.0  // celcius
+	battOverVoltsSet   float64 = 4.25  // volts at the highest cell
+	battOverVoltsClear float64 = 4.20  // volts
 
 	errJSONDecoding = "decoding json: %s"
 )
@@ -33,113 +48,506 @@ var (
 	batteryTypeCount uint64 // package counter of things by type
 
 	// internal error objects
-	errChannelIsNil = errors.New("channel can not be nil")
+	errChannelIsNil     = errors.New("channel can not be nil")
+	errDrivenByInverter = errors.New("current is set by the attached inverter")
+
+	// ocvCurve open circuit voltage of a single cell, indexed by state of charge
+	// in steps of 10%. Loosely follows an NMC cell between 3.2v and 4.2v
+	ocvCurve = []float64{3.20, 3.55, 3.62, 3.68, 3.73, 3.78, 3.85, 3.93, 4.01, 4.10, 4.20}
 )
 
-// BatteryPack very simple for demo.
-// TODO should model a more accurate simulator
+// BatteryConfig electrical characteristics of a BatteryPack
+type BatteryConfig struct {
+	Series           int     // number of cells in series
+	Parallel         int     // number of cells in parallel per series element
+	CellCapacityAh   float64 // rated capacity of a single cell in Ah
+	CellResistance   float64 // internal resistance of a single cell in ohms, source of I*R sag
+	InitialSoC       float64 // state of charge at creation 0.0 - 1.0
+	CellVariance     float64 // +/- fraction of manufacturing variance in cell capacity and resistance
+	SoCVariance      float64 // +/- spread of cell state of charge at creation
+	BalanceThreshold float64 // volts above the lowest cell before a cell is bled
+	BleedAmps        float64 // current bled from a balancing cell
+
+	AmbientTemp  float64               // celcius, the pack starts at and cools toward ambient
+	CoolingCoeff float64               // heat rejected to ambient W per degree celcius above ambient
+	HeatCapacity float64               // thermal mass of the pack J per degree celcius
+	Thermistors  []ThermistorPlacement // where the thermistors sit in the pack
+
+	OverTemp    AlarmRule // on the hottest thermistor, celcius
+	OverVoltage AlarmRule // on the highest cell, volts
+}
+
+// ThermistorPlacement position of a thermistor within the pack. Gradient is the
+// fraction of the core temperature rise above ambient seen at that position,
+// 1.0 at the hottest point, less toward the coolant inlet or the pack walls.
+type ThermistorPlacement struct {
+	Position string
+	Gradient float64
+}
+
+// DefaultBatteryConfig the 71S pack used when no configuration is given
+func DefaultBatteryConfig() BatteryConfig {
+	return BatteryConfig{
+		Series:           battSeries,
+		Parallel:         battParallel,
+		CellCapacityAh:   battCellAh,
+		CellResistance:   battCellResistance,
+		InitialSoC:       battInitialSoC,
+		CellVariance:     battCellVariance,
+		SoCVariance:      battSoCVariance,
+		BalanceThreshold: battBalanceVolts,
+		BleedAmps:        battBleedAmps,
+		AmbientTemp:      battAmbientTemp,
+		CoolingCoeff:     battCoolingCoeff,
+		HeatCapacity:     battHeatCapacity,
+		Thermistors: []ThermistorPlacement{
+			{Position: "core", Gradient: 1.0},
+			{Position: "coolant_inlet", Gradient: 0.4},
+		},
+		OverTemp:    AlarmRule{Code: AlarmOverTemp, Severity: SeverityMajor, Set: battOverTempSet, Clear: battOverTempClear},
+		OverVoltage: AlarmRule{Code: AlarmOverVoltage, Severity: SeverityCritical, Set: battOverVoltsSet, Clear: battOverVoltsClear},
+	}
+}
+
+// Resistance internal resistance of the whole pack, before cell variance
+func (c BatteryConfig) Resistance() float64 {
+	return float64(c.Series) * c.CellResistance / float64(c.Parallel)
+}
+
+// CapacityAh rated capacity of the whole pack
+func (c BatteryConfig) CapacityAh() float64 {
+	return float64(c.Parallel) * c.CellCapacityAh
+}
+
+// BatteryPack stateful pack model. Current is integrated over the elapsed time
+// between emits (coulomb counting) into every cell, and pack voltage is the sum
+// of the cell open circuit voltages minus I*R sag. The I*R losses heat a lumped
+// thermal mass that cools toward ambient.
+// LiveAmps is positive while discharging and negative while charging.
 type BatteryPack struct {
-	TTLVoltage  float64       `json:"pack_voltage"` // Total Pack Voltage
-	AmpMeter    AmpMeter      `json:"amp_meter"`    // Keep all current flow information in/out of battery
-	Therms      []Thermistor  `json:"thermistors"`  // Thermistor array for Battery Pack
-	id          uint64        // non serializable id
-	createdTime time.Time     // time the object was created
-	stopC       chan struct{} // internal stopC interupt
-	evtCount    uint64        // number of events generated
-	// Cells []Cell
+	TTLVoltage float64            `json:"pack_voltage"`    // Total Pack Voltage
+	SoC        float64            `json:"state_of_charge"` // mean state of charge of the cells 0.0 - 1.0
+	AmpMeter   AmpMeter           `json:"amp_meter"`       // Keep all current flow information in/out of battery
+	Therms     []Thermistor       `json:"thermistors"`     // Thermistor array for Battery Pack
+	Cells      []Cell             `json:"cells"`           // one entry per series element
+	CellStats  CellStats          `json:"cell_stats"`      // spread of the cells
+	Setpoint   *float64           `json:"setpoint"`        // amps held by command, nil follows the load
+	config     BatteryConfig      // electrical characteristics
+	coreTemp   float64            // lumped temperature of the hottest point in the pack
+	lastUpdate time.Time          // time current was last integrated
+	sources    map[uint64]float64 // current drawn by each attached inverter, by CID
+
+	base // mu also guards the model, attached inverters update it concurrently
+}
+
+// Cell one series element of the pack. The parallel cells of an element share a
+// voltage, so they are modelled as a single cell of their combined capacity.
+type Cell struct {
+	Voltage    float64 `json:"voltage"`            // terminal voltage
+	Temp       float64 `json:"temperature"`        // celcius
+	CapacityAh float64 `json:"capacity_amp_hours"` // capacity after manufacturing variance
+	SoC        float64 `json:"state_of_charge"`    // 0.0 - 1.0
+	Balancing  bool    `json:"balancing"`          // bleed resistor switched in
+	resistance float64 // internal resistance after manufacturing variance
+}
+
+// CellStats summary of cell spread used by BMS dashboards
+type CellStats struct {
+	MinVolts  float64 `json:"min_cell_voltage"`
+	MaxVolts  float64 `json:"max_cell_voltage"`
+	MinCell   int     `json:"min_cell"`      // index of the lowest cell
+	MaxCell   int     `json:"max_cell"`      // index of the highest cell
+	Spread    float64 `json:"cell_spread"`   // max - min cell volts
+	Imbalance float64 `json:"imbalance"`     // max - min cell state of charge
+	Balancing int     `json:"balancing_qty"` // number of cells being bled
 }
 
 // AmpMeter represents battery pack coloumn counter
 type AmpMeter struct {
 	LiveAmps    float64 `json:"live_amps"`        // realtime or last (n) time buffer avg
-	CycleAmpHrs float64 `json:"cycle_amps_hours"` // existing duty cycle
-	TTLAmpHours float64 `json:"total_amp_hours"`  // battery odometer
+	CycleAmpHrs float64 `json:"cycle_amps_hours"` // Ah moved since current last changed direction
+	TTLAmpHours float64 `json:"total_amp_hours"`  // battery odometer, Ah moved in either direction
 }
 
 // Thermistor state for thermistor temp, and can be enhanced for hi/lo, notification etc
 type Thermistor struct {
-	Temp float64 `json:"temperature"`
+	Temp     float64 `json:"temperature"`
+	Position string  `json:"position"`
+	gradient float64 // fraction of the core rise seen at Position
 }
 
-// NewBatteryPack create a battery allocating configuration
+// NewBatteryPack create a battery with the DefaultBatteryConfig
 // ID = cid  code challenge id. Increment ID created by supervisor unique to all things
 func NewBatteryPack(ID uint64) BatteryPack {
+	return NewBatteryPackConfig(ID, DefaultBatteryConfig())
+}
 
-	// generate random data init
-	battery := BatteryPack{id: ID, createdTime: time.Now(), Therms: make([]Thermistor, 2), stopC: make(chan struct{})}
-	battery.generateRandomData()
+// NewBatteryPackConfig create a battery allocating configuration
+// ID = cid  code challenge id. Increment ID created by supervisor unique to all things
+// cfg = electrical characteristics of the pack
+func NewBatteryPackConfig(ID uint64, cfg BatteryConfig) BatteryPack {
+
+	battery := BatteryPack{
+		base:     newBase(ID, "BatteryPack", UniformCadence(battRandomDelayMin, battRandomDelayMax)),
+		config:   cfg,
+		Therms:   make([]Thermistor, len(cfg.Thermistors)),
+		Cells:    make([]Cell, cfg.Series),
+		coreTemp: cfg.AmbientTemp,
+		sources:  make(map[uint64]float64),
+	}
+	battery.lastUpdate = battery.createdTime
+
+	// every cell comes off the line a little different
+	for i := range battery.Cells {
+		variance := 1 + battery.rng.RFloat(-cfg.CellVariance, cfg.CellVariance)
+		battery.Cells[i] = Cell{
+			CapacityAh: round(cfg.CapacityAh() * variance),
+			resistance: cfg.CellResistance / float64(cfg.Parallel) / variance,
+			SoC:        clamp(cfg.InitialSoC+battery.rng.RFloat(-cfg.SoCVariance, cfg.SoCVariance), 0, 1),
+		}
+	}
+	for i, p := range cfg.Thermistors {
+		battery.Therms[i] = Thermistor{Position: p.Position, gradient: p.Gradient}
+	}
+	battery.updateVoltage()
+	battery.balance()
+	battery.updateTemps()
 	return battery
 }
 
 // Emit implements thing interface to send events over Channel
 // c = channel writer for all events
 // wg = waitgroup needs to know when we are done with channel
-// TODO far too redundant with other Things. Refactor/Reuse
-// Note: Not concurrent safe if multiple Supervisors would ever be required!
 func (b *BatteryPack) Emit(c chan<- ThingEvent, wg *sync.WaitGroup) {
+	b.run(c, wg, b.sample)
+}
+
+// sample advance the model to now, check its alarms and copy it for the event
+func (b *BatteryPack) sample(now time.Time) interface{} {
+	b.update(now)
+	b.checkAlarms(now)
+	return b.snapshot()
+}
+
+// checkAlarms raise or clear the alarms of the pack on its present readings
+func (b *BatteryPack) checkAlarms(now time.Time) {
+	hottest := math.Inf(-1)
+	for _, t := range b.Therms {
+		hottest = math.Max(hottest, t.Temp)
+	}
+	if len(b.Therms) > 0 {
+		b.checkAlarm(b.config.OverTemp, hottest, now)
+	}
+	if len(b.Cells) > 0 {
+		b.checkAlarm(b.config.OverVoltage, b.CellStats.MaxVolts, now)
+	}
+}
+
+// Control implements Controllable
+// setpoint = amps, positive discharges and negative charges the pack, or auto
+// to follow the load again. Rejected while an inverter drives the pack.
+func (b *BatteryPack) Control(cmd Command) Ack {
+	return b.control(cmd, b.apply)
+}
+
+// apply a command with the lock held
+func (b *BatteryPack) apply(cmd Command) error {
+	switch cmd.Name {
+	case "setpoint":
+		if cmd.Value == cmdAuto {
+			b.Setpoint = nil
+			return nil
+		}
+		if len(b.sources) > 0 {
+			return errDrivenByInverter
+		}
+		v, err := parseRange(cmd.Value, minLiveAmps, maxLiveAmps)
+		if err != nil {
+			return err
+		}
+		b.Setpoint = &v
+	default:
+		return errUnknownCommand
+	}
+	return nil
+}
+
+// batteryState model of a BatteryPack in a ThingState
+type batteryState struct {
+	Pack        *BatteryPack  `json:"pack"`
+	Config      BatteryConfig `json:"config"`
+	CoreTemp    float64       `json:"core_temp"`
+	LastUpdate  time.Time     `json:"last_update"`
+	Resistances []float64     `json:"cell_resistances"` // after manufacturing variance
+}
+
+// Snapshot implements Snapshotter
+func (b *BatteryPack) Snapshot() (ThingState, error) {
+	defer b.mu.Unlock()
+	b.mu.Lock()
+
+	s := batteryState{Pack: b, Config: b.config, CoreTemp: b.coreTemp, LastUpdate: b.lastUpdate}
+	for _, cell := range b.Cells {
+		s.Resistances = append(s.Resistances, cell.resistance)
+	}
+	return b.saveState(s)
+}
+
+// Restore implements Snapshotter, attached inverters draw again once they
+// are attached again
+func (b *BatteryPack) Restore(state ThingState) error {
+	defer b.mu.Unlock()
+	b.mu.Lock()
+
+	s := batteryState{Pack: b}
+	shift, err := b.restoreState(state, &s)
+	if err != nil {
+		return err
+	}
+	if len(s.Resistances) != len(b.Cells) || len(s.Config.Thermistors) != len(b.Therms) {
+		return errStateModel
+	}
+	b.config = s.Config
+	b.coreTemp = s.CoreTemp
+	b.lastUpdate = s.LastUpdate.Add(shift)
+	for i := range b.Cells {
+		b.Cells[i].resistance = s.Resistances[i]
+	}
+	for i := range b.Therms {
+		b.Therms[i].gradient = s.Config.Thermistors[i].Gradient
+	}
+	return nil
+}
+
+// Voltage pack terminal voltage
+func (b *BatteryPack) Voltage() float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.TTLVoltage
+}
+
+// draw set the current a source (an attached inverter) draws from the pack,
+// positive discharges. The pack is integrated up to now at the old current
+// first. Returns the current the pack accepted, zero once a cell limit is hit.
+func (b *BatteryPack) draw(source uint64, amps float64, now time.Time) float64 {
 
-	defer wg.Done() // tell the listener we are done
-	wg.Add(1)
-	randomTime := RInt(battRandomDelayMin, battRandomDelayMax)
-	delay := time.Duration(randomTime) * time.Millisecond
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.integrate(now)
+	if !b.accepts(amps) {
+		amps = 0
+	}
+	b.sources[source] = amps
+
+	var total float64
+	for _, a := range b.sources {
+		total += a
+	}
+	b.setAmps(total)
+	b.updateVoltage()
+	return amps
+}
+
+// release the source no longer draws from the pack
+func (b *BatteryPack) release(source uint64) {
+	b.draw(source, 0, b.clock.Now())
+	b.mu.Lock()
+	delete(b.sources, source)
+	b.mu.Unlock()
+}
+
+// snapshot copy of the pack safe to hand to the listener
+func (b *BatteryPack) snapshot() BatteryPack {
+	// counters keep full precision, small intervals would round away
+	c := *b
+	if b.Setpoint != nil {
+		setpoint := *b.Setpoint
+		c.Setpoint = &setpoint
+	}
+	c.AmpMeter.CycleAmpHrs = round(b.AmpMeter.CycleAmpHrs)
+	c.AmpMeter.TTLAmpHours = round(b.AmpMeter.TTLAmpHours)
+	c.Cells = append([]Cell(nil), b.Cells...)
+	for i := range c.Cells {
+		c.Cells[i].SoC = round(c.Cells[i].SoC)
+	}
+	c.Therms = append([]Thermistor(nil), b.Therms...)
+	return c
+}
 
-	if c == nil {
-		log.Error(errChannelIsNil)
+// update advance the pack model to now. The current of the last interval is
+// integrated first, then the load picks a new current for the next interval.
+// Packs with an attached inverter take their current from the inverter instead.
+func (b *BatteryPack) update(now time.Time) {
+	b.integrate(now)
+	switch {
+	case len(b.sources) > 0: // the inverters set the current
+	case b.Setpoint != nil:
+		amps := *b.Setpoint
+		if !b.accepts(amps) {
+			amps = 0
+		}
+		b.setAmps(amps)
+	default:
+		b.stepLoad()
+	}
+	b.updateVoltage()
+	b.balance()
+	b.updateTemps()
+}
+
+// integrate coulomb count LiveAmps over the time elapsed since the last update.
+// The pack current flows through every cell, balancing cells also lose their
+// bleed current.
+func (b *BatteryPack) integrate(now time.Time) {
+
+	hours := now.Sub(b.lastUpdate).Hours()
+	b.lastUpdate = now
+	if hours <= 0 {
 		return
 	}
 
-	thingType := reflect.TypeOf(*b)
-EMIT:
-	// Begin start lifecycle of thing
-	for {
-		select {
-		case <-time.After(delay):
-
-			// generate random data
-			// lock here down if multiple supervisors required
-			b.generateRandomData()
-
-			// create new event
-			thingEvent := ThingEvent{
-				ThingID:   b.id,
-				TS:        time.Now(),
-				ThingType: thingType.Name(),
-				EventData: *b,
-			}
-			c <- thingEvent
-			atomic.AddUint64(&b.evtCount, 1)
-		case <-b.stopC:
-			break EMIT
+	ah := b.AmpMeter.LiveAmps * hours
+	for i := range b.Cells {
+		cell := &b.Cells[i]
+		cellAh := ah
+		if cell.Balancing {
+			cellAh += b.config.BleedAmps * hours
 		}
+		cell.SoC = clamp(cell.SoC-cellAh/cell.CapacityAh, 0, 1)
+	}
+	b.AmpMeter.CycleAmpHrs += math.Abs(ah)
+	b.AmpMeter.TTLAmpHours += math.Abs(ah)
+	b.heat(hours * 3600)
+}
 
-		// reset another random time, each time through loop
-		randomTime := RInt(battRandomDelayMin, battRandomDelayMax)
-		delay = time.Duration(randomTime) * time.Millisecond
+// heat lumped thermal model over seconds. I*R losses heat the pack, cooling
+// rejects heat in proportion to the rise over ambient. Solved exactly for a
+// constant current so long gaps between emits stay stable.
+func (b *BatteryPack) heat(seconds float64) {
+
+	if b.config.CoolingCoeff <= 0 || b.config.HeatCapacity <= 0 {
+		return
 	}
-	log.Debugf("exiting battery pack: %d", b.id)
+
+	watts := b.AmpMeter.LiveAmps * b.AmpMeter.LiveAmps * b.config.Resistance()
+	steady := b.config.AmbientTemp + watts/b.config.CoolingCoeff
+	decay := math.Exp(-b.config.CoolingCoeff * seconds / b.config.HeatCapacity)
+	b.coreTemp = steady + (b.coreTemp-steady)*decay
 }
 
-// ShortD used to give brief data reprentation of this thing. implemnted from things.Thing
-func (b BatteryPack) ShortD() CID {
-	return CID{CidNumber: b.id, Type: reflect.TypeOf(b).Name(), CreateTime: b.createdTime, TTLEvents: atomic.LoadUint64(&b.evtCount)}
+// stepLoad random walk of the load current. The walk drifts toward discharge
+// when full and toward charge when empty, so packs cycle instead of pinning,
+// and decays toward rest so the pack can shed its I*R heat.
+func (b *BatteryPack) stepLoad() {
+
+	drift := (b.SoC - 0.5) * battSoCDrift
+	amps := clamp(b.AmpMeter.LiveAmps*battAmpReversion+drift+b.rng.RFloat(-battAmpStep, battAmpStep), minLiveAmps, maxLiveAmps)
+
+	if !b.accepts(amps) {
+		amps = 0
+	}
+	b.setAmps(amps)
 }
 
-// Stop start shutdown sequence
-func (b BatteryPack) Stop() {
-	b.stopC <- ZeroStruct
+// accepts a full cell stops the charge and an empty cell stops the discharge
+func (b *BatteryPack) accepts(amps float64) bool {
+	for _, cell := range b.Cells {
+		if (cell.SoC >= 1 && amps < 0) || (cell.SoC <= 0 && amps > 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// setAmps change the live current, a change of direction starts a new cycle
+func (b *BatteryPack) setAmps(amps float64) {
+	if (amps > 0) != (b.AmpMeter.LiveAmps > 0) {
+		b.AmpMeter.CycleAmpHrs = 0
+	}
+	b.AmpMeter.LiveAmps = round(amps)
+}
+
+// updateVoltage cell voltage is the open circuit voltage less the I*R sag,
+// the pack is the sum of its cells. Refreshes SoC and CellStats.
+func (b *BatteryPack) updateVoltage() {
+
+	if len(b.Cells) == 0 {
+		return
+	}
+
+	var volts, soc float64
+	minSoC, maxSoC := math.Inf(1), math.Inf(-1)
+	stats := CellStats{MinVolts: math.Inf(1), MaxVolts: math.Inf(-1)}
+	for i := range b.Cells {
+		cell := &b.Cells[i]
+		cell.Voltage = round(cellOCV(cell.SoC) - b.AmpMeter.LiveAmps*cell.resistance)
+		volts += cell.Voltage
+		soc += cell.SoC
+
+		if cell.Voltage < stats.MinVolts {
+			stats.MinVolts, stats.MinCell = cell.Voltage, i
+		}
+		if cell.Voltage > stats.MaxVolts {
+			stats.MaxVolts, stats.MaxCell = cell.Voltage, i
+		}
+		minSoC = math.Min(minSoC, cell.SoC)
+		maxSoC = math.Max(maxSoC, cell.SoC)
+	}
+	stats.Spread = round(stats.MaxVolts - stats.MinVolts)
+	stats.Imbalance = round(maxSoC - minSoC)
+
+	b.TTLVoltage = round(volts)
+	b.SoC = round(soc / float64(len(b.Cells)))
+	b.CellStats = stats
+}
+
+// balance passive balancing, bleed every cell whose open circuit voltage sits
+// more than the balance threshold above the lowest cell. Open circuit voltage
+// keeps the I*R spread of the cell resistances out of the decision.
+func (b *BatteryPack) balance() {
+
+	minOCV := math.Inf(1)
+	for _, cell := range b.Cells {
+		minOCV = math.Min(minOCV, cellOCV(cell.SoC))
+	}
+
+	b.CellStats.Balancing = 0
+	for i := range b.Cells {
+		b.Cells[i].Balancing = cellOCV(b.Cells[i].SoC)-minOCV > b.config.BalanceThreshold
+		if b.Cells[i].Balancing {
+			b.CellStats.Balancing++
+		}
+	}
 }
 
-// generateRandomData just create erratic random data
-// TODO model behaivor more realistic
-func (b *BatteryPack) generateRandomData() {
+// updateTemps spread the core temperature over the thermistors and cells.
+// Cells sit on a gradient from the coolest position to the core.
+func (b *BatteryPack) updateTemps() {
 
-	// TODO improve on random data to modeled behaivoral generated data.
-	// b.AmpMeter.TtlAmpHours = rand
-	b.TTLVoltage = RFloat(minVolts, maxVolts)
-	b.AmpMeter.LiveAmps = RFloat(minLiveAmps, maxLiveAmps)
-	b.AmpMeter.CycleAmpHrs = RFloat(minCycleAh, maxCycleAh)
-	b.AmpMeter.TTLAmpHours = RFloat(minTTLAh, maxTTLAh)
-	b.Therms[0].Temp = RFloat(minTherm, maxTherm)
-	b.Therms[1].Temp = RFloat(minTherm, maxTherm)
+	rise := b.coreTemp - b.config.AmbientTemp
+	for i := range b.Therms {
+		// thermistors saturate at the ends of their range
+		b.Therms[i].Temp = round(clamp(b.config.AmbientTemp+rise*b.Therms[i].gradient, minTherm, maxTherm))
+	}
 
+	n := len(b.Cells)
+	for i := range b.Cells {
+		gradient := 1.0
+		if n > 1 {
+			gradient = battCellGradient + (1-battCellGradient)*float64(i)/float64(n-1)
+		}
+		b.Cells[i].Temp = round(b.config.AmbientTemp + rise*gradient)
+	}
+}
+
+// cellOCV open circuit voltage of one cell at soc, interpolated from ocvCurve
+func cellOCV(soc float64) float64 {
+	soc = clamp(soc, 0, 1)
+	pos := soc * float64(len(ocvCurve)-1)
+	i := int(pos)
+	if i >= len(ocvCurve)-1 {
+		return ocvCurve[len(ocvCurve)-1]
+	}
+	return ocvCurve[i] + (ocvCurve[i+1]-ocvCurve[i])*(pos-float64(i))
 }
@@ -2,7 +2,9 @@ package things
 
 import (
 	"encoding/json"
+	"math"
 	"testing"
+	"time"
 )
 
 // TestBatteryJSON verify JSON format, and even more important,
@@ -10,15 +12,18 @@ import (
 func TestBatteryJSON(t *testing.T) {
 
 	errJSONnomatch := "json test data does not match expected: %s"
-	jsonTestData := `{"pack_voltage":272.683,"amp_meter":{"live_amps":-268.982,"cycle_amps_hours":856.753,"total_amp_hours":3773.437},"thermistors":[{"temperature":63.143},{"temperature":110.421}]}`
+	jsonTestData := `{"pack_voltage":272.683,"state_of_charge":0.5,"amp_meter":{"live_amps":-268.982,"cycle_amps_hours":856.753,"total_amp_hours":3773.437},"thermistors":[{"temperature":63.143,"position":"core"},{"temperature":110.421,"position":"coolant_inlet"}],"cells":[{"voltage":3.841,"temperature":25,"capacity_amp_hours":230.5,"state_of_charge":0.5,"balancing":false}],"cell_stats":{"min_cell_voltage":3.841,"max_cell_voltage":3.841,"min_cell":0,"max_cell":0,"cell_spread":0,"imbalance":0,"balancing_qty":0},"setpoint":null}`
 
 	battery := NewBatteryPack(1000)
 	battery.TTLVoltage = 272.683
+	battery.SoC = 0.5
 	battery.AmpMeter.LiveAmps = -268.982
 	battery.AmpMeter.CycleAmpHrs = 856.753
 	battery.AmpMeter.TTLAmpHours = 3773.437
 	battery.Therms[0].Temp = 63.143
 	battery.Therms[1].Temp = 110.421
+	battery.Cells = []Cell{{Voltage: 3.841, Temp: 25, CapacityAh: 230.5, SoC: 0.5}}
+	battery.CellStats = CellStats{MinVolts: 3.841, MaxVolts: 3.841}
 
 	jsonData, err := json.Marshal(battery)
 	if err != nil {
@@ -29,3 +34,128 @@ func TestBatteryJSON(t *testing.T) {
 		t.Error(errJSONnomatch, string(jsonData))
 	}
 }
+
+// TestBatteryCoulombCounting discharge half the capacity over one hour and
+// check the amp hour counters, state of charge and voltage sag follow.
+func TestBatteryCoulombCounting(t *testing.T) {
+
+	cfg := DefaultBatteryConfig()
+	cfg.InitialSoC = 1.0
+	cfg.CellVariance = 0
+	cfg.SoCVariance = 0
+	battery := NewBatteryPackConfig(1, cfg)
+
+	amps := cfg.CapacityAh() / 2
+	battery.setAmps(amps)
+	battery.integrate(battery.lastUpdate.Add(time.Hour))
+	battery.updateVoltage()
+
+	if math.Abs(battery.SoC-0.5) > 0.0001 {
+		t.Errorf("state of charge expected 0.5: %f", battery.SoC)
+	}
+	if math.Abs(battery.AmpMeter.TTLAmpHours-amps) > 0.001 {
+		t.Errorf("total amp hours expected %f: %f", amps, battery.AmpMeter.TTLAmpHours)
+	}
+	if math.Abs(battery.AmpMeter.CycleAmpHrs-amps) > 0.001 {
+		t.Errorf("cycle amp hours expected %f: %f", amps, battery.AmpMeter.CycleAmpHrs)
+	}
+
+	expected := float64(cfg.Series) * (cellOCV(0.5) - amps*cfg.CellResistance/float64(cfg.Parallel))
+	if math.Abs(battery.TTLVoltage-expected) > 0.01 {
+		t.Errorf("pack voltage expected %f: %f", expected, battery.TTLVoltage)
+	}
+
+	// reversing the current starts a new cycle, the odometer keeps counting
+	battery.setAmps(-amps)
+	battery.integrate(battery.lastUpdate.Add(time.Hour))
+	battery.updateVoltage()
+	if math.Abs(battery.SoC-1.0) > 0.0001 {
+		t.Errorf("state of charge expected 1.0: %f", battery.SoC)
+	}
+	if math.Abs(battery.AmpMeter.CycleAmpHrs-amps) > 0.001 {
+		t.Errorf("cycle amp hours expected %f: %f", amps, battery.AmpMeter.CycleAmpHrs)
+	}
+	if math.Abs(battery.AmpMeter.TTLAmpHours-2*amps) > 0.001 {
+		t.Errorf("total amp hours expected %f: %f", 2*amps, battery.AmpMeter.TTLAmpHours)
+	}
+}
+
+// TestBatteryBalancing a single high cell is bled down while the others rest
+func TestBatteryBalancing(t *testing.T) {
+
+	cfg := DefaultBatteryConfig()
+	cfg.InitialSoC = 0.5
+	cfg.CellVariance = 0
+	cfg.SoCVariance = 0
+	battery := NewBatteryPackConfig(1, cfg)
+
+	battery.Cells[3].SoC = 0.6
+	battery.updateVoltage()
+	battery.balance()
+
+	if battery.CellStats.MaxCell != 3 || battery.CellStats.Balancing != 1 || !battery.Cells[3].Balancing {
+		t.Fatalf("expected only cell 3 to balance: %+v", battery.CellStats)
+	}
+
+	battery.integrate(battery.lastUpdate.Add(time.Hour))
+	if battery.Cells[3].SoC >= 0.6 {
+		t.Errorf("balancing cell was not bled: %f", battery.Cells[3].SoC)
+	}
+	if battery.Cells[0].SoC != 0.5 {
+		t.Errorf("resting cell changed: %f", battery.Cells[0].SoC)
+	}
+}
+
+// TestBatteryThermal a constant current settles at ambient plus I*I*R over the
+// cooling coefficient at the core, cooler toward the coolant inlet.
+func TestBatteryThermal(t *testing.T) {
+
+	cfg := DefaultBatteryConfig()
+	cfg.InitialSoC = 0.5
+	cfg.CellVariance = 0
+	cfg.SoCVariance = 0
+	battery := NewBatteryPackConfig(1, cfg)
+
+	amps := 100.0
+	battery.setAmps(amps)
+	battery.heat(100 * cfg.HeatCapacity / cfg.CoolingCoeff) // many time constants
+	battery.updateTemps()
+
+	expected := cfg.AmbientTemp + amps*amps*cfg.Resistance()/cfg.CoolingCoeff
+	if math.Abs(battery.Therms[0].Temp-expected) > 0.01 {
+		t.Errorf("core temperature expected %f: %f", expected, battery.Therms[0].Temp)
+	}
+	if battery.Therms[1].Temp >= battery.Therms[0].Temp || battery.Therms[1].Temp <= cfg.AmbientTemp {
+		t.Errorf("inlet temperature should sit between ambient and core: %f", battery.Therms[1].Temp)
+	}
+
+	// no current, the pack cools back to ambient
+	battery.setAmps(0)
+	battery.heat(100 * cfg.HeatCapacity / cfg.CoolingCoeff)
+	battery.updateTemps()
+	if math.Abs(battery.Therms[0].Temp-cfg.AmbientTemp) > 0.01 {
+		t.Errorf("core temperature expected ambient %f: %f", cfg.AmbientTemp, battery.Therms[0].Temp)
+	}
+}
+
+// TestBatterySubResolution at a 100ms cadence every increment of the amp hour
+// counters is far below the rounding of the event, they must still add up.
+func TestBatterySubResolution(t *testing.T) {
+
+	battery := NewBatteryPack(1)
+	battery.setAmps(2)
+	now := battery.lastUpdate
+	for i := 0; i < 36000; i++ { // an hour of 100ms steps
+		now = now.Add(100 * time.Millisecond)
+		battery.integrate(now)
+	}
+	if math.Abs(battery.AmpMeter.TTLAmpHours-2) > 0.001 {
+		t.Errorf("total amp hours expected 2: %f", battery.AmpMeter.TTLAmpHours)
+	}
+	if math.Abs(battery.AmpMeter.CycleAmpHrs-2) > 0.001 {
+		t.Errorf("cycle amp hours expected 2: %f", battery.AmpMeter.CycleAmpHrs)
+	}
+	if event := battery.snapshot(); event.AmpMeter.TTLAmpHours != 2 {
+		t.Errorf("event total amp hours expected 2: %f", event.AmpMeter.TTLAmpHours)
+	}
+}
@@ -0,0 +1,200 @@
+package things
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CadenceMode how the time between two events of a thing is picked
+type CadenceMode uint8
+
+// cadence modes
+const (
+	CadenceFixed   CadenceMode = iota + 1 // every Period
+	CadenceJitter                         // Period +/- Jitter fraction of it
+	CadenceUniform                        // anywhere from Period to Max
+	CadencePoisson                        // random arrivals, Period apart on average
+)
+
+var errCadence = errors.New("cadence must be fixed:<d>, jitter:<d>:<pct>%, uniform:<min>-<max> or poisson:<mean>")
+
+// Cadence time between the events of a thing
+type Cadence struct {
+	Mode   CadenceMode
+	Period time.Duration // period, least delay of uniform or mean of poisson
+	Max    time.Duration // most delay of uniform
+	Jitter float64       // +/- fraction of the period 0.0 - 1.0
+}
+
+// FixedCadence an event every period
+func FixedCadence(period time.Duration) Cadence {
+	return Cadence{Mode: CadenceFixed, Period: period}
+}
+
+// JitterCadence an event every period +/- jitter, a fraction of the period
+func JitterCadence(period time.Duration, jitter float64) Cadence {
+	return Cadence{Mode: CadenceJitter, Period: period, Jitter: jitter}
+}
+
+// UniformCadence an event after a delay anywhere from min to max
+func UniformCadence(min, max time.Duration) Cadence {
+	return Cadence{Mode: CadenceUniform, Period: min, Max: max}
+}
+
+// PoissonCadence events as independent random arrivals, mean apart on average
+func PoissonCadence(mean time.Duration) Cadence {
+	return Cadence{Mode: CadencePoisson, Period: mean}
+}
+
+// ParseCadence cadence from its String form. A bare duration is fixed and a
+// bare range is uniform.
+// fixed:1s, jitter:1s:10%, uniform:200ms-2s, poisson:1s, 1s, 200ms-2s
+func ParseCadence(spec string) (Cadence, error) {
+
+	spec = strings.ToLower(strings.TrimSpace(spec))
+	mode, arg := "", spec
+	if i := strings.Index(spec, ":"); i >= 0 {
+		mode, arg = spec[:i], spec[i+1:]
+	} else if strings.Contains(spec, "-") {
+		mode = "uniform"
+	}
+
+	var c Cadence
+	var err error
+	switch mode {
+	case "", "fixed":
+		c.Mode = CadenceFixed
+		c.Period, err = time.ParseDuration(arg)
+	case "jitter":
+		c.Mode = CadenceJitter
+		parts := strings.Split(arg, ":")
+		if len(parts) != 2 {
+			return c, errCadence
+		}
+		if c.Period, err = time.ParseDuration(parts[0]); err != nil {
+			return c, err
+		}
+		pct, err := strconv.ParseFloat(strings.TrimSuffix(parts[1], "%"), 64)
+		if err != nil {
+			return c, errCadence
+		}
+		c.Jitter = pct / 100
+	case "uniform":
+		c.Mode = CadenceUniform
+		parts := strings.Split(arg, "-")
+		if len(parts) != 2 {
+			return c, errCadence
+		}
+		if c.Period, err = time.ParseDuration(parts[0]); err != nil {
+			return c, err
+		}
+		c.Max, err = time.ParseDuration(parts[1])
+	case "poisson":
+		c.Mode = CadencePoisson
+		c.Period, err = time.ParseDuration(arg)
+	default:
+		return c, errCadence
+	}
+	if err != nil {
+		return c, err
+	}
+	return c, c.Validate()
+}
+
+// Validate the cadence can pace a thing
+func (c Cadence) Validate() error {
+	switch {
+	case c.Mode < CadenceFixed || c.Mode > CadencePoisson:
+		return errCadence
+	case c.Period < time.Millisecond:
+		return fmt.Errorf("cadence %s: period must be at least 1ms", c)
+	case c.Mode == CadenceJitter && (c.Jitter < 0 || c.Jitter > 1):
+		return fmt.Errorf("cadence %s: jitter must be 0%% to 100%%", c)
+	case c.Mode == CadenceUniform && c.Max < c.Period:
+		return fmt.Errorf("cadence %s: max must not be less than min", c)
+	}
+	return nil
+}
+
+// String spec of the cadence, see ParseCadence
+func (c Cadence) String() string {
+	switch c.Mode {
+	case CadenceFixed:
+		return "fixed:" + c.Period.String()
+	case CadenceJitter:
+		return fmt.Sprintf("jitter:%s:%g%%", c.Period, c.Jitter*100)
+	case CadenceUniform:
+		return fmt.Sprintf("uniform:%s-%s", c.Period, c.Max)
+	case CadencePoisson:
+		return "poisson:" + c.Period.String()
+	}
+	return "unknown"
+}
+
+// MarshalText cadence is written as its spec
+func (c Cadence) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+// UnmarshalText cadence is read from its spec
+func (c *Cadence) UnmarshalText(text []byte) error {
+	parsed, err := ParseCadence(string(text))
+	if err != nil {
+		return err
+	}
+	*c = parsed
+	return nil
+}
+
+// Mean average time between events
+func (c Cadence) Mean() time.Duration {
+	if c.Mode == CadenceUniform {
+		return (c.Period + c.Max) / 2
+	}
+	return c.Period
+}
+
+// next delay until the next event, drawn from r
+func (c Cadence) next(r rng) time.Duration {
+	switch c.Mode {
+	case CadenceJitter:
+		return c.Period + time.Duration(r.RFloat(-c.Jitter, c.Jitter)*float64(c.Period))
+	case CadenceUniform:
+		if c.Max <= c.Period {
+			return c.Period
+		}
+		return c.Period + time.Duration(r.Int63n(int64(c.Max-c.Period)))
+	case CadencePoisson:
+		return r.expDuration(c.Period)
+	}
+	return c.Period
+}
+
+// Cadenced implemented by things whose cadence can change while they run
+type Cadenced interface {
+	Cadence() Cadence
+	SetCadence(Cadence) error
+}
+
+// Cadence implements Cadenced
+func (b *base) Cadence() Cadence {
+	defer b.mu.Unlock()
+	b.mu.Lock()
+	return b.cadence
+}
+
+// SetCadence implements Cadenced. The event already scheduled is scheduled
+// again with it, the old cadence may have it far off.
+func (b *base) SetCadence(c Cadence) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	b.cadence = c
+	b.mu.Unlock()
+	b.wake()
+	return nil
+}
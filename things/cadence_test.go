@@ -0,0 +1,127 @@
+package things
+
+import (
+	"math"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestParseCadence every mode parses back from its String form, and bad
+// specs are rejected
+func TestParseCadence(t *testing.T) {
+
+	specs := map[string]Cadence{
+		"fixed:1s":           FixedCadence(time.Second),
+		"1s":                 FixedCadence(time.Second),
+		"jitter:500ms:10%":   JitterCadence(500*time.Millisecond, 0.1),
+		"uniform:200ms-2s":   UniformCadence(200*time.Millisecond, 2*time.Second),
+		"200ms-2s":           UniformCadence(200*time.Millisecond, 2*time.Second),
+		"Poisson:1m":         PoissonCadence(time.Minute),
+		" fixed:250ms ":      FixedCadence(250 * time.Millisecond),
+		"jitter:1s:0%":       JitterCadence(time.Second, 0),
+		"uniform:1s-1s":      UniformCadence(time.Second, time.Second),
+		"jitter:2h30m:12.5%": JitterCadence(150*time.Minute, 0.125),
+	}
+	for spec, expected := range specs {
+		c, err := ParseCadence(spec)
+		if err != nil || c != expected {
+			t.Errorf("%q: expected %s: %s %v", spec, expected, c, err)
+			continue
+		}
+		if again, err := ParseCadence(c.String()); err != nil || again != c {
+			t.Errorf("%q: %s does not parse back: %v", spec, c, err)
+		}
+	}
+
+	for _, spec := range []string{"", "fast", "fixed:0s", "jitter:1s", "jitter:1s:150%", "uniform:2s-1s", "poisson:", "burst:1s"} {
+		if _, err := ParseCadence(spec); err == nil {
+			t.Errorf("expected %q to be rejected", spec)
+		}
+	}
+}
+
+// TestCadenceDelays each mode draws delays in its range, poisson averages its mean
+func TestCadenceDelays(t *testing.T) {
+
+	r := newRng(1, streamTiming)
+	n := 10000
+
+	cases := []struct {
+		cadence  Cadence
+		min, max time.Duration
+	}{
+		{FixedCadence(time.Second), time.Second, time.Second},
+		{JitterCadence(time.Second, 0.1), 900 * time.Millisecond, 1100 * time.Millisecond},
+		{UniformCadence(time.Second, 3*time.Second), time.Second, 3 * time.Second},
+	}
+	for _, c := range cases {
+		for i := 0; i < n; i++ {
+			if d := c.cadence.next(r); d < c.min || d > c.max {
+				t.Fatalf("%s: delay %s out of %s to %s", c.cadence, d, c.min, c.max)
+			}
+		}
+	}
+
+	poisson := PoissonCadence(time.Second)
+	var total time.Duration
+	for i := 0; i < n; i++ {
+		total += poisson.next(r)
+	}
+	if mean := total / time.Duration(n); math.Abs(float64(mean-time.Second)) > 0.05*float64(time.Second) {
+		t.Errorf("expected a mean of about 1s: %s", mean)
+	}
+}
+
+// TestSetCadenceRearms a new cadence applies to the event already scheduled,
+// not only from the one after it.
+func TestSetCadenceRearms(t *testing.T) {
+
+	defer noRandomFaults()()
+	light := NewLight(1)
+	if err := light.SetCadence(FixedCadence(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	c := make(chan ThingEvent, 100)
+	var wg sync.WaitGroup
+	go light.Emit(c, &wg)
+	defer light.Stop()
+
+	// telemetry of the thing, skipping transitions
+	telemetry := func(wait time.Duration) bool {
+		timeout := time.After(wait)
+		for {
+			select {
+			case e := <-c:
+				if e.Kind == KindTelemetry {
+					return true
+				}
+			case <-timeout:
+				return false
+			}
+		}
+	}
+
+	if telemetry(20 * time.Millisecond) {
+		t.Fatal("expected no telemetry within the hour")
+	}
+	if err := light.SetCadence(FixedCadence(time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if !telemetry(time.Second) {
+		t.Error("expected telemetry once the cadence is 1ms")
+	}
+
+	light.Control(Command{Name: "cadence", Value: "1h"})
+	time.Sleep(20 * time.Millisecond)
+	for len(c) > 0 { // what the 1ms cadence sent
+		<-c
+	}
+	if telemetry(20 * time.Millisecond) {
+		t.Fatal("expected no telemetry once the cadence command sets 1h")
+	}
+	light.Control(Command{Name: "cadence", Value: "1ms"})
+	if !telemetry(time.Second) {
+		t.Error("expected telemetry once the cadence command sets 1ms")
+	}
+}
@@ -23,9 +23,12 @@ func TestThingShutdown(t *testing.T) {
 	battery := NewBatteryPack(1)
 	inverter := NewInverter(2)
 	light := NewLight(3)
+	solar := NewSolarArray(4)
+	grid := NewGridMeter(5)
+	charger := NewEVCharger(6)
 
 	// passing reference since things require pointer receiver for emit()
-	things := []Thing{&battery, &inverter, &light}
+	things := []Thing{&battery, &inverter, &light, &solar, &grid, &charger}
 	eventC := make(chan ThingEvent)
 	quitC := make(chan struct{})
 	wg := &sync.WaitGroup{}
@@ -0,0 +1,327 @@
+package things
+
+import (
+	"container/heap"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	clockLock sync.Mutex
+	clock     Clock = RealClock() // clock of the run, see SetClock
+)
+
+// Clock source of time for things and the listener. A simulation runs on one
+// clock, so event TS values are simulated time.
+//
+// Goroutines that wait on timers Join the clock while they run and Leave when
+// they are done. A clock running as fast as possible moves time forward only
+// once every one of them is waiting on a timer.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer   // fires once after d, for goroutines that joined
+	NewTicker(d time.Duration) Ticker // fires every d, never holds the clock back
+	Join()
+	Leave()
+}
+
+// Timer single event of a Clock
+type Timer interface {
+	C() <-chan time.Time // receives the clock time when the timer fires
+	Stop() bool          // false if the timer already fired
+}
+
+// Ticker repeating event of a Clock, slow receivers miss ticks
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// SetClock clock of the run. Set it before creating things, those already
+// running keep their clock.
+func SetClock(c Clock) {
+	defer clockLock.Unlock()
+	clockLock.Lock()
+	clock = c
+}
+
+// GetClock clock of the run
+func GetClock() Clock {
+	defer clockLock.Unlock()
+	clockLock.Lock()
+	return clock
+}
+
+// ParseClock clock from its description
+// real = wall clock, <n>x = n times faster than the wall clock, e.g. 60x,
+// afap = as fast as possible
+// start = simulated time the clock starts at, ignored by the wall clock
+func ParseClock(spec string, start time.Time) (Clock, error) {
+
+	switch spec := strings.ToLower(spec); {
+	case spec == "real":
+		return RealClock(), nil
+	case spec == "afap":
+		return NewAFAPClock(start), nil
+	case strings.HasSuffix(spec, "x"):
+		scale, err := strconv.ParseFloat(strings.TrimSuffix(spec, "x"), 64)
+		if err != nil || scale <= 0 {
+			return nil, fmt.Errorf("invalid clock scale %q", spec)
+		}
+		return NewScaledClock(start, scale), nil
+	}
+	return nil, fmt.Errorf("invalid clock %q, use real, afap or a scale like 60x", spec)
+}
+
+//---------------------------------------------------------
+// scaled clock, real time is a scale of 1 from now
+//---------------------------------------------------------
+
+// scaledClock simulated time runs scale times faster than the wall clock
+type scaledClock struct {
+	start  time.Time // simulated time at origin
+	origin time.Time // wall clock time the clock was created
+	scale  float64
+}
+
+// RealClock the wall clock
+func RealClock() Clock {
+	now := time.Now()
+	return &scaledClock{start: now, origin: now, scale: 1}
+}
+
+// NewScaledClock clock starting at start and running scale times faster than
+// the wall clock, 60 simulates an hour a minute
+func NewScaledClock(start time.Time, scale float64) Clock {
+	return &scaledClock{start: start, origin: time.Now(), scale: scale}
+}
+
+// Now implements Clock
+func (c *scaledClock) Now() time.Time {
+	if c.scale == 1 && c.start.Equal(c.origin) {
+		return time.Now()
+	}
+	return c.start.Add(time.Duration(float64(time.Since(c.origin)) * c.scale))
+}
+
+// NewTimer implements Clock
+func (c *scaledClock) NewTimer(d time.Duration) Timer {
+	t := &scaledTimer{ch: make(chan time.Time, 1)}
+	t.timer = time.AfterFunc(c.wall(d), func() { t.ch <- c.Now() })
+	return t
+}
+
+// NewTicker implements Clock
+func (c *scaledClock) NewTicker(d time.Duration) Ticker {
+	t := &scaledTicker{ticker: time.NewTicker(c.wall(d)), ch: make(chan time.Time, 1), stopC: make(chan struct{})}
+	go func() {
+		for {
+			select {
+			case <-t.ticker.C:
+				select {
+				case t.ch <- c.Now():
+				default: // receiver is behind, drop the tick
+				}
+			case <-t.stopC:
+				return
+			}
+		}
+	}()
+	return t
+}
+
+// Join implements Clock, the wall clock doesn't wait for anyone
+func (c *scaledClock) Join() {}
+
+// Leave implements Clock
+func (c *scaledClock) Leave() {}
+
+// wall duration on the wall clock of a simulated duration
+func (c *scaledClock) wall(d time.Duration) time.Duration {
+	return time.Duration(float64(d) / c.scale)
+}
+
+type scaledTimer struct {
+	timer *time.Timer
+	ch    chan time.Time
+}
+
+func (t *scaledTimer) C() <-chan time.Time { return t.ch }
+func (t *scaledTimer) Stop() bool          { return t.timer.Stop() }
+
+type scaledTicker struct {
+	ticker *time.Ticker
+	ch     chan time.Time
+	stopC  chan struct{}
+}
+
+func (t *scaledTicker) C() <-chan time.Time { return t.ch }
+func (t *scaledTicker) Stop() {
+	t.ticker.Stop()
+	close(t.stopC)
+}
+
+//---------------------------------------------------------
+// as fast as possible clock, event driven
+//---------------------------------------------------------
+
+// afapClock jumps straight to the next timer once every goroutine that joined
+// is waiting on one. Things blocked sending an event hold the clock, so the
+// simulation never runs ahead of the listener.
+type afapClock struct {
+	mu           sync.Mutex
+	now          time.Time
+	timers       timerHeap
+	tickers      []*afapTicker
+	participants int    // goroutines that joined
+	seq          uint64 // orders timers due at the same time
+}
+
+// NewAFAPClock event driven clock starting at start, runs as fast as the
+// things and the listener can keep up
+func NewAFAPClock(start time.Time) Clock {
+	return &afapClock{now: start}
+}
+
+// Now implements Clock
+func (c *afapClock) Now() time.Time {
+	defer c.mu.Unlock()
+	c.mu.Lock()
+	return c.now
+}
+
+// NewTimer implements Clock
+func (c *afapClock) NewTimer(d time.Duration) Timer {
+	defer c.mu.Unlock()
+	c.mu.Lock()
+
+	c.seq++
+	t := &afapTimer{clock: c, at: c.now.Add(d), seq: c.seq, ch: make(chan time.Time, 1)}
+	heap.Push(&c.timers, t)
+	c.advance()
+	return t
+}
+
+// NewTicker implements Clock
+func (c *afapClock) NewTicker(d time.Duration) Ticker {
+	defer c.mu.Unlock()
+	c.mu.Lock()
+
+	t := &afapTicker{clock: c, every: d, next: c.now.Add(d), ch: make(chan time.Time, 1)}
+	c.tickers = append(c.tickers, t)
+	return t
+}
+
+// Join implements Clock
+func (c *afapClock) Join() {
+	defer c.mu.Unlock()
+	c.mu.Lock()
+	c.participants++
+}
+
+// Leave implements Clock
+func (c *afapClock) Leave() {
+	defer c.mu.Unlock()
+	c.mu.Lock()
+	c.participants--
+	c.advance()
+}
+
+// advance fire the next timers while every participant is waiting on one,
+// call with the lock held
+func (c *afapClock) advance() {
+	for c.participants > 0 && len(c.timers) >= c.participants {
+		t := heap.Pop(&c.timers).(*afapTimer)
+		if t.at.After(c.now) {
+			c.tick(t.at)
+			c.now = t.at
+		}
+		t.ch <- c.now
+	}
+}
+
+// tick fire the tickers due up to at, call with the lock held
+func (c *afapClock) tick(at time.Time) {
+	for _, t := range c.tickers {
+		for !t.next.After(at) {
+			select {
+			case t.ch <- t.next:
+			default: // receiver is behind, drop the tick
+			}
+			t.next = t.next.Add(t.every)
+		}
+	}
+}
+
+type afapTimer struct {
+	clock *afapClock
+	at    time.Time
+	seq   uint64
+	index int // position in the heap, -1 once fired or stopped
+	ch    chan time.Time
+}
+
+func (t *afapTimer) C() <-chan time.Time { return t.ch }
+
+func (t *afapTimer) Stop() bool {
+	defer t.clock.mu.Unlock()
+	t.clock.mu.Lock()
+	if t.index < 0 {
+		return false
+	}
+	heap.Remove(&t.clock.timers, t.index)
+	t.clock.advance()
+	return true
+}
+
+type afapTicker struct {
+	clock *afapClock
+	every time.Duration
+	next  time.Time
+	ch    chan time.Time
+}
+
+func (t *afapTicker) C() <-chan time.Time { return t.ch }
+
+func (t *afapTicker) Stop() {
+	defer t.clock.mu.Unlock()
+	t.clock.mu.Lock()
+	for i, other := range t.clock.tickers {
+		if other == t {
+			t.clock.tickers = append(t.clock.tickers[:i], t.clock.tickers[i+1:]...)
+			return
+		}
+	}
+}
+
+// timerHeap pending timers, earliest first
+type timerHeap []*afapTimer
+
+func (h timerHeap) Len() int { return len(h) }
+func (h timerHeap) Less(i, j int) bool {
+	if h[i].at.Equal(h[j].at) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].at.Before(h[j].at)
+}
+func (h timerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *timerHeap) Push(x interface{}) {
+	t := x.(*afapTimer)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+func (h *timerHeap) Pop() interface{} {
+	old := *h
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	t.index = -1
+	*h = old[:len(old)-1]
+	return t
+}
@@ -0,0 +1,104 @@
+package things
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestAFAPClock time jumps to the next timer once every participant waits,
+// and tickers fire on the way.
+func TestAFAPClock(t *testing.T) {
+
+	start := time.Date(2020, 6, 21, 0, 0, 0, 0, time.UTC)
+	clock := NewAFAPClock(start)
+
+	clock.Join()
+	if now := <-clock.NewTimer(time.Hour).C(); !now.Equal(start.Add(time.Hour)) {
+		t.Fatalf("expected the only participant to wake an hour later: %s", now)
+	}
+
+	// a second participant is busy, nothing fires until it waits too
+	clock.Join()
+	ticker := clock.NewTicker(30 * time.Minute)
+	a := clock.NewTimer(2 * time.Hour)
+	select {
+	case <-a.C():
+		t.Fatal("timer fired while a participant was busy")
+	default:
+	}
+	b := clock.NewTimer(time.Hour)
+	if now := <-b.C(); !now.Equal(start.Add(2 * time.Hour)) {
+		t.Errorf("expected the earliest timer first: %s", now)
+	}
+	if tick := <-ticker.C(); !tick.Equal(start.Add(90 * time.Minute)) {
+		t.Errorf("expected a tick on the way: %s", tick)
+	}
+
+	// the second leaves, the first no longer waits for it
+	clock.Leave()
+	if now := <-a.C(); !now.Equal(start.Add(3 * time.Hour)) {
+		t.Errorf("expected the remaining timer to fire: %s", now)
+	}
+	if !clock.Now().Equal(start.Add(3 * time.Hour)) {
+		t.Errorf("expected the clock at the last timer: %s", clock.Now())
+	}
+}
+
+// TestThingAFAP a day of light events runs in moments, stamped in simulated time
+func TestThingAFAP(t *testing.T) {
+
+	defer SetClock(GetClock())
+	start := time.Date(2020, 6, 21, 0, 0, 0, 0, time.UTC)
+	SetClock(NewAFAPClock(start))
+
+	light := NewLight(1)
+	c := make(chan ThingEvent, 10)
+	var wg sync.WaitGroup
+	go light.Emit(c, &wg)
+
+	began := time.Now()
+	var last time.Time
+	for e := range c {
+		if e.TS.Before(last) {
+			t.Fatalf("events out of order: %s before %s", e.TS, last)
+		}
+		last = e.TS
+		if last.Sub(start) >= 24*time.Hour {
+			break
+		}
+	}
+	if time.Since(began) > 10*time.Second {
+		t.Errorf("a simulated day took %s", time.Since(began))
+	}
+
+	// keep draining, the light may be blocked on a send while stopping
+	light.Stop()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for {
+		select {
+		case <-c:
+		case <-done:
+			return
+		}
+	}
+}
+
+// TestParseClock clocks by name and scale
+func TestParseClock(t *testing.T) {
+
+	for _, spec := range []string{"real", "afap", "60x", "0.5x"} {
+		if _, err := ParseClock(spec, time.Now()); err != nil {
+			t.Errorf("%s: %s", spec, err)
+		}
+	}
+	for _, spec := range []string{"", "fast", "0x", "-2x"} {
+		if _, err := ParseClock(spec, time.Now()); err == nil {
+			t.Errorf("expected %q to be rejected", spec)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package things
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	cmdAuto = "auto" // value that hands a setpoint back to the simulation
+
+	// commands every thing accepts, handled before the commands of the thing
+	cmdCadence   = "cadence"   // time between events, see ParseCadence
+	cmdInterval  = "interval"  // same as cadence
+	cmdFault     = "fault"     // raise an alarm by code and hold it until cleared
+	cmdClear     = "clear"     // release a held alarm and clear it
+	cmdRBE       = "rbe"       // report by exception on or off
+	cmdDeadband  = "deadband"  // deadbands of report by exception, see ParseDeadbands
+	cmdIntegrity = "integrity" // longest time without a report by exception
+)
+
+var (
+	errUnknownCommand = errors.New("unknown command")
+	errNotOnOff       = errors.New("value must be on or off")
+	errNoAlarmCode    = errors.New("alarm code can not be empty")
+	errNotFaulted     = errors.New("no fault held with that code")
+)
+
+// Command request to change a running thing, e.g. {level 80} for a Light
+type Command struct {
+	Name  string `json:"name"`  // what to change
+	Value string `json:"value"` // the new value
+}
+
+// Ack answer of a thing to a Command, also published as a KindCommand event
+type Ack struct {
+	CID      uint64  `json:"cid"`
+	Command  Command `json:"command"`
+	Accepted bool    `json:"accepted"`
+	Reason   string  `json:"reason,omitempty"` // why the command was rejected
+}
+
+// Controllable implemented by things that accept commands. A command that is
+// accepted shows up in the next event the thing emits.
+type Controllable interface {
+	Control(Command) Ack
+}
+
+// control apply a command under the lock of the thing and queue the answer.
+// apply returns why the command was rejected, nil when it was accepted.
+// The commands every thing accepts never reach apply.
+func (b *base) control(cmd Command, apply func(Command) error) Ack {
+
+	defer b.mu.Unlock()
+	b.mu.Lock()
+
+	var err error
+	switch cmd.Name {
+	case cmdCadence, cmdInterval:
+		var cadence Cadence
+		if cadence, err = ParseCadence(cmd.Value); err == nil {
+			b.cadence = cadence
+			b.wake() // schedule the next event again
+		}
+	case cmdFault:
+		err = b.injectFault(AlarmCode(cmd.Value))
+	case cmdClear:
+		err = b.releaseFault(AlarmCode(cmd.Value))
+	case cmdRBE:
+		var on bool
+		if on, err = parseOnOff(cmd.Value); err == nil {
+			b.exception.Enabled = on
+			b.reported = report{}
+		}
+	case cmdDeadband:
+		var bands map[string]float64
+		if bands, err = ParseDeadbands(cmd.Value); err == nil {
+			if err = b.checkDeadbands(bands); err == nil {
+				b.setDeadbands(bands)
+			}
+		}
+	case cmdIntegrity:
+		var period time.Duration
+		if period, err = time.ParseDuration(cmd.Value); err == nil {
+			if period < 0 {
+				err = errIntegrity
+			} else {
+				b.exception.Integrity = period
+			}
+		}
+	default:
+		err = apply(cmd)
+	}
+
+	ack := Ack{CID: b.id, Command: cmd, Accepted: true}
+	if err != nil {
+		ack.Accepted = false
+		ack.Reason = err.Error()
+	}
+	b.queue(KindCommand, ack)
+	return ack
+}
+
+// parseOnOff value of an on/off command
+func parseOnOff(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "on", "true", "1":
+		return true, nil
+	case "off", "false", "0":
+		return false, nil
+	}
+	return false, errNotOnOff
+}
+
+// parseRange value of a numeric command bounded to min<->max
+func parseRange(value string, min, max float64) (float64, error) {
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("value %q is not a number", value)
+	}
+	if v < min || v > max {
+		return 0, fmt.Errorf("value %g out of range %g to %g", v, min, max)
+	}
+	return v, nil
+}
@@ -0,0 +1,102 @@
+package things
+
+import (
+	"testing"
+	"time"
+)
+
+// TestLightControl an accepted command shows up in the next event, and every
+// answer is queued for the event stream.
+func TestLightControl(t *testing.T) {
+
+	defer noRandomFaults()()
+	light := NewLight(1)
+	ack := light.Control(Command{Name: "level", Value: "80"})
+	if !ack.Accepted || ack.CID != 1 {
+		t.Fatalf("expected level to be accepted: %+v", ack)
+	}
+
+	sampled := light.sample(time.Now()).(Light)
+	if sampled.LightLevel != 80 || !sampled.Manual {
+		t.Errorf("expected level 80 held in manual: %d %t", sampled.LightLevel, sampled.Manual)
+	}
+
+	ack = light.Control(Command{Name: "cct", Value: "9000"})
+	if ack.Accepted || ack.Reason == "" {
+		t.Errorf("expected cct out of range to be rejected: %+v", ack)
+	}
+	ack = light.Control(Command{Name: "volume", Value: "11"})
+	if ack.Accepted {
+		t.Errorf("expected unknown command to be rejected: %+v", ack)
+	}
+
+	if len(light.pending) != 3 || light.pending[0].Kind != KindCommand {
+		t.Errorf("expected every answer queued as a command event: %+v", light.pending)
+	}
+}
+
+// TestInverterControl a setpoint replaces the load demand and a battery driven
+// by the inverter rejects its own setpoint.
+func TestInverterControl(t *testing.T) {
+
+	defer noRandomFaults()()
+	battery := NewBatteryPack(1)
+	inverter := NewInverter(2)
+	inverter.Attach(&battery)
+
+	if ack := inverter.Control(Command{Name: "setpoint", Value: "-3000"}); !ack.Accepted {
+		t.Fatalf("expected setpoint to be accepted: %+v", ack)
+	}
+	sampled := inverter.sample(time.Now()).(Inverter)
+	if sampled.Watts != -3000 || battery.AmpMeter.LiveAmps >= 0 {
+		t.Errorf("expected the battery to charge at 3000 W: %f W %f A", sampled.Watts, battery.AmpMeter.LiveAmps)
+	}
+
+	if ack := battery.Control(Command{Name: "setpoint", Value: "10"}); ack.Accepted {
+		t.Errorf("expected battery setpoint to be rejected while attached: %+v", ack)
+	}
+
+	inverter.Control(Command{Name: "state", Value: "off"})
+	sampled = inverter.sample(time.Now()).(Inverter)
+	if sampled.Watts != 0 || sampled.State {
+		t.Errorf("expected no output when off: %f", sampled.Watts)
+	}
+}
+
+// TestBaseCommands every thing takes an interval and held faults, which
+// readings don't clear until the fault is released.
+func TestBaseCommands(t *testing.T) {
+
+	defer noRandomFaults()()
+	inverter := NewInverter(1)
+
+	if ack := inverter.Control(Command{Name: "interval", Value: "2s-5s"}); !ack.Accepted {
+		t.Fatalf("expected interval to be accepted: %+v", ack)
+	}
+	if d := inverter.nextDelay(); d < 2*time.Second || d > 5*time.Second {
+		t.Errorf("expected a delay of 2s to 5s: %s", d)
+	}
+	for _, v := range []string{"fast", "0s", "5s-2s"} {
+		if ack := inverter.Control(Command{Name: "interval", Value: v}); ack.Accepted {
+			t.Errorf("expected interval %q to be rejected", v)
+		}
+	}
+
+	if ack := inverter.Control(Command{Name: "fault", Value: "ground_fault"}); !ack.Accepted {
+		t.Fatalf("expected fault to be accepted: %+v", ack)
+	}
+	sampled := inverter.sample(time.Now()).(Inverter)
+	if sampled.Watts != 0 || len(inverter.ActiveAlarms()) != 1 {
+		t.Errorf("expected a held ground fault to trip the inverter: %f W %+v", sampled.Watts, inverter.ActiveAlarms())
+	}
+
+	if ack := inverter.Control(Command{Name: "clear", Value: "ground_fault"}); !ack.Accepted {
+		t.Fatalf("expected clear to be accepted: %+v", ack)
+	}
+	if ack := inverter.Control(Command{Name: "clear", Value: "ground_fault"}); ack.Accepted {
+		t.Errorf("expected clear of a released fault to be rejected: %+v", ack)
+	}
+	if len(inverter.ActiveAlarms()) != 0 {
+		t.Errorf("expected no active alarms: %+v", inverter.ActiveAlarms())
+	}
+}
@@ -0,0 +1,317 @@
+package things
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// rating of an EVCharger, how often vehicles arrive and how long they stay,
+// the range of vehicles that plug in, and the states and events of a session
+const (
+	evRandomDelayMin time.Duration = 1000 * time.Millisecond // least time delay 1s
+	evRandomDelayMax time.Duration = 2000 * time.Millisecond // most time delay 2s
+
+	evVolts        float64       = 240.0            // supply voltage
+	evMaxAmps      float64       = 48.0             // rating of the charger
+	evMeanArrival  time.Duration = 2 * time.Minute  // mean idle time between sessions
+	evMeanDwell    time.Duration = 10 * time.Minute // mean time a vehicle stays plugged in
+	evTaperSoC     float64       = 0.8              // vehicle tapers its charge above this SoC
+	evMinTaper     float64       = 0.1              // fraction of power left at a full battery
+	evMinCapacity  float64       = 40.0             // smallest vehicle battery kWh
+	evMaxCapacity  float64       = 100.0            // largest vehicle battery kWh
+	evMinArriveSoC float64       = 0.1              // vehicles arrive between min and max SoC
+	evMaxArriveSoC float64       = 0.6
+	evMinTargetSoC float64       = 0.8 // drivers ask for between min and max SoC
+	evMaxTargetSoC float64       = 1.0
+	evMinVehicleKW float64       = 7.2  // slowest on board charger kW
+	evMaxVehicleKW float64       = 11.5 // fastest on board charger kW
+
+	evStateIdle     = "idle"     // nothing plugged in
+	evStateCharging = "charging" // vehicle plugged in and taking power
+	evStateComplete = "complete" // vehicle plugged in, reached its target
+
+	evStart          = "start"     // session event, vehicle plugged in
+	evStop           = "stop"      // session event, vehicle unplugged
+	evReasonDeparted = "departed"  // unplugged at the end of its dwell
+	evReasonUnplug   = "unplugged" // unplugged by command
+)
+
+var (
+	errNoSession = errors.New("no vehicle plugged in")
+
+	// evAmpLimits amperage limits handed to new sessions
+	evAmpLimits = []float64{16, 24, 32, 40, 48}
+)
+
+// EVChargerConfig ratings of an EVCharger and the traffic it sees
+type EVChargerConfig struct {
+	Volts       float64       // supply voltage
+	MaxAmps     float64       // rating of the charger, session limits never exceed it
+	MeanArrival time.Duration // mean idle time before the next vehicle arrives
+	MeanDwell   time.Duration // mean time a vehicle stays plugged in
+}
+
+// DefaultEVChargerConfig the 48A level 2 charger used when no configuration is given
+func DefaultEVChargerConfig() EVChargerConfig {
+	return EVChargerConfig{
+		Volts:       evVolts,
+		MaxAmps:     evMaxAmps,
+		MeanArrival: evMeanArrival,
+		MeanDwell:   evMeanDwell,
+	}
+}
+
+// Vehicle battery of the vehicle plugged into an EVCharger
+type Vehicle struct {
+	CapacityKWh float64 `json:"capacity_kwh"`
+	SoC         float64 `json:"state_of_charge"` // 0.0 - 1.0
+	TargetSoC   float64 `json:"target_soc"`      // charging stops here
+	MaxKW       float64 `json:"max_kw"`          // on board charger limit
+}
+
+// EVSession start and stop events of a charging session
+type EVSession struct {
+	Event     string    `json:"event"` // start or stop
+	SessionID uint64    `json:"session_id"`
+	Started   time.Time `json:"started"`
+	AmpLimit  float64   `json:"amp_limit"`
+	Vehicle   Vehicle   `json:"vehicle"`
+	StartSoC  float64   `json:"start_soc"`
+	EnergyKWh float64   `json:"energy_kwh"`       // delivered so far
+	Reason    string    `json:"reason,omitempty"` // why the session stopped
+}
+
+// EVCharger level 2 charger. Vehicles arrive after a random idle time, charge
+// under the session amperage limit and their own on board charger, taper near
+// full, and leave at the end of a random dwell.
+type EVCharger struct {
+	State      string   `json:"state"`       // idle, charging or complete
+	Volts      float64  `json:"volts"`       // supply voltage
+	Amps       float64  `json:"amps"`        // present charge current
+	Watts      float64  `json:"watts"`       // present charge power
+	AmpLimit   float64  `json:"amp_limit"`   // limit of the present session
+	SessionID  uint64   `json:"session_id"`  // 0 while idle
+	SessionKWh float64  `json:"session_kwh"` // delivered in the present session
+	TTLKWh     float64  `json:"total_kwh"`   // charger odometer
+	Vehicle    *Vehicle `json:"vehicle"`     // nil while idle
+
+	config      EVChargerConfig
+	session     EVSession // present session
+	nextSession uint64    // ID of the last session started, never reset
+	nextChange  time.Time // next arrival while idle, departure while plugged in
+	lastUpdate  time.Time // time energy was last integrated
+
+	base
+}
+
+// NewEVCharger create an EV charger with the DefaultEVChargerConfig
+// ID = cid  code challenge id. Increment ID created by supervisor unique to all things
+func NewEVCharger(ID uint64) EVCharger {
+	return NewEVChargerConfig(ID, DefaultEVChargerConfig())
+}
+
+// NewEVChargerConfig create an EV charger allocating configuration
+// ID = cid  code challenge id. Increment ID created by supervisor unique to all things
+// cfg = ratings and traffic of the charger
+func NewEVChargerConfig(ID uint64, cfg EVChargerConfig) EVCharger {
+
+	e := EVCharger{
+		base:   newBase(ID, "EVCharger", UniformCadence(evRandomDelayMin, evRandomDelayMax)),
+		config: cfg,
+		State:  evStateIdle,
+		Volts:  cfg.Volts,
+	}
+	e.lastUpdate = e.createdTime
+	e.nextChange = e.createdTime.Add(e.rng.expDuration(cfg.MeanArrival))
+	return e
+}
+
+// Emit implements thing interface to send events over Channel
+// c = channel writer for all events
+// wg = waitgroup needs to know when we are done with channel
+func (e *EVCharger) Emit(c chan<- ThingEvent, wg *sync.WaitGroup) {
+	e.run(c, wg, e.sample)
+}
+
+// NetWatts implements PowerFlow, a charging vehicle draws power from the site
+func (e *EVCharger) NetWatts() float64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return -e.Watts
+}
+
+// EnergyRole implements PowerFlow
+func (e *EVCharger) EnergyRole() EnergyRole {
+	return RoleLoad
+}
+
+// Control implements Controllable
+// limit = amps of the present session, unplug = end the present session now
+func (e *EVCharger) Control(cmd Command) Ack {
+	return e.control(cmd, e.apply)
+}
+
+// apply a command with the lock held
+func (e *EVCharger) apply(cmd Command) error {
+	if e.Vehicle == nil {
+		return errNoSession
+	}
+	switch cmd.Name {
+	case "limit":
+		v, err := parseRange(cmd.Value, 0, e.config.MaxAmps)
+		if err != nil {
+			return err
+		}
+		e.AmpLimit = v
+	case "unplug":
+		e.unplug(evReasonUnplug)
+		e.nextChange = e.lastUpdate.Add(e.rng.expDuration(e.config.MeanArrival))
+	default:
+		return errUnknownCommand
+	}
+	return nil
+}
+
+// evChargerState model of an EVCharger in a ThingState
+type evChargerState struct {
+	Charger     *EVCharger      `json:"charger"`
+	Config      EVChargerConfig `json:"config"`
+	Session     EVSession       `json:"session"`
+	NextSession uint64          `json:"next_session"`
+	NextChange  time.Time       `json:"next_change"`
+	LastUpdate  time.Time       `json:"last_update"`
+}
+
+// Snapshot implements Snapshotter
+func (e *EVCharger) Snapshot() (ThingState, error) {
+	defer e.mu.Unlock()
+	e.mu.Lock()
+
+	return e.saveState(evChargerState{Charger: e, Config: e.config, Session: e.session,
+		NextSession: e.nextSession, NextChange: e.nextChange, LastUpdate: e.lastUpdate})
+}
+
+// Restore implements Snapshotter, a vehicle plugged in stays for the rest of
+// its dwell
+func (e *EVCharger) Restore(state ThingState) error {
+	defer e.mu.Unlock()
+	e.mu.Lock()
+
+	s := evChargerState{Charger: e}
+	shift, err := e.restoreState(state, &s)
+	if err != nil {
+		return err
+	}
+	e.config = s.Config
+	e.session = s.Session
+	e.nextSession = s.NextSession
+	if e.nextSession < e.SessionID {
+		e.nextSession = e.SessionID // saved before the counter was kept
+	}
+	e.nextChange = s.NextChange.Add(shift)
+	e.lastUpdate = s.LastUpdate.Add(shift)
+	return nil
+}
+
+// sample advance the model to now and copy it for the event
+func (e *EVCharger) sample(now time.Time) interface{} {
+	e.update(now)
+
+	c := *e
+	c.SessionKWh = round(e.SessionKWh)
+	c.TTLKWh = round(e.TTLKWh)
+	if e.Vehicle != nil {
+		v := *e.Vehicle
+		v.SoC = round(v.SoC)
+		c.Vehicle = &v
+	}
+	return c
+}
+
+// update integrate the energy of the last interval, then plug in or unplug a
+// vehicle when its time has come and work out the charge power at now
+func (e *EVCharger) update(now time.Time) {
+
+	kWh := e.Watts / 1000 * now.Sub(e.lastUpdate).Hours()
+	e.lastUpdate = now
+	if e.Vehicle != nil && kWh > 0 {
+		e.Vehicle.SoC = math.Min(e.Vehicle.TargetSoC, e.Vehicle.SoC+kWh/e.Vehicle.CapacityKWh)
+		e.SessionKWh += kWh
+		e.TTLKWh += kWh
+	}
+
+	if !now.Before(e.nextChange) {
+		if e.Vehicle == nil {
+			e.plugIn(now)
+		} else {
+			e.unplug(evReasonDeparted)
+			e.nextChange = now.Add(e.rng.expDuration(e.config.MeanArrival))
+		}
+	}
+
+	e.Amps, e.Watts = 0, 0
+	if e.Vehicle == nil {
+		e.State = evStateIdle
+		return
+	}
+	if e.Vehicle.SoC >= e.Vehicle.TargetSoC {
+		e.State = evStateComplete
+		return
+	}
+
+	e.State = evStateCharging
+	watts := math.Min(e.AmpLimit*e.Volts, e.Vehicle.MaxKW*1000)
+	if e.Vehicle.SoC > evTaperSoC {
+		taper := (1 - e.Vehicle.SoC) / (1 - evTaperSoC)
+		watts *= math.Max(evMinTaper, taper)
+	}
+	e.Watts = round(watts)
+	e.Amps = round(watts / e.Volts)
+}
+
+// plugIn a new vehicle arrives and starts a session
+func (e *EVCharger) plugIn(now time.Time) {
+
+	e.Vehicle = &Vehicle{
+		CapacityKWh: e.rng.RFloat(evMinCapacity, evMaxCapacity),
+		SoC:         e.rng.RFloat(evMinArriveSoC, evMaxArriveSoC),
+		TargetSoC:   e.rng.RFloat(evMinTargetSoC, evMaxTargetSoC),
+		MaxKW:       e.rng.RFloat(evMinVehicleKW, evMaxVehicleKW),
+	}
+	e.nextSession++
+	e.SessionID = e.nextSession
+	e.SessionKWh = 0
+	e.AmpLimit = math.Min(e.config.MaxAmps, evAmpLimits[e.rng.RInt(0, len(evAmpLimits))])
+	e.nextChange = now.Add(e.rng.expDuration(e.config.MeanDwell))
+
+	e.session = EVSession{
+		SessionID: e.SessionID,
+		Started:   now,
+		AmpLimit:  e.AmpLimit,
+		StartSoC:  e.Vehicle.SoC,
+	}
+	e.queueSession(evStart, "")
+}
+
+// unplug the vehicle leaves and the session stops
+func (e *EVCharger) unplug(reason string) {
+	e.queueSession(evStop, reason)
+	e.Vehicle = nil
+	e.AmpLimit = 0
+	e.SessionID = 0
+	e.Amps, e.Watts = 0, 0
+}
+
+// queueSession queue a session event with the state of the present session
+func (e *EVCharger) queueSession(event, reason string) {
+	s := e.session
+	s.Event = event
+	s.Reason = reason
+	s.AmpLimit = e.AmpLimit
+	s.Vehicle = *e.Vehicle
+	s.Vehicle.SoC = round(s.Vehicle.SoC)
+	s.EnergyKWh = round(e.SessionKWh)
+	e.queue(KindSession, s)
+}
@@ -0,0 +1,81 @@
+package things
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// TestEVChargerSession a vehicle plugs in, charges under the session limit and
+// leaves, with a session event at either end.
+func TestEVChargerSession(t *testing.T) {
+
+	charger := NewEVCharger(1)
+	now := charger.nextChange
+	charger.update(now)
+
+	if charger.Vehicle == nil || charger.State != evStateCharging {
+		t.Fatalf("expected a vehicle charging: %s", charger.State)
+	}
+	if len(charger.pending) != 1 || charger.pending[0].Kind != KindSession {
+		t.Fatalf("expected a session start event: %+v", charger.pending)
+	}
+	if charger.Watts > charger.AmpLimit*charger.Volts || charger.Watts > charger.Vehicle.MaxKW*1000 {
+		t.Errorf("charge power %f exceeds the limits", charger.Watts)
+	}
+
+	// charge for six minutes, stay clear of the departure
+	charger.nextChange = now.Add(time.Hour)
+	startSoC, watts := charger.Vehicle.SoC, charger.Watts
+	now = now.Add(6 * time.Minute)
+	charger.update(now)
+	kWh := watts / 1000 / 10
+	if math.Abs(charger.SessionKWh-kWh) > 0.001 {
+		t.Errorf("session energy expected %f: %f", kWh, charger.SessionKWh)
+	}
+	expected := math.Min(charger.Vehicle.TargetSoC, startSoC+kWh/charger.Vehicle.CapacityKWh)
+	if math.Abs(charger.Vehicle.SoC-expected) > 0.0001 {
+		t.Errorf("vehicle state of charge expected %f: %f", expected, charger.Vehicle.SoC)
+	}
+
+	charger.update(charger.nextChange)
+	if charger.Vehicle != nil || charger.State != evStateIdle {
+		t.Errorf("expected the vehicle to leave: %s", charger.State)
+	}
+	stop, ok := charger.pending[len(charger.pending)-1].EventData.(EVSession)
+	if !ok || stop.Event != evStop || stop.SessionID != 1 {
+		t.Errorf("expected a session stop event: %+v", charger.pending)
+	}
+}
+
+// TestEVChargerSessionIDs every session of a charger gets an ID of its own,
+// idle in between, and a restored charger carries on from the last one.
+func TestEVChargerSessionIDs(t *testing.T) {
+
+	charger := NewEVCharger(1)
+	ids := make(map[uint64]bool)
+	for i := 0; i < 5; i++ {
+		charger.update(charger.nextChange) // plug in
+		if charger.SessionID == 0 || ids[charger.SessionID] {
+			t.Fatalf("session %d: expected a new ID: %d", i, charger.SessionID)
+		}
+		ids[charger.SessionID] = true
+		charger.update(charger.nextChange) // leave
+		if charger.SessionID != 0 {
+			t.Errorf("session %d: expected ID 0 while idle: %d", i, charger.SessionID)
+		}
+	}
+
+	state, err := charger.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := NewEVCharger(1)
+	if err := restored.Restore(state); err != nil {
+		t.Fatal(err)
+	}
+	restored.update(restored.nextChange)
+	if ids[restored.SessionID] {
+		t.Errorf("restored charger repeated session ID %d", restored.SessionID)
+	}
+}
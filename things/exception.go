@@ -0,0 +1,266 @@
+package things
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	deadbandAll      = "*"              // deadband of the fields without one of their own
+	defaultIntegrity = 15 * time.Minute // longest silence of a thing reporting by exception
+)
+
+var (
+	errDeadband  = errors.New("deadband must be <field>=<band> or <field>=off, comma separated")
+	errIntegrity = errors.New("integrity period can not be negative")
+
+	errDeadbandField = "no telemetry field %s, deadbands are set by flattened JSON path e.g. cells.0.voltage"
+)
+
+// Exception report by exception settings of a thing. While enabled telemetry
+// is sent only when a field moved past its deadband since the last report,
+// or no report was sent for the integrity period. Events other than
+// telemetry are always sent.
+//
+// Fields are named by their flattened JSON path in the telemetry, e.g.
+// pack_voltage, amp_meter.live_amps or cells.0.voltage. Fields without a
+// deadband of their own use the one of "*", and never trigger a report when
+// there is none. A field that isn't a number triggers on any change.
+type Exception struct {
+	Enabled   bool               `json:"enabled"`
+	Deadbands map[string]float64 `json:"deadbands"` // least change that is reported, by field path
+	Integrity time.Duration      `json:"integrity"` // longest time without a report, 0 never reports on time alone
+}
+
+// Exceptional implemented by things that can report by exception
+type Exceptional interface {
+	Exception() Exception
+	SetException(Exception) error
+}
+
+// ParseDeadbands deadbands from their spec, e.g.
+// pack_voltage=0.5,thermistors.0.temperature=1. A band of off removes the
+// deadband of the field, returned as NaN.
+func ParseDeadbands(spec string) (map[string]float64, error) {
+
+	bands := make(map[string]float64)
+	for _, part := range strings.Split(spec, ",") {
+		kv := strings.Split(strings.TrimSpace(part), "=")
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, errDeadband
+		}
+		field, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		if strings.EqualFold(value, "off") {
+			bands[field] = math.NaN()
+			continue
+		}
+		band, err := strconv.ParseFloat(value, 64)
+		if err != nil || band < 0 || math.IsNaN(band) {
+			return nil, fmt.Errorf("deadband %q must be a number of at least 0", part)
+		}
+		bands[field] = band
+	}
+	return bands, nil
+}
+
+// Validate the settings can be applied
+func (e Exception) Validate() error {
+	if e.Integrity < 0 {
+		return errIntegrity
+	}
+	for field, band := range e.Deadbands {
+		if band < 0 || math.IsNaN(band) {
+			return fmt.Errorf("deadband of %s must be at least 0", field)
+		}
+	}
+	return nil
+}
+
+// Exception implements Exceptional
+func (b *base) Exception() Exception {
+	defer b.mu.Unlock()
+	b.mu.Lock()
+
+	e := b.exception
+	e.Deadbands = make(map[string]float64, len(b.exception.Deadbands))
+	for field, band := range b.exception.Deadbands {
+		e.Deadbands[field] = band
+	}
+	return e
+}
+
+// SetException implements Exceptional, the next telemetry is always reported
+func (b *base) SetException(e Exception) error {
+	if err := e.Validate(); err != nil {
+		return err
+	}
+	bands := make(map[string]float64, len(e.Deadbands))
+	for field, band := range e.Deadbands {
+		bands[field] = band
+	}
+	e.Deadbands = bands
+
+	defer b.mu.Unlock()
+	b.mu.Lock()
+	if err := b.checkDeadbands(bands); err != nil {
+		return err
+	}
+	b.exception = e
+	b.reported = report{}
+	return nil
+}
+
+// checkDeadbands the fields of bands are in the telemetry of the thing. Until
+// it has sampled any they are checked by sampled instead. Call with the lock
+// held.
+func (b *base) checkDeadbands(bands map[string]float64) error {
+	if b.fields == nil {
+		return nil
+	}
+	if unknown := unknownFields(bands, b.fields); len(unknown) > 0 {
+		return fmt.Errorf(errDeadbandField, strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// sampled keep the fields of the first telemetry to check deadbands against,
+// the deadbands set before it are checked now. Reports by exception keep
+// them up to date. Call with the lock held.
+func (b *base) sampled(data interface{}) {
+	if b.fields != nil {
+		return
+	}
+	b.fields = flatten(data)
+	if unknown := unknownFields(b.exception.Deadbands, b.fields); len(unknown) > 0 {
+		log.Warnf("%s %d: "+errDeadbandField, b.thingType, b.id, strings.Join(unknown, ", "))
+	}
+}
+
+// unknownFields the fields of bands not in the flattened telemetry, sorted.
+// The deadband of * and removed ones (NaN) fit any telemetry.
+func unknownFields(bands map[string]float64, fields map[string]interface{}) []string {
+	unknown := make([]string, 0)
+	for field, band := range bands {
+		if _, ok := fields[field]; !ok && field != deadbandAll && !math.IsNaN(band) {
+			unknown = append(unknown, field)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// setDeadbands add, change or remove (NaN) deadbands, call with the lock held
+func (b *base) setDeadbands(bands map[string]float64) {
+	if b.exception.Deadbands == nil {
+		b.exception.Deadbands = make(map[string]float64)
+	}
+	for field, band := range bands {
+		if math.IsNaN(band) {
+			delete(b.exception.Deadbands, field)
+			continue
+		}
+		b.exception.Deadbands[field] = band
+	}
+}
+
+// report whether telemetry sampled at now is sent, and remember it as the
+// last report if so. Call with the lock held.
+func (b *base) report(data interface{}, now time.Time) bool {
+
+	if !b.exception.Enabled {
+		return true
+	}
+	fields := flatten(data)
+	b.fields = fields
+	due := b.exception.Integrity > 0 && now.Sub(b.reported.at) >= b.exception.Integrity
+	if b.reported.fields != nil && !due && !b.exceeds(fields) {
+		return false
+	}
+	b.reported = report{fields: fields, at: now}
+	return true
+}
+
+// exceeds a field moved past its deadband since the last report, call with
+// the lock held
+func (b *base) exceeds(fields map[string]interface{}) bool {
+
+	for field, value := range fields {
+		band, ok := b.exception.Deadbands[field]
+		if !ok {
+			if band, ok = b.exception.Deadbands[deadbandAll]; !ok {
+				continue
+			}
+		}
+		last, ok := b.reported.fields[field]
+		if !ok {
+			return true
+		}
+		v, isNum := value.(float64)
+		l, wasNum := last.(float64)
+		switch {
+		case isNum && wasNum:
+			if math.Abs(v-l) > band {
+				return true
+			}
+		case value != last:
+			return true
+		}
+	}
+	return false
+}
+
+// fieldValues telemetry flattened by JSON path, see flatten
+type fieldValues map[string]interface{}
+
+// report last telemetry sent while reporting by exception
+type report struct {
+	fields map[string]interface{} // flattened telemetry, nil before the first report
+	at     time.Time
+}
+
+// flatten telemetry into its JSON fields by path, numbers are float64
+func flatten(data interface{}) map[string]interface{} {
+
+	fields := make(map[string]interface{})
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return fields
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(raw, &decoded); err != nil {
+		return fields
+	}
+	flattenInto(fields, "", decoded)
+	return fields
+}
+
+// flattenInto add value and everything under it to fields
+func flattenInto(fields map[string]interface{}, path string, value interface{}) {
+
+	join := func(key string) string {
+		if path == "" {
+			return key
+		}
+		return path + "." + key
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			flattenInto(fields, join(key), child)
+		}
+	case []interface{}:
+		for i, child := range v {
+			flattenInto(fields, join(strconv.Itoa(i)), child)
+		}
+	default:
+		fields[path] = v
+	}
+}
@@ -0,0 +1,122 @@
+package things
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestReportByException telemetry is sent on a change past a deadband or once
+// the integrity period passed, and always while reporting is periodic.
+func TestReportByException(t *testing.T) {
+
+	type reading struct {
+		Volts float64 `json:"volts"`
+		Temp  float64 `json:"temperature"`
+		Mode  string  `json:"mode"`
+		Cells []struct {
+			Voltage float64 `json:"voltage"`
+		} `json:"cells"`
+	}
+
+	b := newBase(1, "Test", FixedCadence(time.Second))
+	start := time.Date(2020, 6, 21, 0, 0, 0, 0, time.UTC)
+	r := reading{Volts: 240, Temp: 25, Mode: "auto"}
+	if !b.report(r, start) || !b.report(r, start) {
+		t.Fatal("expected every sample reported while periodic")
+	}
+
+	for _, cmd := range []Command{
+		{Name: "deadband", Value: "volts=0.5, cells.0.voltage=0.01"},
+		{Name: "integrity", Value: "10m"},
+		{Name: "rbe", Value: "on"},
+	} {
+		if ack := b.control(cmd, nil); !ack.Accepted {
+			t.Fatalf("expected %s to be accepted: %s", cmd.Name, ack.Reason)
+		}
+	}
+
+	r.Cells = make([]struct {
+		Voltage float64 `json:"voltage"`
+	}, 1)
+	r.Cells[0].Voltage = 4.0
+	steps := []struct {
+		after  time.Duration
+		change func()
+		sent   bool
+	}{
+		{0, func() {}, true}, // first report after enabling
+		{time.Second, func() { r.Volts = 240.4 }, false},
+		{2 * time.Second, func() { r.Volts = 240.6 }, true},
+		{3 * time.Second, func() { r.Temp = 40 }, false}, // no deadband
+		{4 * time.Second, func() { r.Cells[0].Voltage = 4.02 }, true},
+		{5 * time.Second, func() {}, false},
+		{10*time.Minute + 4*time.Second, func() {}, true}, // integrity
+	}
+	for i, step := range steps {
+		step.change()
+		if sent := b.report(r, start.Add(step.after)); sent != step.sent {
+			t.Errorf("step %d: expected sent %t", i, step.sent)
+		}
+	}
+
+	// any field not a number triggers on change once covered by *
+	b.control(Command{Name: "deadband", Value: "*=1000"}, nil)
+	r.Mode = "manual"
+	if !b.report(r, start.Add(11*time.Minute)) {
+		t.Error("expected a change of mode to be reported")
+	}
+
+	if ack := b.control(Command{Name: "deadband", Value: "volts"}, nil); ack.Accepted {
+		t.Error("expected a deadband without a band to be rejected")
+	}
+	if ack := b.control(Command{Name: "integrity", Value: "-1s"}, nil); ack.Accepted {
+		t.Error("expected a negative integrity to be rejected")
+	}
+	b.control(Command{Name: "deadband", Value: "volts=off"}, nil)
+	if _, ok := b.Exception().Deadbands["volts"]; ok {
+		t.Error("expected the volts deadband removed")
+	}
+}
+
+// TestDeadbandFields deadbands are set by the flattened paths of the
+// telemetry of a thing, a field it doesn't report is rejected once it has
+// sampled any.
+func TestDeadbandFields(t *testing.T) {
+
+	pack := NewBatteryPack(1)
+	if ack := pack.Control(Command{Name: "deadband", Value: "volts=0.5"}); !ack.Accepted {
+		t.Errorf("expected a deadband before the first sample to be accepted: %s", ack.Reason)
+	}
+	pack.mu.Lock()
+	pack.sampled(pack.sample(time.Now()))
+	pack.mu.Unlock()
+
+	tests := []struct {
+		spec     string
+		accepted bool
+	}{
+		{"pack_voltage=0.5,thermistors.0.temperature=1", true}, // the example of ParseDeadbands
+		{"cells.0.voltage=0.01", true},
+		{"*=1", true},
+		{"volts=off", true},
+		{"volts=0.5", false},
+		{"pack_voltage=0.5,temperature=1", false},
+		{"thermistors.99.temperature=1", false},
+	}
+	for _, tt := range tests {
+		ack := pack.Control(Command{Name: "deadband", Value: tt.spec})
+		if ack.Accepted != tt.accepted {
+			t.Errorf("%s: expected accepted %t: %s", tt.spec, tt.accepted, ack.Reason)
+		}
+		if !ack.Accepted && !strings.Contains(ack.Reason, "no telemetry field") {
+			t.Errorf("%s: expected the unknown field named: %s", tt.spec, ack.Reason)
+		}
+	}
+
+	e := pack.Exception()
+	e.Deadbands["volts"] = 1
+	if err := pack.SetException(e); err == nil || !strings.Contains(err.Error(), "volts") {
+		t.Errorf("expected an unknown field to be rejected: %v", err)
+	}
+}
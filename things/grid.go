@@ -0,0 +1,229 @@
+package things
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// nominal values at the point of connection of a GridMeter, and how far and
+// how fast its frequency, voltage, site load and power factor drift
+const (
+	gridRandomDelayMin time.Duration = 1000 * time.Millisecond // least time delay 1s
+	gridRandomDelayMax time.Duration = 2000 * time.Millisecond // most time delay 2s
+
+	gridNominalHz    float64 = 60.0   // nominal grid frequency
+	gridNominalVolts float64 = 120.0  // nominal phase to neutral voltage
+	gridPhases       int     = 3      // phases metered
+	gridBaseLoad     float64 = 1500.0 // mean unmetered site load, watts
+	gridLoadStep     float64 = 150.0  // max change of the site load per emit, watts
+	gridPowerFactor  float64 = 0.95   // mean power factor of the site load
+
+	hzReversion   float64 = 0.1     // pull of the frequency back to nominal per emit
+	hzNoise       float64 = 0.005   // max change of the frequency per emit
+	hzLimit       float64 = 0.5     // frequency stays within nominal +/- limit
+	voltReversion float64 = 0.1     // pull of the phase voltage back to nominal per emit
+	voltNoise     float64 = 0.004   // max change of the phase voltage per emit, fraction of nominal
+	voltLimit     float64 = 0.05    // phase voltage stays within nominal +/- fraction
+	voltSag       float64 = 0.00025 // volts lost per watt imported on a phase
+	loadReversion float64 = 0.05    // pull of the site load back to its mean per emit
+	pfNoise       float64 = 0.005   // max change of the power factor per emit
+	pfMin         float64 = 0.8     // lowest power factor of the site load
+)
+
+// GridConfig nominal values at the point of connection of a GridMeter
+type GridConfig struct {
+	NominalHz    float64 // 50 or 60
+	NominalVolts float64 // phase to neutral
+	Phases       int     // number of phases metered
+	BaseLoad     float64 // mean watts of the site load not modelled by any thing
+	PowerFactor  float64 // mean power factor of that load
+}
+
+// DefaultGridConfig the 60Hz 3 phase service used when no configuration is given
+func DefaultGridConfig() GridConfig {
+	return GridConfig{
+		NominalHz:    gridNominalHz,
+		NominalVolts: gridNominalVolts,
+		Phases:       gridPhases,
+		BaseLoad:     gridBaseLoad,
+		PowerFactor:  gridPowerFactor,
+	}
+}
+
+// GridMeter bidirectional revenue meter at the point of connection. Net power
+// is the site load less whatever the PowerFlow things on the site inject.
+// RealPower is positive while importing and negative while exporting.
+type GridMeter struct {
+	ImportKWh     float64   `json:"import_kwh"`     // energy register imported from the grid
+	ExportKWh     float64   `json:"export_kwh"`     // energy register exported to the grid
+	RealPower     float64   `json:"real_power"`     // watts
+	ReactivePower float64   `json:"reactive_power"` // VAR drawn by the site load
+	PowerFactor   float64   `json:"power_factor"`   // of the site load
+	Frequency     float64   `json:"frequency"`      // Hz
+	PhaseVolts    []float64 `json:"phase_volts"`    // phase to neutral volts
+
+	config     GridConfig
+	siteLoad   float64        // unmetered site load, watts
+	netPower   func() float64 // power injected by the things on the site
+	voltDrift  []float64      // random walk of each phase voltage, fraction of nominal
+	lastUpdate time.Time      // time registers were last integrated
+
+	base
+}
+
+// NewGridMeter create a grid meter with the DefaultGridConfig
+// ID = cid  code challenge id. Increment ID created by supervisor unique to all things
+func NewGridMeter(ID uint64) GridMeter {
+	return NewGridMeterConfig(ID, DefaultGridConfig())
+}
+
+// NewGridMeterConfig create a grid meter allocating configuration
+// ID = cid  code challenge id. Increment ID created by supervisor unique to all things
+// cfg = nominal values at the point of connection
+func NewGridMeterConfig(ID uint64, cfg GridConfig) GridMeter {
+
+	g := GridMeter{
+		base:        newBase(ID, "GridMeter", UniformCadence(gridRandomDelayMin, gridRandomDelayMax)),
+		config:      cfg,
+		Frequency:   cfg.NominalHz,
+		PowerFactor: cfg.PowerFactor,
+		PhaseVolts:  make([]float64, cfg.Phases),
+		voltDrift:   make([]float64, cfg.Phases),
+		siteLoad:    cfg.BaseLoad,
+	}
+	g.lastUpdate = g.createdTime
+	g.update(g.createdTime)
+	return g
+}
+
+// SetNetPower source of the power injected by the other things on the site.
+// Without one the meter sees only its own site load.
+func (g *GridMeter) SetNetPower(f func() float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.netPower = f
+}
+
+// Control implements Controllable, the meter takes only the commands every
+// thing accepts
+func (g *GridMeter) Control(cmd Command) Ack {
+	return g.control(cmd, func(Command) error { return errUnknownCommand })
+}
+
+// gridState model of a GridMeter in a ThingState
+type gridState struct {
+	Meter      *GridMeter `json:"meter"`
+	Config     GridConfig `json:"config"`
+	SiteLoad   float64    `json:"site_load"`
+	VoltDrift  []float64  `json:"volt_drift"`
+	LastUpdate time.Time  `json:"last_update"`
+}
+
+// Snapshot implements Snapshotter
+func (g *GridMeter) Snapshot() (ThingState, error) {
+	defer g.mu.Unlock()
+	g.mu.Lock()
+	return g.saveState(gridState{Meter: g, Config: g.config, SiteLoad: g.siteLoad, VoltDrift: g.voltDrift, LastUpdate: g.lastUpdate})
+}
+
+// Restore implements Snapshotter, the registers carry on from their saved
+// readings
+func (g *GridMeter) Restore(state ThingState) error {
+	defer g.mu.Unlock()
+	g.mu.Lock()
+
+	s := gridState{Meter: g}
+	shift, err := g.restoreState(state, &s)
+	if err != nil {
+		return err
+	}
+	if len(s.VoltDrift) != len(g.PhaseVolts) {
+		return errStateModel
+	}
+	g.config = s.Config
+	g.siteLoad = s.SiteLoad
+	g.voltDrift = s.VoltDrift
+	g.lastUpdate = s.LastUpdate.Add(shift)
+	return nil
+}
+
+// NetWatts implements PowerFlow, the unmetered site load seen by the meter.
+// It is not part of the power the meter gets from SetNetPower.
+func (g *GridMeter) NetWatts() float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return -g.siteLoad
+}
+
+// EnergyRole implements PowerFlow
+func (g *GridMeter) EnergyRole() EnergyRole {
+	return RoleLoad
+}
+
+// GridWatts implements SiteMeter, the real power measured at the last emit
+func (g *GridMeter) GridWatts() float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.RealPower
+}
+
+// Emit implements thing interface to send events over Channel
+// c = channel writer for all events
+// wg = waitgroup needs to know when we are done with channel
+func (g *GridMeter) Emit(c chan<- ThingEvent, wg *sync.WaitGroup) {
+	g.run(c, wg, g.sample)
+}
+
+// sample advance the model to now and copy it for the event
+func (g *GridMeter) sample(now time.Time) interface{} {
+	g.stepGrid()
+	g.update(now)
+
+	// registers keep full precision, small intervals would round away
+	c := *g
+	c.ImportKWh = round(g.ImportKWh)
+	c.ExportKWh = round(g.ExportKWh)
+	c.PhaseVolts = append([]float64(nil), g.PhaseVolts...)
+	return c
+}
+
+// stepGrid random walks of the site load, power factor, frequency and phase
+// voltages, each pulled back toward its nominal value
+func (g *GridMeter) stepGrid() {
+
+	g.siteLoad = math.Max(0, g.siteLoad+(g.config.BaseLoad-g.siteLoad)*loadReversion+g.rng.RFloat(-gridLoadStep, gridLoadStep))
+	g.PowerFactor = round(clamp(g.PowerFactor+(g.config.PowerFactor-g.PowerFactor)*loadReversion+g.rng.RFloat(-pfNoise, pfNoise), pfMin, 1))
+
+	hz := g.Frequency + (g.config.NominalHz-g.Frequency)*hzReversion + g.rng.RFloat(-hzNoise, hzNoise)
+	g.Frequency = round(clamp(hz, g.config.NominalHz-hzLimit, g.config.NominalHz+hzLimit))
+
+	for i := range g.voltDrift {
+		g.voltDrift[i] = clamp(g.voltDrift[i]*(1-voltReversion)+g.rng.RFloat(-voltNoise, voltNoise), -voltLimit, voltLimit)
+	}
+}
+
+// update net power at the point of connection at now, integrating the previous
+// interval into the energy registers
+func (g *GridMeter) update(now time.Time) {
+
+	kWh := g.RealPower / 1000 * now.Sub(g.lastUpdate).Hours()
+	g.lastUpdate = now
+	if kWh > 0 {
+		g.ImportKWh += kWh
+	} else {
+		g.ExportKWh -= kWh
+	}
+
+	injected := 0.0
+	if g.netPower != nil {
+		injected = g.netPower()
+	}
+	g.RealPower = round(g.siteLoad - injected)
+	g.ReactivePower = round(g.siteLoad * math.Tan(math.Acos(g.PowerFactor)))
+
+	perPhase := g.RealPower / float64(len(g.PhaseVolts))
+	for i := range g.PhaseVolts {
+		g.PhaseVolts[i] = round(g.config.NominalVolts*(1+g.voltDrift[i]) - perPhase*voltSag)
+	}
+}
@@ -0,0 +1,43 @@
+package things
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// TestGridMeterRegisters net power is the site load less what other things
+// inject, and energy lands in the import or export register by direction.
+func TestGridMeterRegisters(t *testing.T) {
+
+	cfg := DefaultGridConfig()
+	cfg.BaseLoad = 1000
+	grid := NewGridMeterConfig(1, cfg)
+
+	injected := 3000.0
+	grid.SetNetPower(func() float64 { return injected })
+	grid.update(grid.lastUpdate)
+	if grid.RealPower != -2000 {
+		t.Errorf("expected 2000 W export: %f", grid.RealPower)
+	}
+	if grid.NetWatts() != -1000 {
+		t.Errorf("expected the site load as a 1000 W load: %f", grid.NetWatts())
+	}
+
+	grid.update(grid.lastUpdate.Add(time.Hour))
+	if math.Abs(grid.ExportKWh-2) > 0.001 || grid.ImportKWh != 0 {
+		t.Errorf("expected 2 kWh exported: import %f export %f", grid.ImportKWh, grid.ExportKWh)
+	}
+
+	injected = 0
+	grid.update(grid.lastUpdate)
+	grid.update(grid.lastUpdate.Add(30 * time.Minute))
+	if math.Abs(grid.ImportKWh-0.5) > 0.001 {
+		t.Errorf("expected 0.5 kWh imported: %f", grid.ImportKWh)
+	}
+	for _, v := range grid.PhaseVolts {
+		if math.Abs(v-cfg.NominalVolts) > cfg.NominalVolts*voltLimit+1 {
+			t.Errorf("phase voltage too far from nominal: %f", v)
+		}
+	}
+}
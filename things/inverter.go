@@ -1,110 +1,341 @@
 package things
 
 import (
-	"reflect"
+	"math"
 	"sync"
-	"sync/atomic"
 	"time"
-
-	log "github.com/sirupsen/logrus"
 )
 
-// some general sane ranges. not of great value, more than a placeholder
-// erratic jumps with Random generator are absurd or maybe comical? but not the point of this challenge
+// output range of an Inverter, the load demand it follows, and the
+// insulation resistance of its DC side that trips a ground fault
 const (
-	invRandomDelayMin int     = 50    // least time delay 50ms
-	invRandomDelayMax int     = 2000  // most time delay 2s// Inverter minimal sample
-	minWatts          float64 = 10    // min watts
-	maxWatts          float64 = 10000 // max watts
+	invRandomDelayMin time.Duration = 50 * time.Millisecond   // least time delay 50ms
+	invRandomDelayMax time.Duration = 2000 * time.Millisecond // most time delay 2s
+	minWatts          float64       = 10                      // min watts
+	maxWatts          float64       = 10000                   // max watts
+
+	invACVolts     float64 = 240.0 // nominal AC output voltage
+	invDemandStep  float64 = 500.0 // max change of the load demand per emit, watts
+	invDemandLimit float64 = 1.2   // demand wanders up to this multiple of rated power, to exercise clipping
+
+	invInsulation       float64 = 2000.0 // insulation resistance of a healthy DC side, kilo ohms
+	invInsulationNoise  float64 = 50.0   // max change of the insulation resistance per emit
+	invInsulationPull   float64 = 0.02   // share of the gap to healthy recovered each emit
+	invFaultMin         float64 = 10.0   // insulation resistance after a drop, kilo ohms
+	invFaultMax         float64 = 80.0
+	invGroundFaultSet   float64 = 100.0 // kilo ohms
+	invGroundFaultClear float64 = 500.0 // kilo ohms
 )
 
+var invFaultChance = 0.002 // chance per emit that moisture drops the insulation
+
+// EfficiencyPoint efficiency of the inverter at a fraction of rated power
+type EfficiencyPoint struct {
+	Load       float64 // fraction of rated power 0.0 - 1.0
+	Efficiency float64 // 0.0 - 1.0
+}
+
+// InverterConfig ratings of an Inverter
+type InverterConfig struct {
+	RatedWatts float64           // AC output is clipped at this power in either direction
+	ACVolts    float64           // nominal AC voltage
+	DCVolts    float64           // DC bus voltage used when no battery is attached
+	Efficiency []EfficiencyPoint // load dependent efficiency curve, ascending Load
+
+	GroundFault AlarmRule // on the insulation resistance of the DC side, kilo ohms
+}
+
+// DefaultInverterConfig the inverter used when no configuration is given
+func DefaultInverterConfig() InverterConfig {
+	return InverterConfig{
+		RatedWatts: maxWatts,
+		ACVolts:    invACVolts,
+		DCVolts:    (minVolts + maxVolts) / 2,
+		Efficiency: []EfficiencyPoint{
+			{Load: 0.0, Efficiency: 0.80},
+			{Load: 0.05, Efficiency: 0.88},
+			{Load: 0.1, Efficiency: 0.93},
+			{Load: 0.2, Efficiency: 0.955},
+			{Load: 0.5, Efficiency: 0.965},
+			{Load: 1.0, Efficiency: 0.955},
+		},
+		GroundFault: AlarmRule{Code: AlarmGroundFault, Severity: SeverityCritical, Set: invGroundFaultSet, Clear: invGroundFaultClear},
+	}
+}
+
+// Inverter converts between a DC side, the attached BatteryPacks, and an AC side
+// serving a load. Discharging draws DC power of AC output over efficiency from
+// the batteries, charging delivers AC input times efficiency into them.
+// Watts and DCWatts are positive while discharging and negative while charging.
 type Inverter struct {
-	Watts float64 `json:"watts"` // live watt reading (or time buffer)
-	Volts float64 `json:"volts"` // live voltage source
-	State bool    `json:"state"` // state = [on, off] (very simple state)
+	Watts      float64  `json:"watts"`      // AC output watts
+	Volts      float64  `json:"volts"`      // DC bus voltage
+	State      bool     `json:"state"`      // state = [on, off] (very simple state)
+	DCWatts    float64  `json:"dc_watts"`   // DC input watts
+	ACVolts    float64  `json:"ac_volts"`   // AC output voltage
+	Efficiency float64  `json:"efficiency"` // conversion efficiency at the present load
+	Clipping   bool     `json:"clipping"`   // demand exceeded rated power
+	Batteries  []uint64 `json:"batteries"`  // CIDs of the attached battery packs
+	Insulation float64  `json:"insulation"` // insulation resistance of the DC side to ground, kilo ohms
+
+	Setpoint *float64 `json:"setpoint"` // AC watts held by command, nil follows the load
 
-	// TODO looks like common to Composition candidate
-	id          uint64        // non serializable id
-	createdTime time.Time     // time the object was created
-	stopC       chan struct{} // internal stopC interupt
-	evtCount    uint64        // number of events generated
+	config    InverterConfig
+	demand    float64        // AC power the load asks for
+	batteries []*BatteryPack // attached battery packs
+
+	base // mu also guards the model, batteries are attached concurrently
 }
 
-// NewInverter create a battery allocating configuration
+// NewInverter create an inverter with the DefaultInverterConfig
 // ID = cid  code challenge id. Increment ID created by supervisor unique to all things
 func NewInverter(ID uint64) Inverter {
+	return NewInverterConfig(ID, DefaultInverterConfig())
+}
+
+// NewInverterConfig create an inverter allocating configuration
+// ID = cid  code challenge id. Increment ID created by supervisor unique to all things
+// cfg = ratings of the inverter
+func NewInverterConfig(ID uint64, cfg InverterConfig) Inverter {
 
-	i := Inverter{id: ID, createdTime: time.Now(), stopC: make(chan struct{})}
-	i.generateRandomData()
+	i := Inverter{
+		base:       newBase(ID, "Inverter", UniformCadence(invRandomDelayMin, invRandomDelayMax)),
+		config:     cfg,
+		State:      true,
+		ACVolts:    cfg.ACVolts,
+		Volts:      cfg.DCVolts,
+		Batteries:  make([]uint64, 0),
+		Insulation: invInsulation,
+	}
+	i.update(i.createdTime)
 	return i
 }
 
+// Attach connect a battery pack to the DC side. Power is shared evenly between
+// all attached packs.
+func (i *Inverter) Attach(b *BatteryPack) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for _, attached := range i.batteries {
+		if attached == b {
+			return
+		}
+	}
+	i.batteries = append(i.batteries, b)
+	i.Batteries = append(i.Batteries, b.id)
+}
+
+// Detach disconnect a battery pack from the DC side
+func (i *Inverter) Detach(b *BatteryPack) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for n, attached := range i.batteries {
+		if attached == b {
+			i.batteries = append(i.batteries[:n], i.batteries[n+1:]...)
+			i.Batteries = append(i.Batteries[:n], i.Batteries[n+1:]...)
+			b.release(i.id)
+			return
+		}
+	}
+}
+
 // Emit implements thing interface to send events over Channel
 // c = channel writer for all events
 // wg = waitgroup needs to know when we are done with channel
-// CANDIDATE for Composition -
-// had to use pointer reference since incrementing evtCount
 func (i *Inverter) Emit(c chan<- ThingEvent, wg *sync.WaitGroup) {
 
-	defer wg.Done() // tell the listener we are done
-	wg.Add(1)
-	randomTime := RInt(invRandomDelayMin, invRandomDelayMax)
-	delay := time.Duration(randomTime) * time.Millisecond
+	i.run(c, wg, i.sample)
 
-	if c == nil {
-		log.Error(errChannelIsNil)
-		return
+	// a stopped inverter no longer moves current
+	i.mu.Lock()
+	for _, b := range i.batteries {
+		b.release(i.id)
+	}
+	i.mu.Unlock()
+}
+
+// sample advance the model to now, pushing current into the batteries, and
+// copy it for the event
+func (i *Inverter) sample(now time.Time) interface{} {
+	i.stepDemand()
+	i.stepInsulation()
+	i.checkAlarm(i.config.GroundFault, i.Insulation, now)
+	i.update(now)
+	return i.snapshot()
+}
+
+// Control implements Controllable
+// state = on|off, setpoint = AC watts, positive discharges the batteries and
+// negative charges them, or auto to follow the load again
+func (i *Inverter) Control(cmd Command) Ack {
+	return i.control(cmd, i.apply)
+}
+
+// apply a command with the lock held
+func (i *Inverter) apply(cmd Command) error {
+	switch cmd.Name {
+	case "state":
+		on, err := parseOnOff(cmd.Value)
+		if err != nil {
+			return err
+		}
+		i.State = on
+	case "setpoint":
+		if cmd.Value == cmdAuto {
+			i.Setpoint = nil
+			return nil
+		}
+		limit := i.config.RatedWatts * invDemandLimit
+		v, err := parseRange(cmd.Value, -limit, limit)
+		if err != nil {
+			return err
+		}
+		i.Setpoint = &v
+	default:
+		return errUnknownCommand
 	}
+	return nil
+}
 
-	thingType := reflect.TypeOf(*i)
-EMIT:
-	// Begin start lifecycle of thing
-	for {
-		select {
+// inverterState model of an Inverter in a ThingState
+type inverterState struct {
+	Inverter *Inverter      `json:"inverter"`
+	Config   InverterConfig `json:"config"`
+	Demand   float64        `json:"demand"`
+}
 
-		// simulate non-deterministic timing
-		case <-time.After(delay):
+// Snapshot implements Snapshotter, the attached battery packs are saved as
+// Attached
+func (i *Inverter) Snapshot() (ThingState, error) {
+	defer i.mu.Unlock()
+	i.mu.Lock()
 
-			// generate random data
-			i.generateRandomData()
+	state, err := i.saveState(inverterState{Inverter: i, Config: i.config, Demand: i.demand})
+	state.Attached = append([]uint64(nil), i.Batteries...)
+	return state, err
+}
 
-			// create new event
-			thingEvent := ThingEvent{
-				ThingID:   (*i).id,
-				TS:        time.Now(),
-				ThingType: thingType.Name(),
-				EventData: *i,
-			}
-			c <- thingEvent
-			atomic.AddUint64(&i.evtCount, 1)
+// Restore implements Snapshotter, the battery packs of Attached are attached
+// again by the caller
+func (i *Inverter) Restore(state ThingState) error {
+	defer i.mu.Unlock()
+	i.mu.Lock()
 
-		case <-i.stopC:
-			break EMIT
-		}
+	s := inverterState{Inverter: i}
+	if _, err := i.restoreState(state, &s); err != nil {
+		return err
+	}
+	i.config = s.Config
+	i.demand = s.Demand
+	i.Batteries = make([]uint64, 0)
+	return nil
+}
+
+// NetWatts implements PowerFlow, AC output is positive while discharging
+func (i *Inverter) NetWatts() float64 {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.Watts
+}
 
-		// reset another random time, each time through loop
-		randomTime := RInt(invRandomDelayMin, invRandomDelayMax)
-		delay = time.Duration(randomTime) * time.Millisecond
+// EnergyRole implements PowerFlow, the inverter is the AC side of its batteries
+func (i *Inverter) EnergyRole() EnergyRole {
+	return RoleStorage
+}
+
+// stepDemand random walk of the AC load, positive asks for power from the
+// batteries and negative offers power to charge them
+func (i *Inverter) stepDemand() {
+	if i.Setpoint != nil {
+		i.demand = *i.Setpoint
+		return
 	}
-	log.Debugf("exiting battery pack: %d", i.id)
+	limit := i.config.RatedWatts * invDemandLimit
+	i.demand = clamp(i.demand+i.rng.RFloat(-invDemandStep, invDemandStep), -limit, limit)
 }
 
-// ShortD used to give brief data reprentation of this thing. implemnted from things.Thing
-func (i Inverter) ShortD() CID {
-	return CID{CidNumber: i.id, Type: reflect.TypeOf(i).Name(), CreateTime: i.createdTime, TTLEvents: atomic.LoadUint64(&i.evtCount)}
+// stepInsulation insulation resistance wanders near healthy, now and then
+// moisture drops it and it dries out again over the following emits
+func (i *Inverter) stepInsulation() {
+	if i.rng.RFloat(0, 1) < invFaultChance {
+		i.Insulation = round(i.rng.RFloat(invFaultMin, invFaultMax))
+		return
+	}
+	pull := (invInsulation - i.Insulation) * invInsulationPull
+	i.Insulation = round(math.Max(i.Insulation+pull+i.rng.RFloat(-invInsulationNoise, invInsulationNoise), 0))
 }
 
-// Stop start shutdown sequence
-func (i Inverter) Stop() {
-	i.stopC <- ZeroStruct
+// update convert the demand into AC and DC power at now, and push the DC
+// current into the attached batteries. A battery that can't take the current
+// (empty or full) cuts the power it was to supply. A ground fault trips the
+// inverter until it clears.
+func (i *Inverter) update(now time.Time) {
+
+	on := i.State && !i.alarmActive(AlarmGroundFault)
+	ac := 0.0
+	if on {
+		ac = clamp(i.demand, -i.config.RatedWatts, i.config.RatedWatts)
+	}
+	i.Clipping = on && math.Abs(i.demand) > i.config.RatedWatts
+	i.Efficiency = round(i.efficiency(math.Abs(ac) / i.config.RatedWatts))
+
+	dc := ac / i.Efficiency
+	if ac < 0 {
+		dc = ac * i.Efficiency
+	}
+
+	if len(i.batteries) > 0 {
+		// share the DC power evenly, each pack takes what it can at its own voltage
+		share := dc / float64(len(i.batteries))
+		dc, i.Volts = 0, 0
+		for _, b := range i.batteries {
+			volts := b.Voltage()
+			amps := b.draw(i.id, share/volts, now)
+			dc += amps * volts
+			i.Volts += volts
+		}
+		i.Volts /= float64(len(i.batteries))
+
+		ac = dc * i.Efficiency
+		if dc < 0 {
+			ac = dc / i.Efficiency
+		}
+	}
+
+	i.DCWatts = round(dc)
+	i.Watts = round(ac)
+	i.Volts = round(i.Volts)
 }
 
-// generateRandomData just create erratic random data
-// TODO model behaivor more realistic
-func (i *Inverter) generateRandomData() {
+// efficiency interpolate the efficiency curve at load, a fraction of rated power
+func (i *Inverter) efficiency(load float64) float64 {
 
-	i.Watts = RFloat(minWatts, maxWatts)
-	i.Volts = RFloat(minVolts, maxVolts)
-	i.State = bool(!(RInt(0, 2) == 0)) // not == 0 then true
+	curve := i.config.Efficiency
+	if len(curve) == 0 {
+		return 1
+	}
+	if load <= curve[0].Load {
+		return curve[0].Efficiency
+	}
+	for n := 1; n < len(curve); n++ {
+		if load <= curve[n].Load {
+			lo, hi := curve[n-1], curve[n]
+			return lo.Efficiency + (hi.Efficiency-lo.Efficiency)*(load-lo.Load)/(hi.Load-lo.Load)
+		}
+	}
+	return curve[len(curve)-1].Efficiency
+}
 
+// snapshot copy of the inverter safe to hand to the listener
+func (i *Inverter) snapshot() Inverter {
+	c := *i
+	if i.Setpoint != nil {
+		setpoint := *i.Setpoint
+		c.Setpoint = &setpoint
+	}
+	c.Batteries = make([]uint64, len(i.Batteries))
+	copy(c.Batteries, i.Batteries)
+	return c
 }
@@ -0,0 +1,50 @@
+package things
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// TestInverterEnergyBalance DC power drawn from the attached batteries must
+// match AC output over efficiency, and the batteries must carry the current.
+func TestInverterEnergyBalance(t *testing.T) {
+
+	battery1 := NewBatteryPack(1)
+	battery2 := NewBatteryPack(2)
+	inverter := NewInverter(3)
+	inverter.Attach(&battery1)
+	inverter.Attach(&battery2)
+
+	inverter.demand = 5000
+	inverter.update(time.Now())
+
+	if math.Abs(inverter.Watts-inverter.DCWatts*inverter.Efficiency) > 0.01 {
+		t.Errorf("AC watts %f do not match DC watts %f at efficiency %f", inverter.Watts, inverter.DCWatts, inverter.Efficiency)
+	}
+
+	battWatts := battery1.AmpMeter.LiveAmps*battery1.Voltage() + battery2.AmpMeter.LiveAmps*battery2.Voltage()
+	if battery1.AmpMeter.LiveAmps <= 0 || battery2.AmpMeter.LiveAmps <= 0 {
+		t.Errorf("batteries should discharge: %f %f", battery1.AmpMeter.LiveAmps, battery2.AmpMeter.LiveAmps)
+	}
+	// pack voltage sags once the current flows, allow for it
+	if math.Abs(battWatts-inverter.DCWatts)/inverter.DCWatts > 0.02 {
+		t.Errorf("battery watts %f do not match DC watts %f", battWatts, inverter.DCWatts)
+	}
+
+	// demand beyond rating is clipped
+	inverter.demand = -2 * inverter.config.RatedWatts
+	inverter.update(time.Now())
+	if !inverter.Clipping || inverter.Watts < -inverter.config.RatedWatts {
+		t.Errorf("expected clipping at rated power: %f", inverter.Watts)
+	}
+	if battery1.AmpMeter.LiveAmps >= 0 {
+		t.Errorf("battery should charge: %f", battery1.AmpMeter.LiveAmps)
+	}
+
+	// detached batteries no longer carry current
+	inverter.Detach(&battery1)
+	if battery1.AmpMeter.LiveAmps != 0 {
+		t.Errorf("detached battery still carries current: %f", battery1.AmpMeter.LiveAmps)
+	}
+}
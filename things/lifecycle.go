@@ -0,0 +1,129 @@
+package things
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// State lifecycle state of a thing
+type State int32
+
+// lifecycle states
+const (
+	StateCreated State = iota + 1 // built, not emitting yet
+	StateRunning                  // emitting events
+	StatePaused                   // silent, keeps its model and event count
+	StateFaulted                  // emitting with a critical alarm active
+	StateStopped                  // emit loop has exited
+)
+
+var (
+	errNotRunning = errors.New("thing is not running")
+	errNotPaused  = errors.New("thing is not paused")
+)
+
+// String name of the state
+func (s State) String() string {
+	switch s {
+	case StateCreated:
+		return "created"
+	case StateRunning:
+		return "running"
+	case StatePaused:
+		return "paused"
+	case StateFaulted:
+		return "faulted"
+	case StateStopped:
+		return "stopped"
+	}
+	return "unknown"
+}
+
+// MarshalText state is published by name
+func (s State) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Transition payload of a KindLifecycle event
+type Transition struct {
+	From State `json:"from"`
+	To   State `json:"to"`
+}
+
+// Pausable implemented by things that can go silent and come back as they were
+type Pausable interface {
+	Pause() error
+	Resume() error
+}
+
+// Pause implements Pausable, the thing stops emitting until Resume. A running
+// or faulted thing can be paused.
+func (b *base) Pause() error {
+	b.mu.Lock()
+	state := b.lifecycle()
+	if state != StateRunning && state != StateFaulted {
+		b.mu.Unlock()
+		return errNotRunning
+	}
+	b.setState(StatePaused)
+	b.mu.Unlock()
+
+	b.wake()
+	return nil
+}
+
+// Resume implements Pausable, the thing picks up where it paused
+func (b *base) Resume() error {
+	b.mu.Lock()
+	if b.lifecycle() != StatePaused {
+		b.mu.Unlock()
+		return errNotPaused
+	}
+	b.setState(b.activeState())
+	b.mu.Unlock()
+
+	b.wake()
+	return nil
+}
+
+// lifecycle state of the thing, safe without the lock
+func (b *base) lifecycle() State {
+	return State(atomic.LoadInt32(&b.state))
+}
+
+// setState move to a state and queue the transition, call with the lock held
+func (b *base) setState(to State) {
+	from := b.lifecycle()
+	if from == to {
+		return
+	}
+	atomic.StoreInt32(&b.state, int32(to))
+	b.queue(KindLifecycle, Transition{From: from, To: to})
+}
+
+// activeState running, or faulted while a critical alarm is active. Call with
+// the lock held.
+func (b *base) activeState() State {
+	for _, a := range b.alarms {
+		if a.Severity == SeverityCritical {
+			return StateFaulted
+		}
+	}
+	return StateRunning
+}
+
+// updateFaulted follow the critical alarms between running and faulted, call
+// with the lock held
+func (b *base) updateFaulted() {
+	if state := b.lifecycle(); state == StateRunning || state == StateFaulted {
+		b.setState(b.activeState())
+	}
+}
+
+// wake the emit loop to send a transition now
+func (b *base) wake() {
+	select {
+	case b.wakeC <- ZeroStruct:
+	default: // already woken
+	}
+}
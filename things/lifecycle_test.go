@@ -0,0 +1,90 @@
+package things
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestPauseResume a paused thing goes silent and comes back with its count,
+// and every transition is in the event stream.
+func TestPauseResume(t *testing.T) {
+
+	defer noRandomFaults()()
+	light := NewLight(1)
+	light.Control(Command{Name: "interval", Value: "1ms"})
+	if light.ShortD().State != StateCreated {
+		t.Errorf("expected created: %s", light.ShortD().State)
+	}
+
+	c := make(chan ThingEvent, 100)
+	var wg sync.WaitGroup
+	go light.Emit(c, &wg)
+
+	// next transition, skipping telemetry
+	next := func() Transition {
+		for {
+			select {
+			case e := <-c:
+				if e.Kind == KindLifecycle {
+					return e.EventData.(Transition)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("no transition")
+			}
+		}
+	}
+	expect := func(from, to State) {
+		if tr := next(); tr.From != from || tr.To != to {
+			t.Errorf("expected %s to %s: %s to %s", from, to, tr.From, tr.To)
+		}
+	}
+
+	expect(StateCreated, StateRunning)
+	if err := light.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	expect(StateRunning, StatePaused)
+	if err := light.Pause(); err == nil {
+		t.Error("expected a paused thing to refuse another pause")
+	}
+
+	count := light.ShortD().TTLEvents
+	time.Sleep(20 * time.Millisecond)
+	if len(c) != 0 || light.ShortD().TTLEvents != count {
+		t.Errorf("expected no events while paused: %d", len(c))
+	}
+
+	if err := light.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	expect(StatePaused, StateRunning)
+	if e := <-c; e.Kind != KindTelemetry || light.ShortD().TTLEvents <= count {
+		t.Errorf("expected telemetry to carry on counting: %s %d", e.Kind, light.ShortD().TTLEvents)
+	}
+
+	light.Stop()
+	expect(StateRunning, StateStopped)
+	wg.Wait()
+	if light.ShortD().State != StateStopped {
+		t.Errorf("expected stopped: %s", light.ShortD().State)
+	}
+}
+
+// TestFaulted a critical alarm faults a running thing until it clears
+func TestFaulted(t *testing.T) {
+
+	defer noRandomFaults()()
+	inverter := NewInverter(1)
+	inverter.state = int32(StateRunning)
+
+	inverter.Control(Command{Name: "fault", Value: string(AlarmGroundFault)})
+	if inverter.lifecycle() != StateFaulted {
+		t.Errorf("expected faulted: %s", inverter.lifecycle())
+	}
+	inverter.Control(Command{Name: "fault", Value: string(AlarmDriverFailure)}) // major only
+	inverter.Control(Command{Name: "clear", Value: string(AlarmGroundFault)})
+	if inverter.lifecycle() != StateRunning {
+		t.Errorf("expected running once the critical alarm cleared: %s", inverter.lifecycle())
+	}
+}
@@ -1,43 +1,61 @@
 package things
 
 import (
-	"reflect"
+	"errors"
 	"sync"
-	"sync/atomic"
 	"time"
-
-	log "github.com/sirupsen/logrus"
 )
 
 // some general sane ranges. not of great value, more than a placeholder
 // erratic jumps with Random generator are absurd or maybe comical? but not the point of this challenge
 const (
-	lRandomDelayMin int = 1000 // least time delay 1ms
-	lRandomDelayMax int = 3000 // most time delay 3s
-	minCCT          int = 2000 // min ColorSpectrum
-	maxCCT          int = 6000 // max ColorSpectrum
-	minLL           int = 0    // min LightLevel
-	maxLL           int = 100  // max LightLevel
+	lRandomDelayMin time.Duration = 1000 * time.Millisecond // least time delay 1s
+	lRandomDelayMax time.Duration = 3000 * time.Millisecond // most time delay 3s
+	minCCT          int           = 2000                    // min ColorSpectrum
+	maxCCT          int           = 6000                    // max ColorSpectrum
+	minLL           int           = 0                       // min LightLevel
+	maxLL           int           = 100                     // max LightLevel
+
+	lRatedWatts float64 = 60 // draw of a light on at full level
 )
 
+var errDriverFailed = errors.New("driver failed, reset it first")
+
+// LightConfig behaviour of a Light
+type LightConfig struct {
+	DriverFailChance float64 // chance per emit the LED driver fails, latched until reset
+}
+
+// DefaultLightConfig the light used when no configuration is given, its driver
+// only fails when a fault is injected
+func DefaultLightConfig() LightConfig {
+	return LightConfig{}
+}
+
 // Light defines a luminaire
 type Light struct {
 	LightLevel    byte  `json:"light_level"`    // live watt reading (or time buffer)
 	ColorSpectrum int16 `json:"color_spectrum"` // color spectrum 2000-6000 CCT
 	State         bool  `json:"state"`          // state = [on, off] (very simple state)
+	Manual        bool  `json:"manual"`         // held by commands, random data paused
+
+	config LightConfig
 
-	// TODO looks like common to Composition candidate
-	id          uint64        // non serializable id
-	createdTime time.Time     // time the object was created
-	stopC       chan struct{} // internal stopC interupt
-	evtCount    uint64        // number of events generated
+	base
 }
 
-// NewLight create a battery allocating configuration
+// NewLight create a light with the DefaultLightConfig
 // ID = cid  code challenge id. Increment ID created by supervisor unique to all things
 func NewLight(ID uint64) Light {
+	return NewLightConfig(ID, DefaultLightConfig())
+}
+
+// NewLightConfig create a light allocating configuration
+// ID = cid  code challenge id. Increment ID created by supervisor unique to all things
+// cfg = behaviour of the light
+func NewLightConfig(ID uint64, cfg LightConfig) Light {
 
-	l := Light{id: ID, createdTime: time.Now(), stopC: make(chan struct{})}
+	l := Light{base: newBase(ID, "Light", UniformCadence(lRandomDelayMin, lRandomDelayMax)), config: cfg}
 	l.generateRandomData()
 	return l
 }
@@ -45,67 +63,126 @@ func NewLight(ID uint64) Light {
 // Emit implements thing interface to send events over Channel
 // c = channel writer for all events
 // wg = waitgroup needs to know when we are done with channel
-// CANDIDATE for Composition
 func (l *Light) Emit(c chan<- ThingEvent, wg *sync.WaitGroup) {
+	l.run(c, wg, l.sample)
+}
 
-	defer wg.Done() // tell the listener we are done
-	wg.Add(1)
-
-	if c == nil {
-		log.Error(errChannelIsNil)
-		return
+// sample generate the next reading and copy it for the event. A failed
+// driver holds the light dark until it is reset.
+func (l *Light) sample(now time.Time) interface{} {
+	if !l.Manual {
+		l.generateRandomData()
+	}
+	if l.config.DriverFailChance > 0 && l.rng.RFloat(0, 1) < l.config.DriverFailChance {
+		l.raiseAlarm(AlarmDriverFailure, SeverityMajor, 0, 0, now)
+	}
+	if l.alarmActive(AlarmDriverFailure) {
+		l.State = false
+		l.LightLevel = 0
 	}
+	return *l
+}
+
+// Control implements Controllable. Setting level, cct or state holds the light
+// in manual until mode auto hands it back to the random data.
+// level = 0-100, cct = 2000-6000, state = on|off, mode = auto|manual,
+// reset = clear a failed driver
+func (l *Light) Control(cmd Command) Ack {
+	return l.control(cmd, l.apply)
+}
 
-	thingType := reflect.TypeOf(*l)
-
-	randomTime := RInt(lRandomDelayMin, lRandomDelayMax)
-	delay := time.Duration(randomTime) * time.Millisecond
-
-EMIT:
-	// Begin start lifecycle of thing
-	for {
-		select {
-		case <-time.After(delay):
-
-			// generate random data
-			l.generateRandomData()
-
-			// create new event
-			thingEvent := ThingEvent{
-				ThingID:   l.id,
-				TS:        time.Now(),
-				ThingType: thingType.Name(),
-				EventData: *l,
-			}
-			c <- thingEvent
-			atomic.AddUint64(&l.evtCount, 1)
-		case <-l.stopC:
-			break EMIT
+// apply a command with the lock held
+func (l *Light) apply(cmd Command) error {
+	if l.alarmActive(AlarmDriverFailure) && (cmd.Name == "level" || cmd.Name == "state") {
+		return errDriverFailed
+	}
+	switch cmd.Name {
+	case "level":
+		v, err := parseRange(cmd.Value, float64(minLL), float64(maxLL))
+		if err != nil {
+			return err
+		}
+		l.LightLevel = byte(v)
+	case "cct":
+		v, err := parseRange(cmd.Value, float64(minCCT), float64(maxCCT))
+		if err != nil {
+			return err
+		}
+		l.ColorSpectrum = int16(v)
+	case "state":
+		on, err := parseOnOff(cmd.Value)
+		if err != nil {
+			return err
+		}
+		l.State = on
+	case "mode":
+		switch cmd.Value {
+		case cmdAuto:
+			l.Manual = false
+		case "manual":
+			l.Manual = true
+		default:
+			return errors.New("mode must be auto or manual")
 		}
+		return nil
+	case "reset":
+		delete(l.faults, AlarmDriverFailure)
+		l.clearAlarm(AlarmDriverFailure, 0, 0)
+		return nil
+	default:
+		return errUnknownCommand
+	}
+	l.Manual = true
+	return nil
+}
+
+// lightState model of a Light in a ThingState, the fields of the light at the
+// top as saved before it had a configuration
+type lightState struct {
+	*Light
+	Config LightConfig `json:"config"`
+}
 
-		// reset another random time, each time through loop
-		randomTime := RInt(lRandomDelayMin, lRandomDelayMax)
-		delay = time.Duration(randomTime) * time.Millisecond
+// Snapshot implements Snapshotter
+func (l *Light) Snapshot() (ThingState, error) {
+	defer l.mu.Unlock()
+	l.mu.Lock()
+	return l.saveState(lightState{Light: l, Config: l.config})
+}
+
+// Restore implements Snapshotter
+func (l *Light) Restore(state ThingState) error {
+	defer l.mu.Unlock()
+	l.mu.Lock()
+	s := lightState{Light: l}
+	if _, err := l.restoreState(state, &s); err != nil {
+		return err
 	}
-	log.Debugf("exiting battery pack: %d", l.id)
+	l.config = s.Config
+	return nil
 }
 
-// ShortD used to give brief data reprentation of this thing. implemnted from things.Thing
-func (l Light) ShortD() CID {
-	return CID{CidNumber: l.id, Type: reflect.TypeOf(l).Name(), CreateTime: l.createdTime, TTLEvents: atomic.LoadUint64(&l.evtCount)}
+// NetWatts implements PowerFlow, a light on draws power in proportion to its level
+func (l *Light) NetWatts() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.State {
+		return 0
+	}
+	return -lRatedWatts * float64(l.LightLevel) / float64(maxLL)
 }
 
-// Stop break Emit loop
-func (l Light) Stop() {
-	l.stopC <- ZeroStruct
+// EnergyRole implements PowerFlow
+func (l *Light) EnergyRole() EnergyRole {
+	return RoleLoad
 }
 
 // generateRandomData just create erratic random data
 // TODO model behaivor more realistic
 func (l *Light) generateRandomData() {
 
-	l.LightLevel = byte(RInt(minLL, maxLL))
-	l.ColorSpectrum = int16(RInt(minCCT, maxCCT))
-	l.State = bool(!(RInt(0, 2) == 0)) // not == 0 then true
+	l.LightLevel = byte(l.rng.RInt(minLL, maxLL))
+	l.ColorSpectrum = int16(l.rng.RInt(minCCT, maxCCT))
+	l.State = bool(!(l.rng.RInt(0, 2) == 0)) // not == 0 then true
 
 }
@@ -0,0 +1,78 @@
+package things
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// streams of random numbers derived for each thing. Values and timing draw from
+// separate streams, so the values a thing produces don't depend on when the
+// scheduler happened to run it.
+const (
+	streamValues uint64 = iota + 1
+	streamTiming
+)
+
+var (
+	seedLock sync.Mutex
+	runSeed  = time.Now().UnixNano() // seed of the run, see SetSeed
+)
+
+// SetSeed seed the run. Every thing derives its own generators from the seed
+// and its CID, so the same seed and fleet produce the same values per thing.
+// Set it before creating things, those already running keep their generators.
+func SetSeed(seed int64) {
+	defer seedLock.Unlock()
+	seedLock.Lock()
+	runSeed = seed
+	rnLock.Lock()
+	rn = rand.New(rand.NewSource(seed))
+	rnLock.Unlock()
+}
+
+// Seed seed of the run, log it to reproduce a run later
+func Seed() int64 {
+	defer seedLock.Unlock()
+	seedLock.Lock()
+	return runSeed
+}
+
+// rng random generator owned by a single thing, not safe for concurrent use
+type rng struct {
+	*rand.Rand
+}
+
+// newRng generator for one stream of a thing, derived from the run seed and
+// the thing CID
+func newRng(ID, stream uint64) rng {
+	s := uint64(Seed())
+	s = splitmix(s ^ splitmix(ID) ^ splitmix(stream<<32))
+	return rng{rand.New(rand.NewSource(int64(s)))}
+}
+
+// RFloat same as the package RFloat, from this generator
+func (r rng) RFloat(min, max float64) float64 {
+	v := min + r.Float64()*(max-min)
+	return math.Round(v*precision) / precision
+}
+
+// RInt same as the package RInt, from this generator
+func (r rng) RInt(min, max int) int {
+	return r.Intn(max-min) + min
+}
+
+// expDuration exponentially distributed duration with the given mean, the gap
+// between independent random arrivals
+func (r rng) expDuration(mean time.Duration) time.Duration {
+	return time.Duration(r.ExpFloat64() * float64(mean))
+}
+
+// splitmix64 finalizer, spreads nearby seeds and CIDs over unrelated states
+func splitmix(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
@@ -0,0 +1,115 @@
+package things
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+var (
+	registryLock sync.RWMutex
+	registry     []TypeInfo // indexed by ThingType - 1
+
+	errNoThingType = errors.New("no thing type registered")
+)
+
+// Factory creates a thing of a registered type
+// ID = cid  code challenge id. Increment ID created by supervisor unique to all things
+type Factory func(ID uint64) Thing
+
+// TypeInfo a thing type in the registry
+type TypeInfo struct {
+	Type      ThingType // handle returned by Register
+	Name      string    // matches CID.Type and ThingEvent.ThingType of its things
+	ShortCode string    // used by the console to pick the type
+	Factory   Factory   // creates things of the type
+}
+
+// Register add a thing type so the supervisor and console can create, list
+// and stop things of it. Packages outside of things register their own types
+// from an init func. Like sql.Register it panics if the name or short code is
+// already taken, or factory is nil.
+func Register(name, shortCode string, factory Factory) ThingType {
+
+	defer registryLock.Unlock()
+	registryLock.Lock()
+
+	if factory == nil {
+		panic("things: Register factory is nil for " + name)
+	}
+	for _, info := range registry {
+		if info.Name == name || strings.EqualFold(info.ShortCode, shortCode) {
+			panic(fmt.Sprintf("things: Register called twice for %s (%s)", name, shortCode))
+		}
+	}
+
+	tt := ThingType(len(registry) + 1)
+	registry = append(registry, TypeInfo{Type: tt, Name: name, ShortCode: shortCode, Factory: factory})
+	return tt
+}
+
+// Types all registered thing types in the order they were registered
+func Types() []TypeInfo {
+	defer registryLock.RUnlock()
+	registryLock.RLock()
+
+	types := make([]TypeInfo, len(registry))
+	copy(types, registry)
+	return types
+}
+
+// LookupName registered thing type by name
+func LookupName(name string) (TypeInfo, bool) {
+	defer registryLock.RUnlock()
+	registryLock.RLock()
+
+	for _, info := range registry {
+		if info.Name == name {
+			return info, true
+		}
+	}
+	return TypeInfo{}, false
+}
+
+// LookupCode registered thing type by short code, any case
+func LookupCode(shortCode string) (TypeInfo, bool) {
+	defer registryLock.RUnlock()
+	registryLock.RLock()
+
+	for _, info := range registry {
+		if strings.EqualFold(info.ShortCode, shortCode) {
+			return info, true
+		}
+	}
+	return TypeInfo{}, false
+}
+
+// Info registry entry of the thing type
+func (tt ThingType) Info() (TypeInfo, bool) {
+	defer registryLock.RUnlock()
+	registryLock.RLock()
+
+	if tt == 0 || int(tt) > len(registry) {
+		return TypeInfo{}, false
+	}
+	return registry[tt-1], true
+}
+
+// String name the thing type was registered with
+func (tt ThingType) String() string {
+	info, ok := tt.Info()
+	if !ok {
+		return fmt.Sprintf("ThingType(%d)", tt)
+	}
+	return info.Name
+}
+
+// New create a thing of a registered type
+func New(tt ThingType, ID uint64) (Thing, error) {
+	info, ok := tt.Info()
+	if !ok {
+		return nil, errNoThingType
+	}
+	return info.Factory(ID), nil
+}
@@ -0,0 +1,54 @@
+package things
+
+import (
+	"testing"
+)
+
+// unregister remove the thing type registered last, so a test can register
+// its own and leave the registry as it found it. ThingTypes index the
+// registry, so an earlier type can't be removed.
+func unregister(tt ThingType) {
+	defer registryLock.Unlock()
+	registryLock.Lock()
+	if int(tt) == len(registry) {
+		registry = registry[:len(registry)-1]
+	}
+}
+
+// TestRegister a custom type registered from outside the built ins can be
+// looked up and created like any other, and names can't be taken twice.
+func TestRegister(t *testing.T) {
+
+	tt := Register("TestLight", "tl", func(ID uint64) Thing {
+		l := Light{base: newBase(ID, "TestLight", UniformCadence(lRandomDelayMin, lRandomDelayMax))}
+		l.generateRandomData()
+		return &l
+	})
+	t.Cleanup(func() { unregister(tt) })
+
+	info, ok := LookupCode("TL")
+	if !ok || info.Type != tt || info.Name != "TestLight" || tt.String() != "TestLight" {
+		t.Fatalf("registered type not found by short code: %+v", info)
+	}
+	if info, ok := LookupName("BatteryPack"); !ok || info.Type != TBatteryPack {
+		t.Errorf("built in type not found by name: %+v", info)
+	}
+
+	thing, err := New(tt, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cid := thing.ShortD(); cid.CidNumber != 42 || cid.Type != tt.String() {
+		t.Errorf("factory did not make a TestLight 42: %+v", cid)
+	}
+	if _, err := New(ThingType(0), 1); err == nil {
+		t.Error("expected an error creating an unregistered type")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic registering a taken short code")
+		}
+	}()
+	Register("Other", "b", func(ID uint64) Thing { return nil })
+}
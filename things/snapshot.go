@@ -0,0 +1,121 @@
+package things
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errStateType  = errors.New("saved state is of another thing type")
+	errStateCID   = errors.New("saved state is of another CID")
+	errStateModel = errors.New("saved model does not fit the configuration")
+)
+
+// ThingState saved state of a thing, enough to create it again in a later run
+// with the same CID and carry on from where it was
+type ThingState struct {
+	Type      string          `json:"type"`               // name of the thing type in the registry
+	CID       uint64          `json:"cid"`                // CID of the thing
+	Created   time.Time       `json:"created"`            // time the thing was first created
+	Events    uint64          `json:"events"`             // events published so far
+	Saved     time.Time       `json:"saved"`              // clock time the state was saved
+	Cadence   Cadence         `json:"cadence"`            // time between events
+	Exception Exception       `json:"exception"`          // report by exception settings
+	Alarms    []Alarm         `json:"alarms,omitempty"`   // alarms active when saved
+	Faults    []AlarmCode     `json:"faults,omitempty"`   // injected faults held active
+	Attached  []uint64        `json:"attached,omitempty"` // CIDs of the things attached to it
+	Model     json.RawMessage `json:"model"`              // model and configuration of the thing type
+}
+
+// Snapshotter implemented by things whose state can be saved and restored.
+// Restore is called on a new thing of the same type and CID, before it
+// emits. Times of the model move on by the time between Saved and now, so a
+// restored thing doesn't see the run down time as elapsed. The random
+// streams of the thing are derived again from the seed, CID and event count.
+type Snapshotter interface {
+	Snapshot() (ThingState, error)
+	Restore(ThingState) error
+}
+
+// saveState state of the thing with model as its Model, call with the lock held
+func (b *base) saveState(model interface{}) (ThingState, error) {
+
+	raw, err := json.Marshal(model)
+	if err != nil {
+		return ThingState{}, err
+	}
+	s := ThingState{
+		Type:      b.thingType,
+		CID:       b.id,
+		Created:   b.createdTime,
+		Events:    atomic.LoadUint64(&b.evtCount),
+		Saved:     b.clock.Now(),
+		Cadence:   b.cadence,
+		Exception: b.exception,
+		Model:     raw,
+	}
+	for _, a := range b.alarms {
+		s.Alarms = append(s.Alarms, a)
+	}
+	sort.Slice(s.Alarms, func(i, j int) bool { return s.Alarms[i].Code < s.Alarms[j].Code })
+	for code := range b.faults {
+		s.Faults = append(s.Faults, code)
+	}
+	sort.Slice(s.Faults, func(i, j int) bool { return s.Faults[i] < s.Faults[j] })
+	return s, nil
+}
+
+// restoreState restore the state common to all things and decode the Model
+// into model. Returns how far the clock moved on since the state was saved.
+// Call with the lock held.
+func (b *base) restoreState(s ThingState, model interface{}) (time.Duration, error) {
+
+	switch {
+	case s.Type != b.thingType:
+		return 0, errStateType
+	case s.CID != b.id:
+		return 0, errStateCID
+	}
+	if err := s.Cadence.Validate(); err != nil {
+		return 0, err
+	}
+	if err := s.Exception.Validate(); err != nil {
+		return 0, err
+	}
+	if err := json.Unmarshal(s.Model, model); err != nil {
+		return 0, fmt.Errorf("%s %d: %s", s.Type, s.CID, err)
+	}
+
+	b.createdTime = s.Created
+	atomic.StoreUint64(&b.evtCount, s.Events)
+	b.cadence = s.Cadence
+	b.exception = s.Exception
+	if b.exception.Deadbands == nil {
+		b.exception.Deadbands = make(map[string]float64)
+	}
+	b.reported = report{}
+
+	b.alarms = make(map[AlarmCode]Alarm, len(s.Alarms))
+	for _, a := range s.Alarms {
+		b.alarms[a.Code] = a
+	}
+	atomic.StoreInt32(&b.alarmCount, int32(len(b.alarms)))
+	b.faults = make(map[AlarmCode]bool, len(s.Faults))
+	for _, code := range s.Faults {
+		b.faults[code] = true
+	}
+
+	// same seed and CID, but not the streams the thing started with
+	b.rng = newRng(b.id^splitmix(s.Events), streamValues)
+	b.timing = newRng(b.id^splitmix(s.Events), streamTiming)
+
+	var shift time.Duration
+	if !s.Saved.IsZero() {
+		shift = b.clock.Now().Sub(s.Saved)
+	}
+	return shift, nil
+}
@@ -0,0 +1,71 @@
+package things
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// TestSnapshotRestore every built in thing comes back from its saved state
+// with the same model, settings and alarms.
+func TestSnapshotRestore(t *testing.T) {
+
+	defer noRandomFaults()()
+	defer SetClock(GetClock())
+	now := time.Date(2020, 6, 21, 12, 0, 0, 0, time.UTC)
+	SetClock(NewAFAPClock(now)) // stands still, nothing to shift on restore
+	for _, info := range Types() {
+		thing, _ := New(info.Type, 7)
+		if _, ok := thing.(Snapshotter); !ok {
+			continue // registered by another test
+		}
+		thing.(Controllable).Control(Command{Name: "cadence", Value: "fixed:2s"})
+		thing.(Controllable).Control(Command{Name: "fault", Value: "test_fault"})
+		var sampled func(time.Time) interface{}
+		switch th := thing.(type) {
+		case *BatteryPack:
+			sampled = th.sample
+		case *Inverter:
+			sampled = th.sample
+		case *Light:
+			sampled = th.sample
+		case *SolarArray:
+			sampled = th.sample
+		case *GridMeter:
+			sampled = th.sample
+		case *EVCharger:
+			sampled = th.sample
+		}
+		for i := 1; i <= 5; i++ {
+			sampled(now.Add(time.Duration(i) * time.Minute))
+		}
+
+		saved, err := thing.(Snapshotter).Snapshot()
+		if err != nil {
+			t.Fatalf("%s: %s", info.Name, err)
+		}
+		raw, _ := json.Marshal(saved)
+		var state ThingState
+		if err := json.Unmarshal(raw, &state); err != nil {
+			t.Fatalf("%s: %s", info.Name, err)
+		}
+
+		restored, _ := New(info.Type, 7)
+		if err := restored.(Snapshotter).Restore(state); err != nil {
+			t.Fatalf("%s: %s", info.Name, err)
+		}
+		again, _ := restored.(Snapshotter).Snapshot()
+		again.Saved = state.Saved
+		if rawAgain, _ := json.Marshal(again); string(rawAgain) != string(raw) {
+			t.Errorf("%s: expected the restored state to match\n%s\n%s", info.Name, raw, rawAgain)
+		}
+		if restored.(Alarmed).ActiveAlarms()[0].Code != "test_fault" {
+			t.Errorf("%s: expected the held fault restored", info.Name)
+		}
+
+		other, _ := New(info.Type, 8)
+		if err := other.(Snapshotter).Restore(state); err != errStateCID {
+			t.Errorf("%s: expected another CID to be rejected: %v", info.Name, err)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package things
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// default site and panel ratings of a SolarArray, and the constants of its
+// irradiance, cell temperature and MPPT models
+const (
+	solarRandomDelayMin time.Duration = 1000 * time.Millisecond // least time delay 1s
+	solarRandomDelayMax time.Duration = 3000 * time.Millisecond // most time delay 3s
+
+	solarLatitude    float64 = 37.4    // degrees north
+	solarLongitude   float64 = -122.1  // degrees east, places solar noon
+	solarRatedWatts  float64 = 7600    // DC rating at STC
+	solarTempCoeff   float64 = -0.0037 // power per degree celcius above STC
+	solarCloudCover  float64 = 0.2     // mean fraction of irradiance blocked by clouds
+	solarCloudNoise  float64 = 0.05    // max change of cloud cover per emit
+	solarAmbientTemp float64 = 20.0    // celcius
+	solarVmp         float64 = 350.0   // max power point voltage at STC
+	solarMPPTStep    float64 = 2.0     // volts moved by the tracker per emit
+
+	stcIrradiance  float64 = 1000.0  // W/m2 at standard test conditions
+	stcTemp        float64 = 25.0    // celcius at standard test conditions
+	noctRise       float64 = 25.0    // NOCT 45c less 20c ambient, at 800 W/m2
+	noctIrradiance float64 = 800.0   // W/m2
+	vmpTempCoeff   float64 = -0.0035 // max power point voltage per degree celcius above STC
+	mppCurvature   float64 = 4.0     // power lost away from the max power point, (dV/Vmp)^2
+	cloudReversion float64 = 0.2     // pull of the cloud cover back to its mean per emit
+)
+
+// SolarConfig site and panel ratings of a SolarArray
+type SolarConfig struct {
+	Latitude    float64 // degrees, north positive
+	Longitude   float64 // degrees, east positive. Places solar noon in UTC
+	RatedWatts  float64 // DC output at 1000 W/m2 and 25c
+	TempCoeff   float64 // fraction of power per degree celcius above 25c, negative
+	CloudCover  float64 // mean fraction of irradiance blocked 0.0 - 1.0
+	CloudNoise  float64 // max change of the cloud cover per emit
+	AmbientTemp float64 // celcius
+	Vmp         float64 // max power point voltage at STC
+}
+
+// DefaultSolarConfig the array used when no configuration is given
+func DefaultSolarConfig() SolarConfig {
+	return SolarConfig{
+		Latitude:    solarLatitude,
+		Longitude:   solarLongitude,
+		RatedWatts:  solarRatedWatts,
+		TempCoeff:   solarTempCoeff,
+		CloudCover:  solarCloudCover,
+		CloudNoise:  solarCloudNoise,
+		AmbientTemp: solarAmbientTemp,
+		Vmp:         solarVmp,
+	}
+}
+
+// SolarArray PV array following a clear sky irradiance curve for the time of
+// day, dimmed by a random walk of cloud cover. A perturb and observe MPPT stage
+// hunts for the max power point, TrackingEff is how close it is.
+type SolarArray struct {
+	Irradiance   float64  `json:"irradiance"`      // W/m2 on the array
+	SunElevation float64  `json:"sun_elevation"`   // degrees above the horizon
+	CloudCover   float64  `json:"cloud_cover"`     // fraction of irradiance blocked
+	CellTemp     float64  `json:"cell_temp"`       // celcius
+	AvailWatts   float64  `json:"available_watts"` // power at the max power point
+	Watts        float64  `json:"watts"`           // DC output at the tracked point
+	Volts        float64  `json:"volts"`           // tracked operating voltage
+	Amps         float64  `json:"amps"`            // DC output current
+	TrackingEff  float64  `json:"tracking_efficiency"`
+	Limit        *float64 `json:"limit"` // output curtailed to watts by command, nil is unlimited
+
+	config  SolarConfig
+	mpptDir float64 // direction the tracker last moved, +1 or -1
+
+	base
+}
+
+// NewSolarArray create a solar array with the DefaultSolarConfig
+// ID = cid  code challenge id. Increment ID created by supervisor unique to all things
+func NewSolarArray(ID uint64) SolarArray {
+	return NewSolarArrayConfig(ID, DefaultSolarConfig())
+}
+
+// NewSolarArrayConfig create a solar array allocating configuration
+// ID = cid  code challenge id. Increment ID created by supervisor unique to all things
+// cfg = site and panel ratings
+func NewSolarArrayConfig(ID uint64, cfg SolarConfig) SolarArray {
+
+	s := SolarArray{
+		base:       newBase(ID, "SolarArray", UniformCadence(solarRandomDelayMin, solarRandomDelayMax)),
+		config:     cfg,
+		CloudCover: cfg.CloudCover,
+		Volts:      cfg.Vmp,
+		mpptDir:    1,
+	}
+	s.update(s.createdTime)
+	return s
+}
+
+// Emit implements thing interface to send events over Channel
+// c = channel writer for all events
+// wg = waitgroup needs to know when we are done with channel
+func (s *SolarArray) Emit(c chan<- ThingEvent, wg *sync.WaitGroup) {
+	s.run(c, wg, s.sample)
+}
+
+// sample advance the model to now and copy it for the event
+func (s *SolarArray) sample(now time.Time) interface{} {
+	s.stepClouds()
+	s.update(now)
+
+	c := *s
+	if s.Limit != nil {
+		limit := *s.Limit
+		c.Limit = &limit
+	}
+	return c
+}
+
+// solarState model of a SolarArray in a ThingState
+type solarState struct {
+	Array   *SolarArray `json:"array"`
+	Config  SolarConfig `json:"config"`
+	MPPTDir float64     `json:"mppt_dir"`
+}
+
+// Snapshot implements Snapshotter
+func (s *SolarArray) Snapshot() (ThingState, error) {
+	defer s.mu.Unlock()
+	s.mu.Lock()
+	return s.saveState(solarState{Array: s, Config: s.config, MPPTDir: s.mpptDir})
+}
+
+// Restore implements Snapshotter
+func (s *SolarArray) Restore(state ThingState) error {
+	defer s.mu.Unlock()
+	s.mu.Lock()
+
+	saved := solarState{Array: s}
+	if _, err := s.restoreState(state, &saved); err != nil {
+		return err
+	}
+	s.config = saved.Config
+	s.mpptDir = saved.MPPTDir
+	return nil
+}
+
+// NetWatts implements PowerFlow, the array is AC coupled so all of its output
+// is generation on the site
+func (s *SolarArray) NetWatts() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Watts
+}
+
+// EnergyRole implements PowerFlow
+func (s *SolarArray) EnergyRole() EnergyRole {
+	return RoleGeneration
+}
+
+// stepClouds random walk of the cloud cover, pulled back toward its mean
+func (s *SolarArray) stepClouds() {
+	pull := (s.config.CloudCover - s.CloudCover) * cloudReversion
+	s.CloudCover = round(clamp(s.CloudCover+pull+s.rng.RFloat(-s.config.CloudNoise, s.config.CloudNoise), 0, 1))
+}
+
+// update irradiance, temperature and output of the array at now
+func (s *SolarArray) update(now time.Time) {
+
+	s.SunElevation = round(sunElevation(now, s.config.Latitude, s.config.Longitude))
+	clearSky := 0.0
+	if s.SunElevation > 0 {
+		clearSky = stcIrradiance * math.Pow(math.Sin(s.SunElevation*math.Pi/180), 1.15)
+	}
+	s.Irradiance = round(clearSky * (1 - s.CloudCover))
+
+	s.CellTemp = round(s.config.AmbientTemp + s.Irradiance/noctIrradiance*noctRise)
+	derate := 1 + s.config.TempCoeff*(s.CellTemp-stcTemp)
+	s.AvailWatts = round(math.Max(0, s.config.RatedWatts*s.Irradiance/stcIrradiance*derate))
+
+	s.track()
+}
+
+// track one perturb and observe step of the MPPT. The tracker moves its
+// operating voltage a step and reverses whenever the power drops.
+func (s *SolarArray) track() {
+
+	vmp := s.config.Vmp * (1 + vmpTempCoeff*(s.CellTemp-stcTemp))
+	if s.AvailWatts <= 0 {
+		s.Volts, s.Watts, s.Amps, s.TrackingEff = 0, 0, 0, 0
+		return
+	}
+	if s.Volts <= 0 {
+		s.Volts = vmp
+	}
+
+	before := s.powerAt(s.Volts, vmp)
+	volts := s.Volts + s.mpptDir*solarMPPTStep
+	after := s.powerAt(volts, vmp)
+	if after < before {
+		s.mpptDir = -s.mpptDir
+	}
+
+	// a curtailed array holds its operating point, the tracker keeps hunting
+	watts := after
+	if s.Limit != nil {
+		watts = math.Min(watts, *s.Limit)
+	}
+
+	s.Volts = round(volts)
+	s.Watts = round(watts)
+	s.Amps = round(watts / volts)
+	s.TrackingEff = round(watts / s.AvailWatts)
+}
+
+// Control implements Controllable
+// limit = curtail the output to watts, or auto for no limit
+func (s *SolarArray) Control(cmd Command) Ack {
+	return s.control(cmd, s.apply)
+}
+
+// apply a command with the lock held
+func (s *SolarArray) apply(cmd Command) error {
+	switch cmd.Name {
+	case "limit":
+		if cmd.Value == cmdAuto {
+			s.Limit = nil
+			return nil
+		}
+		v, err := parseRange(cmd.Value, 0, s.config.RatedWatts)
+		if err != nil {
+			return err
+		}
+		s.Limit = &v
+	default:
+		return errUnknownCommand
+	}
+	return nil
+}
+
+// powerAt array output when operated at volts, falling away from vmp
+func (s *SolarArray) powerAt(volts, vmp float64) float64 {
+	dv := (volts - vmp) / vmp
+	return s.AvailWatts * math.Max(0, 1-mppCurvature*dv*dv)
+}
+
+// sunElevation degrees of the sun above the horizon at t for a site
+func sunElevation(t time.Time, latitude, longitude float64) float64 {
+
+	t = t.UTC()
+	rad := math.Pi / 180
+	declination := 23.45 * math.Sin(2*math.Pi*float64(284+t.YearDay())/365) * rad
+	solarHours := float64(t.Hour()) + float64(t.Minute())/60 + float64(t.Second())/3600 + longitude/15
+	hourAngle := 15 * (solarHours - 12) * rad
+	lat := latitude * rad
+
+	sinElevation := math.Sin(lat)*math.Sin(declination) + math.Cos(lat)*math.Cos(declination)*math.Cos(hourAngle)
+	return math.Asin(sinElevation) / rad
+}
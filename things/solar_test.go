@@ -0,0 +1,34 @@
+package things
+
+import (
+	"testing"
+	"time"
+)
+
+// TestSolarDayCurve no output at night, output at noon, and the tracker
+// settles near the max power point.
+func TestSolarDayCurve(t *testing.T) {
+
+	cfg := DefaultSolarConfig()
+	cfg.Longitude = 0
+	cfg.CloudCover = 0
+	cfg.CloudNoise = 0
+	solar := NewSolarArrayConfig(1, cfg)
+
+	midnight := time.Date(2020, 6, 21, 0, 0, 0, 0, time.UTC)
+	solar.update(midnight)
+	if solar.Irradiance != 0 || solar.Watts != 0 {
+		t.Errorf("expected no output at midnight: %f W/m2 %f W", solar.Irradiance, solar.Watts)
+	}
+
+	noon := time.Date(2020, 6, 21, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 50; i++ {
+		solar.update(noon)
+	}
+	if solar.Irradiance < 900 {
+		t.Errorf("expected summer noon irradiance near 1000 W/m2: %f", solar.Irradiance)
+	}
+	if solar.Watts > solar.AvailWatts || solar.TrackingEff < 0.99 {
+		t.Errorf("tracker did not settle at the max power point: %f of %f W", solar.Watts, solar.AvailWatts)
+	}
+}
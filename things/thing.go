@@ -1,6 +1,7 @@
 package things
 
 import (
+	"encoding/json"
 	"math"
 	"math/rand"
 	"sync"
@@ -13,30 +14,85 @@ const (
 
 var (
 	// note: crypto rand not required here
-	seed = rand.NewSource(time.Now().UnixNano()) // seed for random generators
-	rn   = rand.New(seed)                        // init the random object
+	// things draw from their own generators, see newRng. rn serves RFloat and RInt
+	rn     = rand.New(rand.NewSource(runSeed)) // init the random object
+	rnLock sync.Mutex                          // rand.Rand is not safe for concurrent use
 
 	// ZeroStruct empty struct to use as trigger
 	ZeroStruct = struct{}{}
 )
 
-//go:generate stringer -type=ThingType
+// ThingType handle of a thing type added to the registry, see Register
 type ThingType uint8
 
-// possible types to instantiate for thing interface
+// possible types to instantiate for thing interface, the built in types
+// register themselves like any other
+var (
+	TBatteryPack = Register("BatteryPack", "b", func(ID uint64) Thing { b := NewBatteryPack(ID); return &b })
+	TInverter    = Register("Inverter", "i", func(ID uint64) Thing { i := NewInverter(ID); return &i })
+	TLight       = Register("Light", "l", func(ID uint64) Thing { l := NewLight(ID); return &l })
+	TSolarArray  = Register("SolarArray", "s", func(ID uint64) Thing { s := NewSolarArray(ID); return &s })
+	TGridMeter   = Register("GridMeter", "g", func(ID uint64) Thing { g := NewGridMeter(ID); return &g })
+	TEVCharger   = Register("EVCharger", "e", func(ID uint64) Thing { e := NewEVCharger(ID); return &e })
+)
+
+// EventKind distinguishes periodic telemetry from the other events a thing
+// publishes in the same stream
+type EventKind string
+
+// kinds of events
 const (
-	TBatteryPack ThingType = iota + 1
-	TInverter
-	TLight
+	KindTelemetry EventKind = "telemetry" // periodic reading of the thing
+	KindSession   EventKind = "session"   // EV charging session started or stopped
+	KindCommand   EventKind = "command"   // answer of a thing to a Command
+	KindSite      EventKind = "site"      // energy balance of a site, see ThingTypeSite
+	KindAlarm     EventKind = "alarm"     // alarm raised or cleared by a thing
+	KindLifecycle EventKind = "lifecycle" // thing moved to another State, see Transition
+	KindWatchdog  EventKind = "watchdog"  // thing went stale or recovered, published by the listener
 )
 
+// ThingTypeSite thing_type of the aggregate events published for a site
+const ThingTypeSite = "Site"
+
+// EventSchema version of the ThingEvent envelope written by the listener.
+// Files written before the envelope was versioned read as schema 0.
+const EventSchema = 1
+
 // ThingEvent event that holds things published data
-// It enforces certain fields will be implemented by all things
+// It enforces certain fields will be implemented by all things. Things fill
+// in the time, thing and payload; the listener stamps the schema, ID, global
+// sequence and ingested time as it receives the event.
 type ThingEvent struct {
-	TS        time.Time   `json:"ts"`               //  time event was created
-	ThingID   uint64      `json:"event_type_count"` // count of each event type that was created. This is unique to each type
-	ThingType string      `json:"thing_type"`       // type of thing that emitted the event
-	EventData interface{} `json:"event_data"`       // json serialized struct of each event type
+	Schema    int         `json:"schema"`     // version of the envelope, see EventSchema
+	ID        string      `json:"event_id"`   // unique to the event, the run of the listener and its Seq
+	Seq       uint64      `json:"seq"`        // order the listener received events in, a gap is an event lost
+	ThingSeq  uint64      `json:"thing_seq"`  // order of the events of the thing, 0 for events the listener publishes
+	TS        time.Time   `json:"ts"`         // time the event was emitted
+	Ingested  time.Time   `json:"ingested"`   // clock time the listener received the event
+	ThingID   uint64      `json:"thing_id"`   // CID of the thing that emitted the event
+	ThingType string      `json:"thing_type"` // type of thing that emitted the event
+	Kind      EventKind   `json:"kind"`       // what EventData carries
+	EventData interface{} `json:"event_data"` // json serialized struct of each event type
+	Replayed  bool        `json:"-"`          // sent by a replay, not by the thing of ThingID
+}
+
+// UnmarshalJSON reads files written before the envelope was versioned too,
+// when the CID was under event_type_count. Like the default, a pointer set
+// in EventData is decoded into.
+func (e *ThingEvent) UnmarshalJSON(data []byte) error {
+	type envelope ThingEvent // without this method
+	v := struct {
+		envelope
+		LegacyID *uint64 `json:"event_type_count"`
+	}{envelope: envelope(*e)}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*e = ThingEvent(v.envelope)
+	if v.LegacyID != nil && e.ThingID == 0 {
+		e.ThingID = *v.LegacyID
+	}
+	return nil
 }
 
 // CID short description used to display running CIDs (CodeChallenge ID / things)
@@ -45,6 +101,10 @@ type CID struct {
 	CreateTime time.Time // time thing was started
 	Type       string    // name of thing type
 	TTLEvents  uint64    // total events published
+	Site       string    // name of the site the thing belongs to
+	Alarms     int       // active alarms
+	State      State     // lifecycle state
+	Stale      bool      // silent for longer than its cadence allows, set by the listener watchdog
 }
 
 // Thing this interface is implemented by all things
@@ -54,6 +114,43 @@ type Thing interface {
 	Stop()                                   // stop sending events, and exit emit()
 }
 
+// SiteMeter implemented by things that measure the net power of their site,
+// the supervisor hands them the source of that power when they are created
+type SiteMeter interface {
+	SetNetPower(func() float64) // power injected into the site by the other things on it
+	GridWatts() float64         // net power measured at the point of connection, positive while importing
+}
+
+// EnergyRole part a PowerFlow plays in the energy balance of its site
+type EnergyRole uint8
+
+// energy roles
+const (
+	RoleLoad       EnergyRole = iota + 1 // draws power from the site
+	RoleGeneration                       // injects power into the site
+	RoleStorage                          // injects while discharging, draws while charging
+)
+
+// String name of the role
+func (r EnergyRole) String() string {
+	switch r {
+	case RoleLoad:
+		return "load"
+	case RoleGeneration:
+		return "generation"
+	case RoleStorage:
+		return "storage"
+	}
+	return "unknown"
+}
+
+// PowerFlow implemented by things that move AC power on a site, lets a
+// GridMeter work out the net power at the point of connection
+type PowerFlow interface {
+	NetWatts() float64      // positive injects power into the site, negative draws from it
+	EnergyRole() EnergyRole // how the flow is booked in the site energy balance
+}
+
 //---------------------------------------------------------
 // convenience utility funcs below
 //---------------------------------------------------------
@@ -62,11 +159,25 @@ type Thing interface {
 // things use it to generate erratic, but bounded data
 // round everything to four precision digits for simpler output
 func RFloat(min, max float64) float64 {
+	rnLock.Lock()
 	r := min + rn.Float64()*(max-min)
+	rnLock.Unlock()
 	return math.Round(r*precision) / precision
 }
 
 // RInt generates an int between min<->max range
 func RInt(min, max int) int {
-	return rand.Intn(max-min) + min
+	defer rnLock.Unlock()
+	rnLock.Lock()
+	return rn.Intn(max-min) + min
+}
+
+// round to the precision used on all float output
+func round(v float64) float64 {
+	return math.Round(v*precision) / precision
+}
+
+// clamp bound v to min<->max range
+func clamp(v, min, max float64) float64 {
+	return math.Max(min, math.Min(max, v))
 }
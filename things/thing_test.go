@@ -1,8 +1,10 @@
 package things
 
 import (
+	"encoding/json"
 	"errors"
 	"testing"
+	"time"
 )
 
 var (
@@ -25,3 +27,66 @@ func TestMinMaxFloat(t *testing.T) {
 		cnt++
 	}
 }
+
+// TestSeededRuns the same seed and CID give the same values, a different CID
+// its own sequence
+func TestSeededRuns(t *testing.T) {
+
+	defer SetSeed(Seed())
+	SetSeed(42)
+
+	run := func(ID uint64) []float64 {
+		battery := NewBatteryPack(ID)
+		now := battery.lastUpdate
+		values := make([]float64, 0)
+		for i := 0; i < 100; i++ {
+			now = now.Add(time.Second)
+			battery.update(now)
+			values = append(values, battery.AmpMeter.LiveAmps, battery.TTLVoltage)
+		}
+		return values
+	}
+
+	first, second, other := run(7), run(7), run(8)
+	same := true
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("seeded runs differ at %d: %f %f", i, first[i], second[i])
+		}
+		same = same && first[i] == other[i]
+	}
+	if same {
+		t.Error("things with different CIDs produced the same values")
+	}
+}
+
+// TestEventEnvelope events read back with their envelope, and lines written
+// before it was versioned keep their CID
+func TestEventEnvelope(t *testing.T) {
+
+	ts := time.Date(2020, 6, 21, 12, 0, 0, 0, time.UTC)
+	e := ThingEvent{Schema: EventSchema, ID: "run-3", Seq: 3, ThingSeq: 2, TS: ts, Ingested: ts, ThingID: 7,
+		ThingType: "Light", Kind: KindTelemetry, EventData: map[string]int{"state": 1}}
+	line, _ := json.Marshal(e)
+
+	var data json.RawMessage
+	read := ThingEvent{EventData: &data}
+	if err := json.Unmarshal(line, &read); err != nil {
+		t.Fatal(err)
+	}
+	if read.ID != e.ID || read.Seq != 3 || read.ThingSeq != 2 || read.ThingID != 7 || !read.Ingested.Equal(ts) {
+		t.Errorf("expected the envelope read back: %+v", read)
+	}
+	if string(data) != `{"state":1}` {
+		t.Errorf("expected the payload decoded into the raw message: %s", data)
+	}
+
+	legacy := `{"ts":"2020-06-21T12:00:00Z","event_type_count":5,"thing_type":"Light","kind":"telemetry","event_data":{}}`
+	var old ThingEvent
+	if err := json.Unmarshal([]byte(legacy), &old); err != nil {
+		t.Fatal(err)
+	}
+	if old.ThingID != 5 || old.Schema != 0 || old.ThingType != "Light" {
+		t.Errorf("expected the legacy line read with its CID: %+v", old)
+	}
+}
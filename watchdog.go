@@ -0,0 +1,166 @@
+package tslab
+
+import (
+	"time"
+
+	"github.com/dfense/tslab/things"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	watchStale     = "stale"     // silent for longer than its cadence allows
+	watchRecovered = "recovered" // emitting again after being stale
+)
+
+var (
+	watchdogInterval      = time.Second // clock time between checks of the watchdog
+	defaultWatchdogFactor = 10.0        // gaps of a thing allowed before it is stale
+)
+
+// Watchdog payload of a KindWatchdog event, published when a thing goes stale
+// and again when it recovers
+type Watchdog struct {
+	Status    string    `json:"status"`            // stale or recovered
+	LastEvent time.Time `json:"last_event"`        // clock time the last event of the thing was received
+	Silent    float64   `json:"silent_seconds"`    // time since that event
+	Threshold float64   `json:"threshold_seconds"` // silence allowed by the cadence of the thing
+}
+
+// SetWatchdog how many of its usual gaps between events a thing may stay
+// silent before it is flagged stale, 0 turns the watchdog off. Set it before
+// StartListener.
+func (l *Listener) SetWatchdog(factor float64) {
+	l.watchdog = factor
+}
+
+// seen note an event of a thing was received, called by the pump on receipt
+// so events dropped by backpressure still count. The events of the sites and
+// of the watchdog itself aren't from a thing, nor are replayed ones, which
+// would otherwise hide a live thing of the same ID going silent.
+func (l *Listener) seen(e things.ThingEvent) {
+	if e.Replayed || e.ThingType == things.ThingTypeSite || e.Kind == things.KindWatchdog {
+		return
+	}
+	now := l.clock.Now()
+	l.watchLock.Lock()
+	l.lastSeen[e.ThingID] = now
+	l.watchLock.Unlock()
+}
+
+// watchdogLoop flag things that go silent for longer than their cadence
+// allows, until told to stop
+func (l *Listener) watchdogLoop() {
+
+	ticker := l.clock.NewTicker(watchdogInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			// the tick may be late, events seen since are stamped with the clock
+			for _, e := range l.checkWatchdog(l.clock.Now()) {
+				l.eventC <- e
+			}
+		case <-l.watchStopC:
+			return
+		}
+	}
+}
+
+// checkWatchdog compare the silence of every watched thing with its
+// threshold, returns the events of the things that went stale or recovered
+func (l *Listener) checkWatchdog(now time.Time) []things.ThingEvent {
+
+	events := make([]things.ThingEvent, 0)
+	running := make(map[uint64]bool)
+
+	for _, t := range l.GetThings() {
+		cid := t.ShortD()
+		running[cid.CidNumber] = true
+		threshold, watched := l.threshold(t, cid)
+
+		l.watchLock.Lock()
+		last, ok := l.lastSeen[cid.CidNumber]
+		if !ok {
+			last = now // subscribed since the last check
+			l.lastSeen[cid.CidNumber] = now
+		}
+		silent := now.Sub(last)
+		status := ""
+		switch {
+		case !watched:
+			delete(l.stale, cid.CidNumber) // paused or stopped things are meant to be silent
+		case !l.stale[cid.CidNumber] && silent > threshold:
+			l.stale[cid.CidNumber] = true
+			status = watchStale
+		case l.stale[cid.CidNumber] && silent <= threshold:
+			delete(l.stale, cid.CidNumber)
+			status = watchRecovered
+		}
+		l.watchLock.Unlock()
+
+		if status == "" {
+			continue
+		}
+		log.Infof("watchdog: %s %d %s, silent %s", cid.Type, cid.CidNumber, status, silent)
+		events = append(events, things.ThingEvent{
+			TS:        now,
+			ThingID:   cid.CidNumber,
+			ThingType: cid.Type,
+			Kind:      things.KindWatchdog,
+			EventData: Watchdog{Status: status, LastEvent: last, Silent: silent.Seconds(), Threshold: threshold.Seconds()},
+		})
+	}
+
+	// forget the things no longer running
+	l.watchLock.Lock()
+	for cid := range l.lastSeen {
+		if !running[cid] {
+			delete(l.lastSeen, cid)
+			delete(l.stale, cid)
+		}
+	}
+	l.watchLock.Unlock()
+	return events
+}
+
+// threshold silence allowed for a thing, false if it isn't watched. Things
+// without a cadence, like a replay, aren't watched, nor are paused ones.
+// A thing reporting by exception is allowed its integrity period.
+func (l *Listener) threshold(t things.Thing, cid things.CID) (time.Duration, bool) {
+
+	if cid.State != things.StateRunning && cid.State != things.StateFaulted {
+		return 0, false
+	}
+	c, ok := t.(things.Cadenced)
+	if !ok {
+		return 0, false
+	}
+
+	cadence := c.Cadence()
+	gap := cadence.Mean()
+	switch cadence.Mode {
+	case things.CadenceUniform:
+		gap = cadence.Max
+	case things.CadenceJitter:
+		gap = time.Duration(float64(cadence.Period) * (1 + cadence.Jitter))
+	}
+	threshold := time.Duration(float64(gap) * l.watchdog)
+
+	if e, ok := t.(things.Exceptional); ok && e.Exception().Enabled {
+		integrity := e.Exception().Integrity
+		if integrity == 0 {
+			return 0, false // may stay silent for good
+		}
+		if integrity+gap > threshold {
+			threshold = integrity + gap
+		}
+	}
+	return threshold, true
+}
+
+// isStale the thing is flagged stale by the watchdog
+func (l *Listener) isStale(cid uint64) bool {
+	defer l.watchLock.Unlock()
+	l.watchLock.Lock()
+	return l.stale[cid]
+}
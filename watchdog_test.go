@@ -0,0 +1,180 @@
+package tslab
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dfense/tslab/things"
+)
+
+// watchedThing a thing that never emits on its own, in the state and with the
+// cadence and exception settings the test gives it
+type watchedThing struct {
+	mu        sync.Mutex
+	id        uint64
+	state     things.State
+	cadence   things.Cadence
+	exception *things.Exception
+}
+
+func (w *watchedThing) Emit(c chan<- things.ThingEvent, wg *sync.WaitGroup) {}
+func (w *watchedThing) Stop()                                               {}
+
+func (w *watchedThing) ShortD() things.CID {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return things.CID{CidNumber: w.id, Type: "Watched", State: w.state}
+}
+
+func (w *watchedThing) setState(s things.State) {
+	w.mu.Lock()
+	w.state = s
+	w.mu.Unlock()
+}
+
+func (w *watchedThing) Cadence() things.Cadence           { return w.cadence }
+func (w *watchedThing) SetCadence(c things.Cadence) error { w.cadence = c; return nil }
+
+// exceptionalThing a watched thing reporting by exception
+type exceptionalThing struct{ *watchedThing }
+
+func (e exceptionalThing) Exception() things.Exception           { return *e.exception }
+func (e exceptionalThing) SetException(x things.Exception) error { *e.exception = x; return nil }
+
+// stillClock a clock that reads the time the test sets
+type stillClock struct {
+	things.Clock
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *stillClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *stillClock) set(now time.Time) {
+	c.mu.Lock()
+	c.now = now
+	c.mu.Unlock()
+}
+
+// watchdogListener a listener that isn't started, its watchdog checked by
+// the test
+func watchdogListener(start time.Time) (*Listener, *stillClock) {
+	clock := &stillClock{Clock: things.NewAFAPClock(start), now: start}
+	l := NewListener()
+	l.SetClock(clock)
+	l.SetWatchdog(10)
+	return l, clock
+}
+
+// statuses the watchdog status of each thing in events
+func statuses(events []things.ThingEvent) map[uint64]string {
+	s := make(map[uint64]string)
+	for _, e := range events {
+		s[e.ThingID] = e.EventData.(Watchdog).Status
+	}
+	return s
+}
+
+// TestWatchdog a running thing silent for longer than its cadence allows goes
+// stale once, and recovers once it is heard from again. A stopped or paused
+// thing is meant to be silent and is never flagged.
+func TestWatchdog(t *testing.T) {
+
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	l, clock := watchdogListener(start)
+	silent := &watchedThing{id: 1, state: things.StateRunning, cadence: things.FixedCadence(time.Second)}
+	stopped := &watchedThing{id: 2, state: things.StateStopped, cadence: things.FixedCadence(time.Second)}
+	paused := &watchedThing{id: 3, state: things.StatePaused, cadence: things.FixedCadence(time.Second)}
+	for _, w := range []*watchedThing{silent, stopped, paused} {
+		l.SubscribeToThing(w)
+	}
+
+	steps := []struct {
+		at    time.Duration // after start
+		heard bool          // from the silent thing just before
+		want  map[uint64]string
+	}{
+		{5 * time.Second, false, map[uint64]string{}},
+		{10 * time.Second, false, map[uint64]string{}}, // silence of the threshold is allowed
+		{11 * time.Second, false, map[uint64]string{1: watchStale}},
+		{60 * time.Second, false, map[uint64]string{}}, // flagged once
+		{61 * time.Second, true, map[uint64]string{1: watchRecovered}},
+		{65 * time.Second, false, map[uint64]string{}},
+		{100 * time.Second, false, map[uint64]string{1: watchStale}},
+	}
+	for _, step := range steps {
+		now := start.Add(step.at)
+		if step.heard {
+			clock.set(now)
+			l.seen(things.ThingEvent{ThingID: silent.id, ThingType: "Watched"})
+		}
+		events := l.checkWatchdog(now)
+		if got := statuses(events); len(got) != len(step.want) || got[1] != step.want[1] {
+			t.Errorf("at %s: expected %v: %v", step.at, step.want, got)
+		}
+		for _, e := range events {
+			w := e.EventData.(Watchdog)
+			if e.Kind != things.KindWatchdog || w.Threshold != 10 || !e.TS.Equal(now) {
+				t.Errorf("at %s: expected a watchdog event at now with a 10s threshold: %+v", step.at, e)
+			}
+		}
+	}
+	if !l.isStale(silent.id) || l.isStale(stopped.id) || l.isStale(paused.id) {
+		t.Errorf("expected only the silent thing stale: %t %t %t", l.isStale(silent.id), l.isStale(stopped.id), l.isStale(paused.id))
+	}
+
+	// stopping a stale thing clears the flag without a recovery
+	silent.setState(things.StateStopped)
+	if events := l.checkWatchdog(start.Add(101 * time.Second)); len(events) != 0 || l.isStale(silent.id) {
+		t.Errorf("expected a stopped thing to be no longer stale: %v", statuses(events))
+	}
+}
+
+// TestWatchdogThreshold the silence allowed is the longest usual gap of the
+// cadence times the factor, or the integrity period of a thing reporting by
+// exception if longer. Things that may stay silent for good aren't watched.
+func TestWatchdogThreshold(t *testing.T) {
+
+	l, _ := watchdogListener(time.Now())
+	running := func(c things.Cadence) *watchedThing {
+		return &watchedThing{id: 1, state: things.StateRunning, cadence: c}
+	}
+	exceptional := func(integrity time.Duration) things.Thing {
+		w := running(things.FixedCadence(time.Second))
+		w.exception = &things.Exception{Enabled: true, Integrity: integrity}
+		return exceptionalThing{w}
+	}
+	faulted := running(things.FixedCadence(time.Second))
+	faulted.state = things.StateFaulted
+
+	tests := []struct {
+		name      string
+		thing     things.Thing
+		threshold time.Duration
+		watched   bool
+	}{
+		{"fixed", running(things.FixedCadence(time.Second)), 10 * time.Second, true},
+		{"uniform", running(things.UniformCadence(time.Second, 3*time.Second)), 30 * time.Second, true},
+		{"jitter", running(things.JitterCadence(time.Second, 0.5)), 15 * time.Second, true},
+		{"faulted", faulted, 10 * time.Second, true},
+		{"short integrity", exceptional(5 * time.Second), 10 * time.Second, true},
+		{"long integrity", exceptional(time.Minute), time.Minute + time.Second, true},
+		{"no integrity", exceptional(0), 0, false},
+		{"no cadence", NewReplay(1, nil, ReplayConfig{}), 0, false},
+	}
+	for _, tt := range tests {
+		cid := tt.thing.ShortD()
+		if _, ok := tt.thing.(*Replay); ok {
+			cid.State = things.StateRunning // as while replaying
+		}
+		threshold, watched := l.threshold(tt.thing, cid)
+		if threshold != tt.threshold || watched != tt.watched {
+			t.Errorf("%s: expected %s watched %t: %s %t", tt.name, tt.threshold, tt.watched, threshold, watched)
+		}
+	}
+}